@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+var batchCmd = newCommand("batch", "convert in parallel all the xlsforms in directories, printing a summary")
+
+func init() {
+	batchCmd.args = "dir1 form1.xlsx..."
+	in := inputFlags(batchCmd.flags)
+	out := outputFlags(batchCmd.flags)
+	batchCmd.flags.Lookup("o").Usage = "output directory, where the directory structure of the inputs is replicated"
+	diagFlags(batchCmd.flags)
+	jobs := batchCmd.flags.Int("j", runtime.NumCPU(), "number of files converted at the same time")
+	reportFile := batchCmd.flags.String("report", "", "write a report to this file, as JUnit XML if it ends with .xml, as json otherwise")
+	batchCmd.run = func(args []string) bool {
+		if out.path == "-" {
+			fmt.Fprintln(os.Stderr, "The output of batch can't be stdout.")
+			return false
+		}
+		if out.path != "" {
+			out.dir = true
+		}
+		files, err := findForms(args)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return false
+		}
+		start := time.Now()
+		results := convertAll(files, checkOutputs(files, out), *jobs, in, out)
+		elapsed := time.Since(start)
+
+		if report.toStdout() {
+			for _, r := range results {
+				for _, w := range r.Warnings {
+					report.warning(r.File, w)
+				}
+				if r.err != nil {
+					report.error(r.File, r.err)
+				}
+			}
+		} else {
+			printSummary(os.Stdout, results, elapsed)
+		}
+		if *reportFile != "" {
+			write := writeJsonReport
+			if strings.ToLower(filepath.Ext(*reportFile)) == ".xml" {
+				write = writeJunitReport
+			}
+			err := formats.WriteFile(*reportFile, func(w io.Writer) error {
+				return write(w, results, elapsed)
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing report %s: %s\n", *reportFile, err)
+				return false
+			}
+		}
+		for _, r := range results {
+			if r.Error != "" {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// A batchFile is a form to convert, rel is its path relative
+// to the directory it was found in, used to name the output.
+type batchFile struct{ path, rel string }
+
+// findForms lists the xlsforms in the given files and directories,
+// each one once even if it's given more times.
+func findForms(args []string) ([]batchFile, error) {
+	var files []batchFile
+	seen := make(map[string]bool)
+	add := func(f batchFile) {
+		if p := filepath.Clean(f.path); !seen[p] {
+			seen[p] = true
+			files = append(files, f)
+		}
+	}
+	for _, arg := range args {
+		stat, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !stat.IsDir() {
+			add(batchFile{arg, filepath.Base(arg)})
+			continue
+		}
+		err = filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || !isFormFile(path) {
+				return nil
+			}
+			rel, err := filepath.Rel(arg, path)
+			if err != nil {
+				return err
+			}
+			add(batchFile{path, rel})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+type batchResult struct {
+	File     string               `json:"file"`
+	Output   string               `json:"output,omitempty"`
+	Error    string               `json:"error,omitempty"`
+	Warnings []formats.Diagnostic `json:"warnings,omitempty"`
+	Time     time.Duration        `json:"-"`
+	Seconds  float64              `json:"seconds"`
+
+	err error // the error of Error, for the diagnostics
+}
+
+// batchOutput is the name of the ajf form converted from f.
+func batchOutput(f batchFile, out *outputOptions) string {
+	if out.dir {
+		return filepath.Join(out.path, strings.TrimSuffix(f.rel, filepath.Ext(f.rel))+".json")
+	}
+	return strings.TrimSuffix(f.path, filepath.Ext(f.path)) + ".json"
+}
+
+// checkOutputs returns, for each file, an error if its output would also be
+// written by other files (like a/form.xlsx and b/form.xlsx with -o):
+// these files aren't converted, rather than overwriting each other.
+func checkOutputs(files []batchFile, out *outputOptions) []error {
+	byOutput := make(map[string][]int)
+	for i, f := range files {
+		output := filepath.Clean(batchOutput(f, out))
+		byOutput[output] = append(byOutput[output], i)
+	}
+	errs := make([]error, len(files))
+	for output, indexes := range byOutput {
+		if len(indexes) < 2 {
+			continue
+		}
+		for _, i := range indexes {
+			var others []string
+			for _, j := range indexes {
+				if j != i {
+					others = append(others, files[j].path)
+				}
+			}
+			errs[i] = fmt.Errorf("%s, the output %s would also be written by %s.", files[i].path, output, strings.Join(others, ", "))
+		}
+	}
+	return errs
+}
+
+// convertAll converts the files using the given number of goroutines,
+// except those with an error in errs.
+// The results are in the same order as the files.
+func convertAll(files []batchFile, errs []error, jobs int, in *inputOptions, out *outputOptions) []batchResult {
+	if jobs < 1 {
+		jobs = 1
+	}
+	results := make([]batchResult, len(files))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if errs[i] != nil {
+					results[i] = batchResult{File: files[i].path, Error: errs[i].Error(), err: errs[i]}
+				} else {
+					results[i] = convertBatchFile(files[i], in, out)
+				}
+				if report.toStdout() {
+					continue // reported at the end
+				}
+				for _, w := range results[i].Warnings {
+					report.warning(results[i].File, w)
+				}
+				if results[i].Error != "" {
+					fmt.Fprintln(os.Stderr, results[i].Error)
+				}
+			}
+		}()
+	}
+	for i := range files {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
+
+func convertBatchFile(f batchFile, in *inputOptions, out *outputOptions) (res batchResult) {
+	start := time.Now()
+	res.File = f.path
+	defer func() {
+		res.Time = time.Since(start)
+		res.Seconds = res.Time.Seconds()
+	}()
+
+	xls, err := decode(f.path, in)
+	if err != nil {
+		res.Error, res.err = err.Error(), err
+		return
+	}
+	res.Warnings = xls.Warnings
+	ajf, err := formats.Convert(xls)
+	if err != nil {
+		res.err = fmt.Errorf("%s, %w", f.path, err)
+		res.Error = res.err.Error()
+		return
+	}
+	output := batchOutput(f, out)
+	if out.dir {
+		if err := os.MkdirAll(filepath.Dir(output), 0777); err != nil {
+			res.err = fmt.Errorf("Error creating output directory: %s", err)
+			res.Error = res.err.Error()
+			return
+		}
+	}
+	if err := out.encJson(output, ajf); err != nil {
+		res.err = fmt.Errorf("Error encoding file %s: %s", output, err)
+		res.Error = res.err.Error()
+		return
+	}
+	res.Output = output
+	return
+}
+
+func printSummary(w io.Writer, results []batchResult, elapsed time.Duration) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "File\tResult\tWarnings\tTime\n")
+	failed := 0
+	for _, r := range results {
+		result := "ok"
+		if r.Error != "" {
+			result = "FAILED"
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", r.File, result, len(r.Warnings), r.Time.Round(time.Millisecond))
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\n%d converted, %d failed in %s.\n", len(results)-failed, failed, elapsed.Round(time.Millisecond))
+}
+
+func writeJsonReport(w io.Writer, results []batchResult, elapsed time.Duration) error {
+	summary := struct {
+		Files     []batchResult `json:"files"`
+		Succeeded int           `json:"succeeded"`
+		Failed    int           `json:"failed"`
+		Seconds   float64       `json:"seconds"`
+	}{Files: results, Seconds: elapsed.Seconds()}
+	for _, r := range results {
+		if r.Error != "" {
+			summary.Failed++
+		} else {
+			summary.Succeeded++
+		}
+	}
+	return formats.EncIndentedJson(w, summary)
+}
+
+type junitSuites struct {
+	XMLName xml.Name   `xml:"testsuites"`
+	Suite   junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemErr string        `xml:"system-err,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+}
+
+func writeJunitReport(w io.Writer, results []batchResult, elapsed time.Duration) error {
+	suite := junitSuite{Name: "formconv", Tests: len(results), Time: junitTime(elapsed)}
+	for _, r := range results {
+		c := junitCase{Name: r.File, ClassName: "formconv", Time: junitTime(r.Time)}
+		if r.Error != "" {
+			c.Failure = &junitFailure{r.Error}
+			suite.Failures++
+		}
+		var warns []string
+		for _, w := range r.Warnings {
+			warns = append(warns, w.Error())
+		}
+		c.SystemErr = strings.Join(warns, "\n")
+		suite.Cases = append(suite.Cases, c)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(junitSuites{Suite: suite}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func junitTime(d time.Duration) string { return fmt.Sprintf("%.3f", d.Seconds()) }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+var codebookCmd = newCommand("codebook", "write codebooks of xlsforms, documenting their fields for data analysis")
+
+func init() {
+	in := inputFlags(codebookCmd.flags)
+	out := outputPathFlag(codebookCmd.flags)
+	codebookCmd.flags.Lookup("o").Usage = outputFileUsage
+	format := codebookCmd.flags.String("to", "csv", "output format: csv, xlsx or md (markdown)")
+	diagFlags(codebookCmd.flags)
+	codebookCmd.run = func(files []string) bool {
+		if *format != "csv" && *format != "xlsx" && *format != "md" {
+			fmt.Fprintln(os.Stderr, "The output format must be csv, xlsx or md.")
+			return false
+		}
+		if err := out.init(len(files)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return false
+		}
+		return forEachFile(files, func(fileName string) error {
+			return codebook(fileName, *format, in, out)
+		})
+	}
+}
+
+func codebook(xlsName, format string, in *inputOptions, out *outputOptions) error {
+	outName, err := out.fileName(xlsName, ".codebook."+format)
+	if err != nil {
+		return err
+	}
+	if err := report.checkOutput(outName); err != nil {
+		return err
+	}
+	xls, err := decodeFile(xlsName, in)
+	if err != nil {
+		return err
+	}
+	ajf, err := formats.Convert(xls)
+	if err != nil {
+		return fmt.Errorf("%s, %w", xlsName, err)
+	}
+	cb := formats.BuildCodebook(ajf)
+	err = out.write(outName, func(w io.Writer) error {
+		switch format {
+		case "xlsx":
+			return formats.EncCodebookXlsx(w, cb)
+		case "md":
+			title := strings.TrimSuffix(filepath.Base(xlsName), filepath.Ext(xlsName))
+			if xlsName == "-" {
+				title = "Form"
+			}
+			return formats.EncCodebookMarkdown(w, cb, title)
+		default:
+			return formats.EncCodebookCsv(w, cb)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("Error writing file %s: %s", outName, err)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+var convertCmd = newCommand("convert", "convert xlsforms to ajf json files")
+
+type outputOptions struct {
+	path    string
+	dir     bool // path is a directory
+	compact bool
+}
+
+const outputFileUsage = "output file, or directory if it ends with a slash or there are many inputs; - for stdout"
+
+func init() {
+	in := inputFlags(convertCmd.flags)
+	out := outputFlags(convertCmd.flags)
+	convertCmd.flags.Lookup("o").Usage = outputFileUsage
+	diagFlags(convertCmd.flags)
+	convertCmd.run = func(files []string) bool {
+		if err := out.init(len(files)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return false
+		}
+		return forEachFile(files, func(fileName string) error {
+			return decXlsEncAjf(fileName, in, out)
+		})
+	}
+}
+
+// outputFlags defines the flags controlling where and how the output is written.
+func outputFlags(fs *flag.FlagSet) *outputOptions {
+	out := outputPathFlag(fs)
+	fs.BoolVar(&out.compact, "compact", false, "write compact json instead of indenting it")
+	return out
+}
+
+// outputPathFlag defines only the -o flag, for outputs that aren't json.
+func outputPathFlag(fs *flag.FlagSet) *outputOptions {
+	out := new(outputOptions)
+	fs.StringVar(&out.path, "o", "", "output directory")
+	return out
+}
+
+// init decides whether the output path is a directory, creating it if needed.
+func (o *outputOptions) init(numFiles int) error {
+	if o.path == "" || o.path == "-" {
+		return nil
+	}
+	stat, err := os.Stat(o.path)
+	o.dir = err == nil && stat.IsDir() || numFiles > 1 ||
+		strings.HasSuffix(o.path, "/") || strings.HasSuffix(o.path, string(filepath.Separator))
+	if !o.dir {
+		return nil
+	}
+	return o.mkdir()
+}
+
+func (o *outputOptions) mkdir() error {
+	if err := os.MkdirAll(o.path, 0777); err != nil {
+		return fmt.Errorf("Error creating output directory: %s", err)
+	}
+	return nil
+}
+
+// fileName returns the output file for an input, "-" for stdout.
+func (o *outputOptions) fileName(xlsName, ext string) (string, error) {
+	switch {
+	case o.path == "" && xlsName == "-":
+		return "-", nil
+	case o.path == "":
+		return strings.TrimSuffix(xlsName, filepath.Ext(xlsName)) + ext, nil
+	case !o.dir:
+		return o.path, nil
+	case xlsName == "-":
+		return "", fmt.Errorf("An output file name (not a directory) is needed when reading from stdin.")
+	}
+	base := filepath.Base(xlsName)
+	return filepath.Join(o.path, strings.TrimSuffix(base, filepath.Ext(base))+ext), nil
+}
+
+// write writes the output file, or stdout if fileName is "-".
+func (o *outputOptions) write(fileName string, write func(w io.Writer) error) error {
+	if fileName != "-" {
+		return formats.WriteFile(fileName, write)
+	}
+	w := bufio.NewWriter(os.Stdout)
+	if err := write(w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func (o *outputOptions) encJson(fileName string, e interface{}) error {
+	return o.write(fileName, func(w io.Writer) error {
+		if o.compact {
+			return formats.EncCompactJson(w, e)
+		}
+		return formats.EncIndentedJson(w, e)
+	})
+}
+
+func decXlsEncAjf(xlsName string, in *inputOptions, out *outputOptions) error {
+	ajfName, err := out.fileName(xlsName, ".json")
+	if err != nil {
+		return err
+	}
+	if err := report.checkOutput(ajfName); err != nil {
+		return err
+	}
+	xls, err := decodeFile(xlsName, in)
+	if err != nil {
+		return err
+	}
+	ajf, err := formats.Convert(xls)
+	if err != nil {
+		return fmt.Errorf("%s, %w", xlsName, err)
+	}
+	err = out.encJson(ajfName, ajf)
+	if err != nil {
+		return fmt.Errorf("Error encoding file %s: %s", ajfName, err)
+	}
+	return nil
+}
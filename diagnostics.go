@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+// A reporter prints the errors and warnings found in the input files:
+// as text as soon as they are found, or as json or sarif at the end.
+type reporter struct {
+	format string
+	diags  []formats.Diagnostic
+}
+
+var report = &reporter{format: "text"}
+
+// errReported is returned by commands that already reported their problems,
+// to fail without adding a diagnostic.
+var errReported = errors.New("problems already reported")
+
+// diagFlags defines the flag choosing the format of the diagnostics.
+func diagFlags(fs *flag.FlagSet) {
+	fs.StringVar(&report.format, "format", "text", "format of errors and warnings: text, json or sarif (json and sarif are written to stdout)")
+}
+
+func (r *reporter) check() error {
+	switch r.format {
+	case "text", "json", "sarif":
+		return nil
+	}
+	return fmt.Errorf("Invalid diagnostics format %q.", r.format)
+}
+
+func (r *reporter) warning(fileName string, d formats.Diagnostic) {
+	if r.format == "text" {
+		fmt.Fprintf(os.Stderr, "%s: warning: %s\n", fileName, d.Error())
+		return
+	}
+	d.File = fileName
+	r.diags = append(r.diags, d)
+}
+
+func (r *reporter) error(fileName string, err error) {
+	if err == errReported {
+		return
+	}
+	if r.format == "text" {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	d := formats.AsDiagnostic(err)
+	d.File = fileName
+	r.diags = append(r.diags, d)
+}
+
+// toStdout tells whether the diagnostics are written to stdout,
+// which then can't be used for other output.
+func (r *reporter) toStdout() bool { return r.format != "text" }
+
+// checkOutput returns an error if the output file outName is stdout
+// while the diagnostics are written there.
+func (r *reporter) checkOutput(outName string) error {
+	if outName == "-" && r.toStdout() {
+		return fmt.Errorf("The %s diagnostics are written to stdout, the output must be a file.", r.format)
+	}
+	return nil
+}
+
+// flush writes the diagnostics collected in json or sarif format,
+// and forgets them.
+func (r *reporter) flush() error {
+	defer func() { r.diags = nil }()
+	switch r.format {
+	case "json":
+		if r.diags == nil {
+			r.diags = []formats.Diagnostic{}
+		}
+		return formats.EncIndentedJson(os.Stdout, r.diags)
+	case "sarif":
+		return formats.EncIndentedJson(os.Stdout, sarifReport(r.diags))
+	}
+	return nil
+}
+
+// Types of the Static Analysis Results Interchange Format (SARIF) 2.1.0,
+// limited to the properties used by formconv.
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationUri string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	Id string `json:"id"`
+}
+
+type sarifResult struct {
+	RuleId    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation  `json:"physicalLocation"`
+	LogicalLocations []sarifLogicalLocation `json:"logicalLocations,omitempty"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	Uri string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+}
+
+type sarifLogicalLocation struct {
+	Name               string `json:"name"`
+	FullyQualifiedName string `json:"fullyQualifiedName,omitempty"`
+	Kind               string `json:"kind"`
+}
+
+// sarifReport converts the diagnostics to sarif.
+// Spreadsheet rows and columns are mapped to lines and columns of the file,
+// the sheet and cell are reported as logical location.
+func sarifReport(diags []formats.Diagnostic) sarifLog {
+	run := sarifRun{
+		Tool: sarifTool{sarifDriver{
+			Name:           "formconv",
+			InformationUri: "https://github.com/gnucoop/formconv",
+			Rules:          []sarifRule{},
+		}},
+		Results: []sarifResult{},
+	}
+	ruleSeen := make(map[string]bool)
+	for _, d := range diags {
+		if !ruleSeen[d.Rule] {
+			ruleSeen[d.Rule] = true
+			run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{d.Rule})
+		}
+		loc := sarifLocation{PhysicalLocation: sarifPhysicalLocation{
+			ArtifactLocation: sarifArtifactLocation{filepath.ToSlash(d.File)},
+		}}
+		if d.Row > 0 {
+			loc.PhysicalLocation.Region = &sarifRegion{StartLine: d.Row, StartColumn: d.Col}
+		}
+		if d.Sheet != "" {
+			ll := sarifLogicalLocation{Name: d.Sheet, Kind: "object"}
+			if cell := d.Cell(); cell != "" {
+				ll.FullyQualifiedName = d.Sheet + "!" + cell
+			}
+			loc.LogicalLocations = []sarifLogicalLocation{ll}
+		}
+		run.Results = append(run.Results, sarifResult{
+			RuleId:    d.Rule,
+			Level:     string(d.Severity),
+			Message:   sarifMessage{d.Message},
+			Locations: []sarifLocation{loc},
+		})
+	}
+	return sarifLog{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs:    []sarifRun{run},
+	}
+}
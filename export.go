@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+var exportCmd = newCommand("export", "export submissions of forms to flat csv or xlsx files, for analysis")
+
+type exportOptions struct {
+	submissions string
+	format      string
+	labels      bool
+}
+
+func init() {
+	in := inputFlags(exportCmd.flags)
+	out := outputPathFlag(exportCmd.flags)
+	exportCmd.flags.Lookup("o").Usage = outputFileUsage
+	opts := new(exportOptions)
+	exportCmd.flags.StringVar(&opts.submissions, "submissions", "",
+		"json file with the submissions (by default, the form file with the extension .submissions.json)")
+	exportCmd.flags.StringVar(&opts.format, "to", "xlsx", "output format: xlsx or csv")
+	exportCmd.flags.BoolVar(&opts.labels, "labels", false, "use the labels of the fields in the header, instead of their names")
+	diagFlags(exportCmd.flags)
+	exportCmd.args = "form.xlsx (or form.json)"
+	exportCmd.run = func(files []string) bool {
+		if opts.format != "xlsx" && opts.format != "csv" {
+			fmt.Fprintln(os.Stderr, "The output format must be xlsx or csv.")
+			return false
+		}
+		if opts.submissions != "" && len(files) > 1 {
+			fmt.Fprintln(os.Stderr, "The -submissions flag can be used with a single form.")
+			return false
+		}
+		if err := out.init(len(files)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return false
+		}
+		return forEachFile(files, func(fileName string) error {
+			return export(fileName, opts, in, out)
+		})
+	}
+}
+
+// decodeAjf reads a form, either an xlsform or an ajf form in json.
+func decodeAjf(fileName string, in *inputOptions) (*formats.AjfForm, error) {
+	if strings.ToLower(filepath.Ext(fileName)) == ".json" {
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		ajf := new(formats.AjfForm)
+		if err := json.Unmarshal(data, ajf); err != nil {
+			return nil, fmt.Errorf("Error decoding file %s: %s", fileName, err)
+		}
+		return ajf, nil
+	}
+	xls, err := decodeFile(fileName, in)
+	if err != nil {
+		return nil, err
+	}
+	ajf, err := formats.Convert(xls)
+	if err != nil {
+		return nil, fmt.Errorf("%s, %w", fileName, err)
+	}
+	return ajf, nil
+}
+
+func export(formName string, opts *exportOptions, in *inputOptions, out *outputOptions) error {
+	subsName := opts.submissions
+	if subsName == "" {
+		if formName == "-" {
+			return fmt.Errorf("The submissions must be given with -submissions when the form is read from stdin.")
+		}
+		subsName = strings.TrimSuffix(formName, filepath.Ext(formName)) + ".submissions.json"
+	}
+	outName, err := out.fileName(formName, ".export."+opts.format)
+	if err != nil {
+		return err
+	}
+	if err := report.checkOutput(outName); err != nil {
+		return err
+	}
+	ajf, err := decodeAjf(formName, in)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(subsName)
+	if err != nil {
+		return fmt.Errorf("Error reading submissions: %s", err)
+	}
+	subs, err := formats.DecSubmissions(data)
+	if err != nil {
+		return fmt.Errorf("Error decoding submissions %s: %s", subsName, err)
+	}
+	sheets := formats.ExportSubmissions(ajf, subs, opts.labels)
+	if opts.format == "xlsx" {
+		err = out.write(outName, func(w io.Writer) error { return formats.EncXlsx(w, sheets) })
+		if err != nil {
+			return fmt.Errorf("Error writing file %s: %s", outName, err)
+		}
+		return nil
+	}
+	return writeCsvSheets(out, outName, sheets)
+}
+
+// writeCsvSheets writes sheets in csv files: the first one in outName,
+// the others in files named with the sheet name, like form.export.kids.csv.
+func writeCsvSheets(out *outputOptions, outName string, sheets []formats.Sheet) error {
+	if outName == "-" && len(sheets) > 1 {
+		return fmt.Errorf("The form has repeats or tables, exported in more csv files: an output file name is needed.")
+	}
+	for i, sheet := range sheets {
+		name := outName
+		if i > 0 {
+			name = strings.TrimSuffix(outName, ".csv") + "." + sheet.Name + ".csv"
+		}
+		err := out.write(name, func(w io.Writer) error { return formats.EncSheetCsv(w, sheet) })
+		if err != nil {
+			return fmt.Errorf("Error writing file %s: %s", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+var fakeCmd = newCommand("fake", "generate random submissions of xlsforms, to build dashboards and reports before fieldwork")
+
+type fakeOptions struct {
+	n      int
+	seed   int64
+	format string
+}
+
+func init() {
+	in := inputFlags(fakeCmd.flags)
+	out := outputFlags(fakeCmd.flags)
+	fakeCmd.flags.Lookup("o").Usage = outputFileUsage
+	opts := new(fakeOptions)
+	fakeCmd.flags.IntVar(&opts.n, "n", 10, "number of submissions for each form")
+	fakeCmd.flags.Int64Var(&opts.seed, "seed", 0, "seed of the random generator, for reproducible submissions (random if 0)")
+	fakeCmd.flags.StringVar(&opts.format, "to", "json", "output format: json or csv")
+	diagFlags(fakeCmd.flags)
+	fakeCmd.run = func(files []string) bool {
+		if opts.n < 0 {
+			fmt.Fprintln(os.Stderr, "The number of submissions can't be negative.")
+			return false
+		}
+		if opts.format != "json" && opts.format != "csv" {
+			fmt.Fprintln(os.Stderr, "The output format must be json or csv.")
+			return false
+		}
+		if err := out.init(len(files)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return false
+		}
+		if opts.seed == 0 {
+			opts.seed = time.Now().UnixNano()
+		}
+		rnd := rand.New(rand.NewSource(opts.seed))
+		return forEachFile(files, func(fileName string) error {
+			return fake(fileName, rnd, opts, in, out)
+		})
+	}
+}
+
+func fake(xlsName string, rnd *rand.Rand, opts *fakeOptions, in *inputOptions, out *outputOptions) error {
+	outName, err := out.fileName(xlsName, ".submissions."+opts.format)
+	if err != nil {
+		return err
+	}
+	if err := report.checkOutput(outName); err != nil {
+		return err
+	}
+	xls, err := decodeFile(xlsName, in)
+	if err != nil {
+		return err
+	}
+	ajf, err := formats.Convert(xls)
+	if err != nil {
+		return fmt.Errorf("%s, %w", xlsName, err)
+	}
+	subs, err := formats.FakeSubmissions(ajf, opts.n, rnd)
+	if err != nil {
+		return err
+	}
+	if opts.format == "csv" {
+		return writeCsvSheets(out, outName, formats.ExportSubmissions(ajf, subs, false))
+	}
+	err = out.encJson(outName, subs)
+	if err != nil {
+		return fmt.Errorf("Error writing file %s: %s", outName, err)
+	}
+	return nil
+}
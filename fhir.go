@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+var fhirCmd = newCommand("fhir", "convert xlsforms to FHIR R4 questionnaires in json")
+
+func init() {
+	in := inputFlags(fhirCmd.flags)
+	out := outputFlags(fhirCmd.flags)
+	fhirCmd.flags.Lookup("o").Usage = outputFileUsage
+	fhirCmd.run = func(files []string) bool {
+		if err := out.init(len(files)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return false
+		}
+		return forEachFile(files, func(fileName string) error {
+			return fhir(fileName, in, out)
+		})
+	}
+}
+
+func fhir(xlsName string, in *inputOptions, out *outputOptions) error {
+	fhirName, err := out.fileName(xlsName, ".fhir.json")
+	if err != nil {
+		return err
+	}
+	xls, err := decodeFile(xlsName, in)
+	if err != nil {
+		return err
+	}
+	ajf, err := formats.Convert(xls)
+	if err != nil {
+		return fmt.Errorf("%s, %w", xlsName, err)
+	}
+	title := strings.TrimSuffix(filepath.Base(xlsName), filepath.Ext(xlsName))
+	if xlsName == "-" {
+		title = "Form"
+	}
+	err = out.write(fhirName, func(w io.Writer) error {
+		return formats.EncFhirQuestionnaire(w, ajf, title, title)
+	})
+	if err != nil {
+		return fmt.Errorf("Error writing file %s: %s", fhirName, err)
+	}
+	return nil
+}
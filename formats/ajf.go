@@ -133,21 +133,36 @@ func EncIndentedJson(w io.Writer, e interface{}) error {
 	return enc.Encode(e)
 }
 
-func EncJsonToFile(fileName string, e interface{}) (err error) {
+func EncCompactJson(w io.Writer, e interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(e)
+}
+
+func EncJsonToFile(fileName string, e interface{}) error {
+	return WriteFile(fileName, func(w io.Writer) error { return EncIndentedJson(w, e) })
+}
+
+// WriteFile creates a file and fills it using write.
+// The file is removed if write fails.
+func WriteFile(fileName string, write func(w io.Writer) error) (err error) {
 	var f *os.File
 	f, err = os.Create(fileName)
 	if err != nil {
 		return err
 	}
 	defer func() {
-		f.Close()
+		cerr := f.Close()
+		if err == nil {
+			err = cerr
+		}
 		if err != nil {
 			os.Remove(fileName)
 		}
 	}()
 
 	w := bufio.NewWriter(f)
-	err = EncIndentedJson(w, e)
+	err = write(w)
 	if err != nil {
 		return err
 	}
@@ -1,8 +1,15 @@
 package formats
 
 import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"math"
+	"math/rand"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/kr/pretty"
@@ -55,6 +62,937 @@ func TestDecodeXls(t *testing.T) {
 	}
 }
 
+func TestDecodeXlsFormulaCells(t *testing.T) {
+	// The labels of this form are computed with excel formulas,
+	// both formats must expose their cached values.
+	xls, err := DecXlsFromFile("testdata/Picaps_baseline_form.xls")
+	check(t, err)
+	xlsx, err := DecXlsFromFile("testdata/Picaps_baseline_form.xlsx")
+	check(t, err)
+	if len(xls.Survey) != len(xlsx.Survey) {
+		t.Fatalf("Survey length mismatch: xls %d, xlsx %d", len(xls.Survey), len(xlsx.Survey))
+	}
+	if label := xls.Survey[0].Label(""); label != "Information" {
+		t.Fatalf("Unexpected label of first xls row: %q", label)
+	}
+	for i := range xls.Survey {
+		a, b := xls.Survey[i], xlsx.Survey[i]
+		if a.Name() != b.Name() || strings.TrimSpace(a.Label("")) != strings.TrimSpace(b.Label("")) {
+			t.Fatalf("Row %d differs between xls and xlsx:\n%q %q\n%q %q",
+				a.LineNum, a.Name(), a.Label(""), b.Name(), b.Label(""))
+		}
+	}
+}
+
+func TestDecodeXlsRecords(t *testing.T) {
+	// cells.xls is written by testdata/gencells.go.
+	f, err := os.Open("testdata/cells.xls")
+	check(t, err)
+	defer f.Close()
+	stat, err := f.Stat()
+	check(t, err)
+	wb, err := NewWorkBookOptions(f, ".xls", stat.Size(), WorkBookOptions{})
+	check(t, err)
+	rows := wb.Cells("survey")
+	formula := func(c Cell) Cell {
+		c.IsFormula = true
+		return c
+	}
+	expected := [][]Cell{
+		{stringCell("type"), stringCell("name"), stringCell("label"), stringCell("default")},
+		{stringCell("integer"), stringCell("age"), stringCell("Età del bambino"), {Type: CellNumber, Num: 12.5}},
+		{{Type: CellNumber, Num: 7}, {Type: CellNumber, Num: 1.5}, {Type: CellNumber, Num: 3.14},
+			{Type: CellDate, Time: excelTime(43831, false)}},
+		{formula(Cell{Type: CellNumber, Num: 42}), formula(stringCell("computed")),
+			formula(Cell{Type: CellBool, Bool: true}), formula(Cell{Type: CellDate, Time: excelTime(43831.75, false)}), {}},
+		{{Type: CellDate, Time: excelTime(0.5, false)}, {Type: CellBool, Bool: true}, {},
+			stringCell("inline"), stringCell("rich"), stringCell("tail")},
+	}
+	for i, row := range expected {
+		for j, cell := range row {
+			var found Cell
+			if i < len(rows) && j < len(rows[i]) {
+				found = rows[i][j]
+			}
+			if !reflect.DeepEqual(found, cell) {
+				t.Errorf("Cell %s%d: expected %#v, found %#v", ColumnName(j), i+1, cell, found)
+			}
+		}
+	}
+}
+
+func TestCellText(t *testing.T) {
+	cells := []struct {
+		cell            Cell
+		text, formulaJs string
+	}{
+		{Cell{}, "", ""},
+		{stringCell("hello"), "hello", "hello"},
+		{Cell{Type: CellNumber, Num: 123}, "123", "123"},
+		{Cell{Type: CellNumber, Num: 0.000001}, "0.000001", "0.000001"},
+		{Cell{Type: CellBool, Bool: true}, "true", "True"},
+		{Cell{Type: CellDate, Time: excelTime(43831, false)}, "2020-01-01", `"2020-01-01"`},
+		{Cell{Type: CellDate, Time: excelTime(42369, true)}, "2020-01-01", `"2020-01-01"`},
+		{Cell{Type: CellDate, Time: excelTime(43831.75, false)}, "2020-01-01T18:00:00", `"2020-01-01T18:00:00"`},
+		{Cell{Type: CellDate, Time: excelTime(0.5, false)}, "12:00:00", `"12:00:00"`},
+	}
+	for _, c := range cells {
+		if text := c.cell.String(); text != c.text {
+			t.Errorf("Text of %#v: expected %q, found %q", c.cell, c.text, text)
+		}
+		if f := c.cell.formulaText(); f != c.formulaJs {
+			t.Errorf("Formula of %#v: expected %q, found %q", c.cell, c.formulaJs, f)
+		}
+	}
+
+	dateFormats := map[string]bool{
+		"General": false, "0.00": false, "#,##0": false, `0.0"m"`: false, "[Red]0.00": false,
+		"yyyy-mm-dd": true, "d/m/yy": true, "h:mm AM/PM": true, "[h]:mm": true, `[$-409]mmm\-yy`: true,
+	}
+	for code, expected := range dateFormats {
+		if isDateFormat(code) != expected {
+			t.Errorf("isDateFormat(%q) expected to be %v", code, expected)
+		}
+	}
+}
+
+func TestWorkBookOptions(t *testing.T) {
+	fileName := "testdata/layout.xlsx"
+	names := func(xls *XlsForm) []string {
+		var res []string
+		for _, row := range xls.Survey {
+			res = append(res, row.Name())
+		}
+		return res
+	}
+
+	xls, err := DecXlsFromFileOptions(fileName, WorkBookOptions{})
+	check(t, err)
+	if n := names(xls); !reflect.DeepEqual(n, []string{"q1", "q2", "q3"}) || len(xls.Warnings) != 0 {
+		t.Fatalf("Unexpected result with default options: %v %v", n, xls.Warnings)
+	}
+	if label := xls.Survey[0].Label("ITA"); label != "" {
+		t.Fatalf("Merged cell unexpectedly expanded: %q", label)
+	}
+
+	xls, err = DecXlsFromFileOptions(fileName, WorkBookOptions{ExpandMerged: true})
+	check(t, err)
+	if label := xls.Survey[0].Label("ITA"); label != "Question one" {
+		t.Fatalf("Merged cell not expanded: %q", label)
+	}
+
+	xls, err = DecXlsFromFileOptions(fileName, WorkBookOptions{Hidden: HiddenSkip})
+	check(t, err)
+	if n := names(xls); !reflect.DeepEqual(n, []string{"q1", "q3"}) || xls.Survey[0].Hint("") != "" {
+		t.Fatalf("Hidden row or column not skipped: %v %q", n, xls.Survey[0].Hint(""))
+	}
+
+	xls, err = DecXlsFromFileOptions(fileName, WorkBookOptions{Hidden: HiddenWarn})
+	check(t, err)
+	expected := []Diagnostic{
+		{Rule: "hidden-content", Severity: SevWarning, Sheet: "survey", Row: 3, Message: "Row is hidden."},
+		{Rule: "hidden-content", Severity: SevWarning, Sheet: "survey", Col: 5, Message: "Column E is hidden."},
+	}
+	if n := names(xls); len(n) != 3 || !reflect.DeepEqual(xls.Warnings, expected) {
+		t.Fatalf("Unexpected result with HiddenWarn: %v %v", n, xls.Warnings)
+	}
+
+	f, err := os.Open(fileName)
+	check(t, err)
+	defer f.Close()
+	stat, err := f.Stat()
+	check(t, err)
+	wb, err := NewWorkBookOptions(f, ".xlsx", stat.Size(), WorkBookOptions{Hidden: HiddenSkip})
+	check(t, err)
+	if cells := wb.Cells("helper"); cells != nil {
+		t.Fatalf("Hidden sheet not skipped: %v", cells)
+	}
+}
+
+func TestExpandMergedBounds(t *testing.T) {
+	rows := [][]Cell{
+		{stringCell("a"), stringCell("b")},
+		{stringCell("c")},
+		{{}, {}, stringCell("d")},
+	}
+	merged := []cellRange{
+		{firstRow: 0, lastRow: 1048575, firstCol: 1, lastCol: 1}, // the whole column B
+		{firstRow: 2, lastRow: 2, firstCol: 2, lastCol: 16383},   // row 3 from C
+		{firstRow: 1, lastRow: 2000000, firstCol: 0, lastCol: 0}, // empty first cell
+	}
+	rows = expandMerged(rows, merged)
+	expected := [][]Cell{
+		{stringCell("a"), stringCell("b")},
+		{stringCell("c"), stringCell("b")},
+		{stringCell("c"), stringCell("b"), stringCell("d")},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		logFatalDiff(t, expected, rows)
+	}
+}
+
+func TestDecodeSparseXlsx(t *testing.T) {
+	// The survey has a question after 197 empty rows
+	// and formatted empty cells in row 1000000.
+	xls, err := DecXlsFromFile("testdata/sparse.xlsx")
+	check(t, err)
+	if len(xls.Survey) != 2 {
+		t.Fatalf("Expected 2 survey rows, found %d", len(xls.Survey))
+	}
+	if row := xls.Survey[1]; row.Name() != "late" || row.LineNum != 200 || row.Default() != "12" {
+		t.Fatalf("Unexpected row after gap: %q at line %d, default %q", row.Name(), row.LineNum, row.Default())
+	}
+	if def := xls.Survey[0].Default(); def != `"2020-01-01"` {
+		t.Fatalf("Unexpected date default: %s", def)
+	}
+}
+
+func TestLint(t *testing.T) {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			MakeSurveyRow("type", "begin group", "name", "g", "label", "G", "label::ITA", "G"),
+			MakeSurveyRow("type", "integer", "name", "age", "label", "Age ", "label::ITA", "Età",
+				"constraint", "${age} > 0"),
+			MakeSurveyRow("type", "select_one yn", "name", "ok", "label", "Ok?",
+				"required_message", "Answer"),
+			MakeSurveyRow("type", "end group"),
+		},
+		Choices: []ChoicesRow{
+			MakeChoicesRow("list name", "yn", "name", "y", "label", "Yes", "label::ITA", "Sì"),
+			MakeChoicesRow("list name", "yn", "name", "y", "label", "No", "label::ITA", "No"),
+			MakeChoicesRow("list name", "unused", "name", "a", "label", "A"),
+		},
+		LangSet: map[string]bool{"ITA": true},
+	}
+	for i := range xls.Survey {
+		xls.Survey[i].LineNum = i + 2
+	}
+	for i := range xls.Choices {
+		xls.Choices[i].LineNum = i + 2
+	}
+	expected := []string{
+		"line 3: Column label has leading or trailing spaces.",
+		`line 3: Constraint of "age" has no constraint_message.`,
+		`line 4: required_message of "ok" is set, but the field isn't required.`,
+		`line 4: Label of "ok" has no ITA translation.`,
+		`line 3: Value "y" appears twice in choice list "yn". (choices sheet)`,
+		`line 4: Choice list "unused" is never used. (choices sheet)`,
+	}
+	var warns []string
+	for _, d := range Lint(xls) {
+		warns = append(warns, d.Error())
+	}
+	if !reflect.DeepEqual(warns, expected) {
+		t.Fatalf("Unexpected lint warnings:\n%s", strings.Join(warns, "\n"))
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	xls, err := DecXlsFromFile("testdata/skeleton.xls")
+	check(t, err)
+	_, err = Convert(xls)
+	d, ok := err.(*Diagnostic)
+	if !ok {
+		t.Fatalf("Expected a diagnostic, found %v", err)
+	}
+	expected := Diagnostic{Rule: "invalid-type", Severity: SevError, Sheet: "survey",
+		Row: 2, Column: "type", Col: 1, Message: `Invalid type "type1" in survey.`}
+	if !reflect.DeepEqual(*d, expected) || d.Cell() != "A2" {
+		t.Fatalf("Unexpected diagnostic %#v", d)
+	}
+	if msg := d.Error(); msg != `line 2: Invalid type "type1" in survey.` {
+		t.Fatalf("Unexpected error message %q", msg)
+	}
+
+	d = MakeChoicesRow("list name", "l").errorf("missing-label", "label", "No label.").(*Diagnostic)
+	if msg := d.Error(); msg != "No label." {
+		t.Fatalf("Unexpected error message without position %q", msg)
+	}
+	d.Row = 4
+	if msg := d.Error(); msg != "line 4: No label. (choices sheet)" {
+		t.Fatalf("Unexpected error message in choices sheet %q", msg)
+	}
+}
+
+func TestEncXForm(t *testing.T) {
+	xls, err := DecXlsFromFile("testdata/noformulas.xlsx")
+	check(t, err)
+	var buf bytes.Buffer
+	err = EncXForm(&buf, xls, "No formulas", "noformulas")
+	check(t, err)
+	dec := xml.NewDecoder(&buf)
+	for {
+		_, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		check(t, err)
+	}
+
+	xls = &XlsForm{Survey: []SurveyRow{
+		MakeSurveyRow("type", "integer", "name", "age", "label", "Age"),
+		MakeSurveyRow("type", "text", "name", "job", "label", "Job of ${age} years old",
+			"relevant", "${age} >= 18 and True", "default", `"none"`),
+		MakeSurveyRow("type", "calculate", "name", "c", "calculation", "js: 1 + 1"),
+	}}
+	buf.Reset()
+	err = EncXForm(&buf, xls, "T", "t")
+	if d, ok := err.(*Diagnostic); !ok || d.Rule != "unsupported-xform" || d.Column != "calculation" {
+		t.Fatalf("Expected an error for javascript formulas, found %v", err)
+	}
+	xls.Survey = xls.Survey[:2]
+	buf.Reset()
+	err = EncXForm(&buf, xls, "T", "t")
+	check(t, err)
+	for _, s := range []string{
+		`<job>none</job>`,
+		`<bind nodeset="/data/job" relevant="/data/age &gt;= 18 and true()" type="string"/>`,
+		`<label>Job of <output value="/data/age"/> years old</label>`,
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("XForm doesn't contain %s:\n%s", s, buf.String())
+		}
+	}
+}
+
+func TestEncPreview(t *testing.T) {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			MakeSurveyRow("type", "integer", "name", "age", "label", "Age <years>", "label::ITA", "Età",
+				"required", "yes"),
+			MakeSurveyRow("type", "select_one yn", "name", "ok", "label", "Ok?", "relevant", "${age} > 1"),
+		},
+		Choices: []ChoicesRow{
+			MakeChoicesRow("list name", "yn", "name", "y", "label", "Yes", "label::ITA", "Sì"),
+		},
+		LangSet: map[string]bool{"ITA": true},
+	}
+	ajf, err := Convert(xls)
+	check(t, err)
+	var buf bytes.Buffer
+	err = EncPreview(&buf, ajf, "T")
+	check(t, err)
+	for _, s := range []string{
+		`<span data-t="Age &lt;years&gt;">Age &lt;years&gt;</span> <span class="required">*</span>`,
+		`<input id="f-age" type="number">`,
+		`<input type="radio" name="ok" value="y"> <span data-t="Yes">Yes</span>`,
+		`<div>Visible if <code>age &gt; 1</code></div>`,
+		`<option>ITA</option>`,
+		`"ITA":{"Age \u003cyears\u003e":"Età"`,
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("Preview doesn't contain %s:\n%s", s, buf.String())
+		}
+	}
+}
+
+func TestEval(t *testing.T) {
+	vars := Vars{"n": 3, "s": "abc", "pets": []interface{}{"cat", "dog"}, "empty": nil}
+	formulas := map[string]interface{}{
+		`1 + 2 * 3 - 4 div 8`:                 6.5,
+		`7 mod 3`:                             1.0,
+		`${n} > 2 and ${s} = "abc"`:           true,
+		`${n} + "1"`:                          "31",
+		`${empty} + 1`:                        1.0,
+		`if(${n} < 0, "neg", "pos")`:          "pos",
+		`round(2.345, 2)`:                     2.35,
+		`int(2.5)`:                            2.0,
+		`pow(2, 10)`:                          1024.0,
+		`concat(${s}, "d", 1)`:                "abcd1",
+		`substr(${s}, 1)`:                     "bc",
+		`string-length(${s})`:                 3.0,
+		`contains(${s}, "bc")`:                true,
+		`regex(${s}, "^a.c$")`:                true,
+		`selected(${pets}, "dog")`:            true,
+		`selected(${pets}, "bird")`:           false,
+		`count-selected(${pets})`:             2.0,
+		`not(${empty})`:                       true,
+		`number("1e3") div 4`:                 250.0,
+		`string(1 div 3 * 3)`:                 "1",
+		`1 div 0`:                             math.Inf(1),
+		`js: [1, 2].length === 2 ? 'y' : 'n'`: "y",
+	}
+	for formula, expected := range formulas {
+		e, err := CompileFormula(formula, "x")
+		if err != nil {
+			t.Fatalf("Error compiling formula %s: %s", formula, err)
+		}
+		v, err := e.Eval(vars)
+		if err != nil {
+			t.Fatalf("Error evaluating formula %s: %s", formula, err)
+		}
+		if !reflect.DeepEqual(v, expected) {
+			t.Errorf("Formula %s: expected %#v, got %#v", formula, expected, v)
+		}
+	}
+
+	for _, formula := range []string{`${missing} + 1`, `js: empty.length`, `js: n(1)`} {
+		e, err := CompileFormula(formula, "x")
+		check(t, err)
+		if _, err := e.Eval(vars); err == nil {
+			t.Errorf("Formula %s should fail.", formula)
+		}
+	}
+	if _, err := ParseExpr("1 +"); err == nil {
+		t.Errorf("Incomplete formula parsed.")
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			MakeSurveyRow("type", "integer", "name", "age", "label", "Age", "required", "yes",
+				"constraint", ". < 150", "constraint_message", "Too old."),
+			MakeSurveyRow("type", "calculate", "name", "adult", "calculation", "${age} >= 18"),
+			MakeSurveyRow("type", "text", "name", "job", "label", "Job", "relevant", "${adult}"),
+			MakeSurveyRow("type", "text", "name", "city", "label", "City", "default", "'Rome'"),
+			MakeSurveyRow("type", "begin repeat", "name", "kids", "label", "Kids", "repeat_count", "3"),
+			MakeSurveyRow("type", "integer", "name", "kid_age", "label", "Age"),
+			MakeSurveyRow("type", "calculate", "name", "older", "calculation", "${kid_age} > 10"),
+			MakeSurveyRow("type", "end repeat"),
+		},
+	}
+	ajf, err := Convert(xls)
+	check(t, err)
+
+	sim := Simulate(ajf, map[string]interface{}{"age": 12, "job": "none", "kids": 5,
+		"kid_age__0": 11, "kid_age__1": 2, "kid_age__3": 1})
+	expected := map[string]interface{}{"age": 12.0, "adult": false, "city": "Rome",
+		"kid_age__0": 11.0, "older__0": true, "kid_age__1": 2.0, "older__1": false, "older__2": false}
+	if !reflect.DeepEqual(sim.Values, expected) {
+		logFatalDiff(t, expected, sim.Values)
+	}
+	if sim.Visible["job"] || !sim.Visible["kid_age__2"] {
+		t.Errorf("Wrong visibility: %v", sim.Visible)
+	}
+	if len(sim.Failures) != 0 || len(sim.Errors) != 0 {
+		t.Errorf("Unexpected failures: %v %v", sim.Failures, sim.Errors)
+	}
+
+	sim = Simulate(ajf, map[string]interface{}{"age": 150.5, "job": "none", "city": "Milan"})
+	if sim.Values["job"] != "none" || sim.Values["city"] != "Milan" {
+		t.Errorf("Wrong values: %v", sim.Values)
+	}
+	var messages []string
+	for _, f := range sim.Failures {
+		messages = append(messages, f.Message)
+	}
+	if !reflect.DeepEqual(messages, []string{"The field value must be an integer.", "Too old."}) {
+		t.Errorf("Wrong failures: %v", sim.Failures)
+	}
+	sim = Simulate(ajf, nil)
+	if len(sim.Failures) != 1 || sim.Failures[0].Field != "age" || sim.Failures[0].Condition != "" {
+		t.Errorf("Wrong failures: %v", sim.Failures)
+	}
+}
+
+func TestDecScenariosYaml(t *testing.T) {
+	data := `
+# comment
+- name: &adult "adult # not a comment"
+  answers: &answers {age: 30, pets: [cat, 'dog''s']}
+  values:
+    "adult": true
+    note: >
+      folded
+      text
+- name: again
+  answers: *answers
+  failures: {age: false, 1: "Choose."}
+`
+	scenarios, err := DecScenarios([]byte(data), true)
+	check(t, err)
+	answers := map[string]interface{}{"age": 30.0, "pets": []interface{}{"cat", "dog's"}}
+	expected := []Scenario{
+		{Name: "adult # not a comment", Answers: answers, Values: map[string]interface{}{"adult": true, "note": "folded text\n"}},
+		{Name: "again", Answers: answers, Failures: map[string]interface{}{"age": false, "1": "Choose."}},
+	}
+	if !reflect.DeepEqual(scenarios, expected) {
+		logFatalDiff(t, expected, scenarios)
+	}
+	for _, bad := range []string{"- name: [1, 2", "- name: a\n  b: 2", "- name: a\n  name: b", "- name: a\n  answer: {}"} {
+		if _, err := DecScenarios([]byte(strings.ReplaceAll(bad, `\n`, "\n")), true); err == nil {
+			t.Errorf("Invalid scenarios %q decoded.", bad)
+		}
+	}
+}
+
+func TestScenarios(t *testing.T) {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			MakeSurveyRow("type", "integer", "name", "age", "label", "Age",
+				"constraint", ". < 150", "constraint_message", "Too old."),
+			MakeSurveyRow("type", "calculate", "name", "adult", "calculation", "${age} >= 18"),
+			MakeSurveyRow("type", "select_multiple pets", "name", "pets", "label", "Pets", "relevant", "${adult}"),
+		},
+		Choices: []ChoicesRow{
+			MakeChoicesRow("list name", "pets", "name", "cat", "label", "Cat"),
+			MakeChoicesRow("list name", "pets", "name", "dog", "label", "Dog"),
+		},
+		Tests: []TestsRow{
+			MakeTestsRow("scenario", "adult", "field", "age", "answer", "30", "failure", "no"),
+			MakeTestsRow("field", "pets", "answer", "dog cat", "visible", "yes", "value", "cat dog"),
+			MakeTestsRow("field", "adult", "value", "true"),
+			MakeTestsRow("scenario", "old", "field", "age", "answer", "200", "failure", "Too old."),
+			MakeTestsRow("scenario", "child", "field", "age", "answer", "5"),
+			MakeTestsRow("field", "pets", "answer", "cat", "visible", "no", "value", "null"),
+		},
+	}
+	ajf, err := Convert(xls)
+	check(t, err)
+	scenarios, err := ScenariosFromSheet(xls, ajf)
+	check(t, err)
+	if len(scenarios) != 3 {
+		t.Fatalf("Expected 3 scenarios, got %# v", pretty.Formatter(scenarios))
+	}
+	for _, sc := range scenarios {
+		if problems := sc.Check(ajf); len(problems) > 0 {
+			t.Errorf("Scenario %s failed: %v", sc.Name, problems)
+		}
+	}
+
+	data := `[{"name": "wrong", "answers": {"age": 10, "pets": ["cat"]},
+		"visible": {"pets": true}, "values": {"adult": true}, "failures": {"age": true, "nope": false}}]`
+	scenarios, err = DecScenarios([]byte(data), false)
+	check(t, err)
+	expected := []string{
+		"pets is hidden, expected visible.",
+		"adult is false, expected true.",
+		"age is valid, expected a failure.",
+		`Unknown field "nope".`,
+	}
+	if problems := scenarios[0].Check(ajf); !reflect.DeepEqual(problems, expected) {
+		logFatalDiff(t, expected, problems)
+	}
+
+	xls.Tests = []TestsRow{MakeTestsRow("scenario", "s", "field", "age", "answer", "x")}
+	if _, err := ScenariosFromSheet(xls, ajf); err == nil {
+		t.Errorf("Invalid answer accepted.")
+	}
+	if _, err := DecScenarios([]byte(`[{"name": "s", "answer": {}}]`), false); err == nil {
+		t.Errorf("Unknown key accepted.")
+	}
+}
+
+func TestFakeSubmissions(t *testing.T) {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			MakeSurveyRow("type", "integer", "name", "big", "label", "Big", "required", "yes", "constraint", ". > 500"),
+			MakeSurveyRow("type", "select_one size", "name", "size", "label", "Size", "required", "yes"),
+			MakeSurveyRow("type", "select_multiple pets", "name", "pets", "label", "Pets",
+				"choice_filter", "size = ${size}", "required", "yes"),
+			MakeSurveyRow("type", "text", "name", "cat_name", "label", "Cat name", "relevant", "selected(${pets}, 'cat')"),
+			MakeSurveyRow("type", "range", "name", "score", "label", "Score", "parameters", "start=10 end=20 step=5"),
+			MakeSurveyRow("type", "begin repeat", "name", "kids", "label", "Kids", "repeat_count", "2"),
+			MakeSurveyRow("type", "decimal", "name", "weight", "label", "Weight", "required", "yes"),
+			MakeSurveyRow("type", "end repeat"),
+		},
+		Choices: []ChoicesRow{
+			MakeChoicesRow("list name", "size", "name", "small", "label", "Small"),
+			MakeChoicesRow("list name", "size", "name", "big", "label", "Big"),
+			MakeChoicesRow("list name", "pets", "name", "cat", "label", "Cat"),
+			MakeChoicesRow("list name", "pets", "name", "dog", "label", "Dog"),
+		},
+	}
+	xls.Choices[2].cells["size"] = stringCell("small")
+	xls.Choices[3].cells["size"] = stringCell("big")
+	ajf, err := Convert(xls)
+	check(t, err)
+	subs, err := FakeSubmissions(ajf, 50, rand.New(rand.NewSource(1)))
+	check(t, err)
+	for _, sub := range subs {
+		sim := Simulate(ajf, sub)
+		if len(sim.Failures) > 0 || len(sim.Errors) > 0 {
+			t.Fatalf("Invalid submission %v: %v %v", sub, sim.Failures, sim.Errors)
+		}
+		if big, ok := sub["big"].(float64); !ok || big != math.Trunc(big) {
+			t.Errorf("Not an integer: %v", sub["big"])
+		}
+		if score, ok := sub["score"].(float64); ok && (score < 10 || score > 20 || int(score)%5 != 0) {
+			t.Errorf("Score out of range: %v", score)
+		}
+		if pets := sub["pets"].([]interface{}); sub["size"] == "big" && pets[0] != "dog" {
+			t.Errorf("Choice filter not respected: %v", sub)
+		}
+		if _, ok := sub["cat_name"]; ok && sub["size"] != "small" {
+			t.Errorf("Hidden field with value: %v", sub)
+		}
+		if reps := sub["kids"].(float64); reps > 2 || (sub["weight__1"] != nil) != (reps == 2) {
+			t.Errorf("Wrong repetitions: %v", sub)
+		}
+	}
+	again, err := FakeSubmissions(ajf, 5, rand.New(rand.NewSource(1)))
+	check(t, err)
+	if !reflect.DeepEqual(subs[:5], again) {
+		t.Errorf("Submissions aren't reproducible.")
+	}
+	if _, err := FakeSubmissions(ajf, -1, rand.New(rand.NewSource(1))); err == nil {
+		t.Errorf("Negative number of submissions accepted.")
+	}
+}
+
+func TestIsIntegerField(t *testing.T) {
+	xls := &XlsForm{Survey: []SurveyRow{
+		MakeSurveyRow("type", "integer", "name", "a", "label", "A"),
+		MakeSurveyRow("type", "decimal", "name", "b", "label", "B"),
+	}}
+	ajf, err := Convert(xls)
+	check(t, err)
+	a, b := &ajf.Slides[0].Nodes[0], &ajf.Slides[0].Nodes[1]
+	b.Validation = &FieldValidation{Conditions: []ValidationCondition{{Condition: "isInt(b) && b > 0"}}}
+	if !isIntegerField(a) || isIntegerField(b) {
+		t.Errorf("Wrong integer fields: %v, %v", isIntegerField(a), isIntegerField(b))
+	}
+}
+
+func TestCodebook(t *testing.T) {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			MakeSurveyRow("type", "begin group", "name", "pets_group", "label", "Pets", "label::ITA", "Animali",
+				"relevant", "${age} >= 18"),
+			MakeSurveyRow("type", "select_multiple pets", "name", "pets", "label", "Pets", "label::ITA", "Animali",
+				"required", "yes"),
+			MakeSurveyRow("type", "integer", "name", "cats", "label", "Cats", "constraint", ". != 0 or . = 10",
+				"constraint_message", "Really?", "relevant", "selected(${pets}, 'cat')"),
+			MakeSurveyRow("type", "end group"),
+			MakeSurveyRow("type", "integer", "name", "age", "label", "Age", "label::ITA", "Età"),
+			MakeSurveyRow("type", "note", "name", "note", "label", "Note"),
+			MakeSurveyRow("type", "calculate", "name", "double", "calculation", "(${age} + 1) * 2"),
+		},
+		Choices: []ChoicesRow{
+			MakeChoicesRow("list name", "pets", "name", "cat", "label", "Cat", "label::ITA", "Gatto"),
+			MakeChoicesRow("list name", "pets", "name", "dog", "label", "Dog", "label::ITA", "Cane"),
+		},
+		LangSet: map[string]bool{"ITA": true},
+	}
+	ajf, err := Convert(xls)
+	check(t, err)
+	cb := BuildCodebook(ajf)
+
+	var buf bytes.Buffer
+	check(t, EncCodebookCsv(&buf, cb))
+	expected := `path,type,label,label::ITA,choices,required,constraint,relevance,calculation
+pets_group/pets,multiple choice,Pets,Animali,"cat = Cat
+dog = Dog",yes,,age ≥ 18,
+pets_group/cats,integer,Cats,,,,cats ≠ 0 or cats = 10 (Really?),age ≥ 18 and pets includes 'cat',
+slide0/age,integer,Age,Età,,,,,
+slide0/double,calculate,,,,,,,(age + 1) * 2
+`
+	if buf.String() != expected {
+		t.Errorf("Wrong csv:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	check(t, EncCodebookMarkdown(&buf, cb, "Pets"))
+	if !strings.Contains(buf.String(), "| pets_group/pets | multiple choice | Pets | Animali | cat = Cat<br>dog = Dog | yes |") {
+		t.Errorf("Wrong markdown:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	check(t, EncCodebookXlsx(&buf, cb))
+	wb, err := NewWorkBook(bytes.NewReader(buf.Bytes()), ".xlsx", int64(buf.Len()))
+	check(t, err)
+	choices := wb.Cells("choices")
+	if len(choices) != 3 || rowText(choices[2])[3] != "Cane" {
+		t.Errorf("Wrong choices sheet: %v", choices)
+	}
+	if fields := wb.Cells("fields"); len(fields) != 5 || fields[1][4].String() != "cat = Cat\ndog = Dog" {
+		t.Errorf("Wrong fields sheet: %v", fields)
+	}
+}
+
+func TestSubmissionSchema(t *testing.T) {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			MakeSurveyRow("type", "integer", "name", "age", "label", "Age", "required", "yes"),
+			MakeSurveyRow("type", "select_one size", "name", "size", "label", "Size"),
+			MakeSurveyRow("type", "range", "name", "score", "label", "Score", "parameters", "start=10 end=20 step=5"),
+			MakeSurveyRow("type", "text", "name", "job", "label", "Job", "required", "yes", "relevant", "${age} > 18"),
+			MakeSurveyRow("type", "begin repeat", "name", "kids", "label", "Kids", "repeat_count", "3"),
+			MakeSurveyRow("type", "select_multiple size", "name", "shoes", "label", "Shoes", "required", "yes"),
+			MakeSurveyRow("type", "end repeat"),
+		},
+		Choices: []ChoicesRow{
+			MakeChoicesRow("list name", "size", "name", "small", "label", "Small"),
+			MakeChoicesRow("list name", "size", "name", "big", "label", "Big"),
+		},
+	}
+	ajf, err := Convert(xls)
+	check(t, err)
+	schema := SubmissionSchema(ajf, "Kids")
+	if !reflect.DeepEqual(schema.Required, []string{"age"}) {
+		t.Errorf("Wrong required fields: %v", schema.Required)
+	}
+	if age := schema.Properties["age"]; age.Type != "integer" {
+		t.Errorf("Wrong type of age: %v", age.Type)
+	}
+	if size := schema.Properties["size"]; !reflect.DeepEqual(size.Enum, []interface{}{"small", "big", nil}) {
+		t.Errorf("Wrong enum of size: %v", size.Enum)
+	}
+	if score := schema.Properties["score"]; *score.Minimum != 10 || *score.Maximum != 20 || *score.MultipleOf != 5 {
+		t.Errorf("Wrong range of score: %v", score)
+	}
+	kids := schema.Properties["kids"]
+	if *kids.MaxItems != 3 {
+		t.Errorf("Wrong maxItems of kids: %v", *kids.MaxItems)
+	}
+	items := kids.Items.(*JsonSchema)
+	shoes := items.Properties["shoes"]
+	if !reflect.DeepEqual(items.Required, []string{"shoes"}) || shoes.Type != "array" || *shoes.MinItems != 1 {
+		t.Errorf("Wrong schema of repeat: %# v", pretty.Formatter(kids))
+	}
+}
+
+func TestEncSql(t *testing.T) {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			MakeSurveyRow("type", "integer", "name", "age", "label", "Age"),
+			MakeSurveyRow("type", "text", "name", "user", "label", "User"),
+			MakeSurveyRow("type", "select_one size", "name", "size", "label", "Size"),
+			MakeSurveyRow("type", "begin repeat", "name", "kids", "label", "Kids", "repeat_count", "3"),
+			MakeSurveyRow("type", "date", "name", "birth", "label", "Date of\nbirth"),
+			MakeSurveyRow("type", "select_multiple size", "name", "order", "label", "Shoes"),
+			MakeSurveyRow("type", "end repeat"),
+		},
+		Choices: []ChoicesRow{
+			MakeChoicesRow("list name", "size", "name", "small", "label", "Small"),
+			MakeChoicesRow("list name", "size", "name", "big", "label", "Kid's"),
+		},
+	}
+	ajf, err := Convert(xls)
+	check(t, err)
+	var buf bytes.Buffer
+	check(t, EncSql(&buf, ajf, "kids", SQLite))
+	expected := `CREATE TABLE kids_choices_size (
+	value text PRIMARY KEY,
+	label text NOT NULL
+);
+INSERT INTO kids_choices_size (value, label) VALUES
+	('small', 'Small'),
+	('big', 'Kid''s');
+
+CREATE TABLE kids (
+	id INTEGER PRIMARY KEY,
+	age integer, -- Age
+	"user" text, -- User
+	size text REFERENCES kids_choices_size (value) -- Size
+);
+
+-- Kids
+CREATE TABLE kids_kids (
+	id INTEGER PRIMARY KEY,
+	submission_id bigint NOT NULL REFERENCES kids (id) ON DELETE CASCADE,
+	rep integer NOT NULL, -- index of the repetition, from 0
+	birth text, -- Date of birth
+	UNIQUE (submission_id, rep)
+);
+
+-- Shoes
+CREATE TABLE kids_kids_order (
+	kids_kids_id bigint NOT NULL REFERENCES kids_kids (id) ON DELETE CASCADE,
+	value text NOT NULL REFERENCES kids_choices_size (value),
+	PRIMARY KEY (kids_kids_id, value)
+);
+`
+	if buf.String() != expected {
+		t.Errorf("Wrong sqlite tables:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	check(t, EncSql(&buf, ajf, "kids", Postgres))
+	if s := buf.String(); !strings.Contains(s, "id bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,") ||
+		!strings.Contains(s, "birth date, -- Date of birth") {
+		t.Errorf("Wrong postgres tables:\n%s", s)
+	}
+
+	ajf.Slides[0].Nodes[0].Name = "id"
+	if err := EncSql(&buf, ajf, "kids", Postgres); err == nil {
+		t.Errorf("Expected error for field named id.")
+	}
+}
+
+func TestEncTypes(t *testing.T) {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			MakeSurveyRow("type", "integer", "name", "age", "label", "Age"),
+			MakeSurveyRow("type", "select_one size", "name", "size", "label", "Size"),
+			MakeSurveyRow("type", "calculate", "name", "double", "calculation", "${age} * 2"),
+			MakeSurveyRow("type", "begin repeat", "name", "kids", "label", "Kids", "repeat_count", "3"),
+			MakeSurveyRow("type", "select_multiple size", "name", "shoes", "label", "Shoes"),
+			MakeSurveyRow("type", "end repeat"),
+		},
+		Choices: []ChoicesRow{
+			MakeChoicesRow("list name", "size", "name", "small", "label", "Small"),
+			MakeChoicesRow("list name", "size", "name", "kid's", "label", "Kid's"),
+		},
+	}
+	ajf, err := Convert(xls)
+	check(t, err)
+
+	var buf bytes.Buffer
+	check(t, EncTypeScript(&buf, ajf, "kids"))
+	expected := `// Code generated by formconv. DO NOT EDIT.
+
+export type SizeChoice =
+	| 'small'
+	| 'kid\'s';
+
+export interface KidsSubmission {
+	/** Age */
+	age?: number | null;
+	/** Size */
+	size?: SizeChoice | null;
+	double?: unknown | null;
+	/** Number of repetitions of Kids */
+	kids?: number | null;
+	/** Shoes, in each repetition */
+	[shoes: ` + "`shoes__${number}`" + `]: SizeChoice[] | null | undefined;
+}
+`
+	if buf.String() != expected {
+		t.Errorf("Wrong typescript:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	check(t, EncGoTypes(&buf, ajf, "kids", "forms"))
+	for _, s := range []string{
+		"package forms\n",
+		"SizeKidS  SizeChoice = \"kid's\"\n",
+		"Age    *int        `json:\"age,omitempty\"`",
+		"Kids   []KidsKids  `json:\"-\"` // Kids",
+		"Shoes []SizeChoice `json:\"shoes,omitempty\"`",
+		"func (s *KidsSubmission) UnmarshalJSON(data []byte) error {",
+		"func (s KidsSubmission) MarshalJSON() ([]byte, error) {",
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("Go types don't contain %q:\n%s", s, buf.String())
+		}
+	}
+}
+
+func TestExportSubmissions(t *testing.T) {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			MakeSurveyRow("type", "integer", "name", "age", "label", "Age"),
+			MakeSurveyRow("type", "select_multiple size", "name", "sizes", "label", "Sizes"),
+			MakeSurveyRow("type", "begin repeat", "name", "kids", "label", "Kids", "repeat_count", "3"),
+			MakeSurveyRow("type", "text", "name", "kid", "label", "Kid"),
+			MakeSurveyRow("type", "end repeat"),
+		},
+		Choices: []ChoicesRow{
+			MakeChoicesRow("list name", "size", "name", "small", "label", "Small"),
+			MakeChoicesRow("list name", "size", "name", "big", "label", "Big"),
+		},
+	}
+	ajf, err := Convert(xls)
+	check(t, err)
+	subs, err := DecSubmissions([]byte(`[
+		{"age": 30, "sizes": ["big"], "kids": 2, "kid__0": "Anna", "kid__1": "Marco"},
+		{"age": 40, "kids": 0}
+	]`))
+	check(t, err)
+	sheets := ExportSubmissions(ajf, subs, false)
+	expected := []Sheet{
+		{"submissions", [][]interface{}{
+			{"submission", "age", "sizes/small", "sizes/big"},
+			{1.0, 30.0, 0.0, 1.0},
+			{2.0, 40.0, nil, nil},
+		}},
+		{"kids", [][]interface{}{
+			{"submission", "repetition", "kid"},
+			{1.0, 1.0, "Anna"},
+			{1.0, 2.0, "Marco"},
+		}},
+	}
+	if !reflect.DeepEqual(sheets, expected) {
+		logFatalDiff(t, sheets, expected)
+	}
+	if head := ExportSubmissions(ajf, subs, true)[0].Rows[0]; head[2] != "Sizes: Small" {
+		t.Errorf("Wrong header with labels: %v", head)
+	}
+	var buf bytes.Buffer
+	check(t, EncSheetCsv(&buf, sheets[0]))
+	if buf.String() != "submission,age,sizes/small,sizes/big\n1,30,0,1\n2,40,,\n" {
+		t.Errorf("Wrong csv:\n%s", buf.String())
+	}
+}
+
+func TestSheetNames(t *testing.T) {
+	long := strings.Repeat("a", 30)
+	sheets := []Sheet{{Name: "submissions"}, {Name: "Submissions"}, {Name: "submissions_2"},
+		{Name: long + "xy"}, {Name: long + "xz"}, {Name: "a/b?"}}
+	names := sheetNames(sheets)
+	expected := []string{"submissions", "Submissions_2", "submissions_2_2", long + "x", long[:29] + "_2", "a_b_"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Wrong sheet names %q, expected %q.", names, expected)
+	}
+}
+
+func TestEncFhirQuestionnaire(t *testing.T) {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			MakeSurveyRow("type", "integer", "name", "age", "label", "Age", "label::Italiano (it)", "Età", "required", "yes"),
+			MakeSurveyRow("type", "select_multiple pets", "name", "pets", "label", "Pets"),
+			MakeSurveyRow("type", "begin group", "name", "adult", "label", "Adult",
+				"relevant", "${age} >= 18 and selected(${pets}, 'dog')"),
+			MakeSurveyRow("type", "text", "name", "job", "label", "Job", "hint", "Your main job",
+				"appearance", "multiline", "relevant", "${age} < 65 or ${job} != ''"),
+			MakeSurveyRow("type", "end group"),
+			MakeSurveyRow("type", "calculate", "name", "months", "calculation", "${age} * 12"),
+		},
+		Choices: []ChoicesRow{
+			MakeChoicesRow("list name", "pets", "name", "dog", "label", "Dog", "label::Italiano (it)", "Cane"),
+		},
+		LangSet: map[string]bool{"Italiano (it)": true},
+	}
+	ajf, err := Convert(xls)
+	check(t, err)
+	var buf bytes.Buffer
+	check(t, EncFhirQuestionnaire(&buf, ajf, "Pets", "pets form"))
+	var q fhirQuestionnaire
+	check(t, json.Unmarshal(buf.Bytes(), &q))
+	if q.ResourceType != "Questionnaire" || q.Id != "pets-form" || q.Name != "PetsForm" || len(q.Item) != 3 ||
+		len(q.Item[0].Item) != 2 || len(q.Item[2].Item) != 1 {
+		t.Fatalf("Wrong questionnaire:\n%s", buf.String())
+	}
+
+	age, pets, adult, months := q.Item[0].Item[0], q.Item[0].Item[1], q.Item[1], q.Item[2].Item[0]
+	if age.Type != "integer" || !age.Required || age.TextExt == nil ||
+		age.TextExt.Extension[0].Extension[0].ValueCode != "it" ||
+		age.TextExt.Extension[0].Extension[1].ValueString != "Età" {
+		t.Errorf("Wrong integer item: %# v", pretty.Formatter(age))
+	}
+	if pets.Type != "choice" || !pets.Repeats || len(pets.AnswerOption) != 1 ||
+		pets.AnswerOption[0].ValueCoding.Code != "dog" || pets.AnswerOption[0].ValueCoding.DisplayExt == nil {
+		t.Errorf("Wrong choice item: %# v", pretty.Formatter(pets))
+	}
+
+	eighteen := 18
+	expectedWhen := []fhirEnableWhen{
+		{Question: "age", Operator: ">=", AnswerInteger: &eighteen},
+		{Question: "pets", Operator: "=", AnswerCoding: &fhirCoding{Code: "dog"}},
+	}
+	if adult.Type != "group" || adult.EnableBehavior != "all" || !reflect.DeepEqual(adult.EnableWhen, expectedWhen) {
+		t.Errorf("Wrong group item: %# v", pretty.Formatter(adult))
+	}
+	job := adult.Item[0]
+	if job.Type != "text" || len(job.EnableWhen) != 2 || job.EnableBehavior != "any" ||
+		job.EnableWhen[1].Operator != "exists" || len(job.Item) != 1 || job.Item[0].Type != "display" {
+		t.Errorf("Wrong text item: %# v", pretty.Formatter(job))
+	}
+
+	expr := "(%resource.repeat(item).where(linkId='age').answer.value * 12)"
+	if len(months.Extension) != 1 || !months.ReadOnly || months.Type != "decimal" ||
+		months.Extension[0].ValueExpression.Expression != expr {
+		t.Errorf("Wrong calculated item: %# v", pretty.Formatter(months))
+	}
+	e := fhirEncoder{ajf: ajf}
+	ext := e.expressionExt("enableWhenExpression", "isUserInGroup('admin')")
+	if ext.ValueExpression.Language != "text/javascript" {
+		t.Errorf("Wrong expression: %# v", pretty.Formatter(ext))
+	}
+}
+
 func TestBuildChoicesOrigins(t *testing.T) {
 	choicesSheet := []ChoicesRow{
 		MakeChoicesRow("list name", "list1", "name", "elem1a", "label", "label1a"),
@@ -0,0 +1,443 @@
+package formats
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"unicode/utf16"
+
+	"github.com/extrame/ole2"
+)
+
+// The xls reader decodes the BIFF8 records of the Workbook stream directly,
+// as github.com/extrame/xls only exposes the formatted text of cells
+// (e.g. formula cells have no value and dates depend on the file's formats).
+// Specification: [MS-XLS] Excel Binary File Format.
+
+const (
+	recFormula    = 0x0006
+	recEOF        = 0x000A
+	recDateMode   = 0x0022
+	recContinue   = 0x003C
+	recColInfo    = 0x007D
+	recBoundSheet = 0x0085
+	recMulRK      = 0x00BD
+	recXF         = 0x00E0
+	recMergeCells = 0x00E5
+	recSST        = 0x00FC
+	recLabelSST   = 0x00FD
+	recNumber     = 0x0203
+	recRow        = 0x0208
+	recLabel      = 0x0204
+	recBoolErr    = 0x0205
+	recString     = 0x0207
+	recRK         = 0x027E
+	recFormat     = 0x041E
+	recBOF        = 0x0809
+)
+
+const biff8Version = 0x0600
+
+const maxXlsCols = 256
+
+type biffRecord struct {
+	id   uint16
+	data []byte
+}
+
+// biffReader splits a BIFF stream in records.
+// CONTINUE records are returned as separate records.
+type biffReader struct {
+	stream []byte
+}
+
+func (r *biffReader) peek() (rec biffRecord, ok bool) {
+	if len(r.stream) < 4 {
+		return biffRecord{}, false
+	}
+	rec.id = binary.LittleEndian.Uint16(r.stream)
+	size := int(binary.LittleEndian.Uint16(r.stream[2:]))
+	if 4+size > len(r.stream) {
+		size = len(r.stream) - 4
+	}
+	rec.data = r.stream[4 : 4+size]
+	return rec, true
+}
+
+func (r *biffReader) next() (rec biffRecord, ok bool) {
+	rec, ok = r.peek()
+	if ok {
+		r.stream = r.stream[4+len(rec.data):]
+	}
+	return rec, ok
+}
+
+type xlsSheet struct {
+	name   string
+	offset int // of the BOF record in the Workbook stream
+	hidden bool
+}
+
+type xlsWorkBook struct {
+	workBookBase
+	stream   []byte
+	date1904 bool
+	xfFormat []uint16          // number format of each XF record
+	formats  map[uint16]string // user-defined number formats
+	sst      []string          // shared strings
+	sheets   []xlsSheet
+}
+
+func openXls(f File, opts WorkBookOptions) (*xlsWorkBook, error) {
+	ole, err := ole2.Open(f, "utf-8")
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ole.ListDir()
+	if err != nil {
+		return nil, err
+	}
+	var book, root *ole2.File
+	for _, file := range dir {
+		switch file.Name() {
+		case "Workbook":
+			if book == nil {
+				book = file
+			}
+		case "Book":
+			return nil, errors.New("Excel 95 (BIFF5) files are not supported, save the file in a newer format.")
+		case "Root Entry":
+			root = file
+		}
+	}
+	if book == nil || root == nil {
+		return nil, errors.New("Workbook stream not found in xls file.")
+	}
+	stream, err := io.ReadAll(ole.OpenFile(book, root))
+	if err != nil {
+		return nil, err
+	}
+	wb := &xlsWorkBook{
+		workBookBase: workBookBase{opts: opts},
+		stream:       stream,
+		formats:      make(map[uint16]string),
+	}
+	err = wb.parseGlobals()
+	if err != nil {
+		return nil, err
+	}
+	return wb, nil
+}
+
+func (wb *xlsWorkBook) parseGlobals() error {
+	r := biffReader{wb.stream}
+	bof, ok := r.next()
+	if !ok || bof.id != recBOF || len(bof.data) < 2 {
+		return errors.New("Invalid xls file: missing BOF record.")
+	}
+	if binary.LittleEndian.Uint16(bof.data) != biff8Version {
+		return errors.New("Unsupported xls version, only Excel 97 and later files are supported.")
+	}
+	for rec, ok := r.next(); ok; rec, ok = r.next() {
+		d := rec.data
+		switch rec.id {
+		case recDateMode:
+			wb.date1904 = len(d) >= 2 && binary.LittleEndian.Uint16(d) == 1
+		case recFormat:
+			if len(d) < 2 {
+				continue
+			}
+			sr := biffStringReader{segs: [][]byte{d[2:]}}
+			wb.formats[binary.LittleEndian.Uint16(d)] = sr.unicodeString(2)
+		case recXF:
+			if len(d) < 4 {
+				continue
+			}
+			wb.xfFormat = append(wb.xfFormat, binary.LittleEndian.Uint16(d[2:]))
+		case recBoundSheet:
+			if len(d) < 8 || d[5] != 0 { // d[5] is the sheet type, 0 is worksheet
+				continue
+			}
+			sr := biffStringReader{segs: [][]byte{d[6:]}}
+			wb.sheets = append(wb.sheets, xlsSheet{
+				name:   sr.unicodeString(1),
+				offset: int(binary.LittleEndian.Uint32(d)),
+				hidden: d[4]&0x03 != 0, // hidden or very hidden
+			})
+		case recSST:
+			segs := [][]byte{d}
+			for next, ok := r.peek(); ok && next.id == recContinue; next, ok = r.peek() {
+				segs = append(segs, next.data)
+				r.next()
+			}
+			wb.sst = parseSST(segs)
+		case recEOF:
+			return nil
+		}
+	}
+	return nil
+}
+
+func parseSST(segs [][]byte) []string {
+	if len(segs[0]) < 8 {
+		return nil
+	}
+	unique := binary.LittleEndian.Uint32(segs[0][4:])
+	segs[0] = segs[0][8:]
+	r := biffStringReader{segs: segs}
+	sst := make([]string, 0, unique)
+	for i := uint32(0); i < unique && !r.eof(); i++ {
+		sst = append(sst, r.unicodeString(2))
+	}
+	return sst
+}
+
+// biffStringReader reads XLUnicodeRichExtendedString structures
+// that can span multiple CONTINUE records.
+type biffStringReader struct {
+	segs [][]byte
+	seg  int
+	off  int
+}
+
+func (r *biffStringReader) eof() bool {
+	for r.seg < len(r.segs) && r.off >= len(r.segs[r.seg]) {
+		r.seg++
+		r.off = 0
+	}
+	return r.seg >= len(r.segs)
+}
+
+// newSegment reports whether the next read starts a CONTINUE record.
+func (r *biffStringReader) newSegment() bool {
+	return r.seg < len(r.segs) && r.off >= len(r.segs[r.seg]) && r.seg+1 < len(r.segs)
+}
+
+func (r *biffStringReader) byte() byte {
+	if r.eof() {
+		return 0
+	}
+	b := r.segs[r.seg][r.off]
+	r.off++
+	return b
+}
+
+func (r *biffStringReader) uint16() uint16 {
+	return uint16(r.byte()) | uint16(r.byte())<<8
+}
+
+func (r *biffStringReader) uint32() uint32 {
+	return uint32(r.uint16()) | uint32(r.uint16())<<16
+}
+
+func (r *biffStringReader) skip(n int) {
+	for ; n > 0 && !r.eof(); n-- {
+		r.off++
+	}
+}
+
+// unicodeString reads a string whose character count is stored in lenSize bytes.
+func (r *biffStringReader) unicodeString(lenSize int) string {
+	var cch int
+	if lenSize == 1 {
+		cch = int(r.byte())
+	} else {
+		cch = int(r.uint16())
+	}
+	flags := r.byte()
+	var runs, ext int
+	if flags&0x08 != 0 { // rich text
+		runs = int(r.uint16())
+	}
+	if flags&0x04 != 0 { // phonetic data
+		ext = int(r.uint32())
+	}
+	chars := make([]uint16, 0, cch)
+	for len(chars) < cch {
+		if r.newSegment() {
+			// Characters continuing in another record are preceded
+			// by a new flags byte, they may change width.
+			r.eof()
+			flags = r.byte()
+		}
+		if r.eof() {
+			break
+		}
+		if flags&0x01 != 0 {
+			chars = append(chars, r.uint16())
+		} else {
+			chars = append(chars, uint16(r.byte()))
+		}
+	}
+	r.skip(4*runs + ext)
+	return string(utf16.Decode(chars))
+}
+
+func (wb *xlsWorkBook) Cells(sheetName string) [][]Cell {
+	var sheet *xlsSheet
+	for i := range wb.sheets {
+		if wb.sheets[i].name == sheetName {
+			sheet = &wb.sheets[i]
+			break
+		}
+	}
+	if sheet == nil || sheet.offset >= len(wb.stream) {
+		return nil
+	}
+	l := sheetLayout{
+		hidden:     sheet.hidden,
+		hiddenRows: make(map[int]bool),
+		hiddenCols: make(map[int]bool),
+	}
+	if !wb.sheetVisible(sheetName, &l) {
+		return nil
+	}
+
+	var s sparseSheet
+	var pendingString *[2]int // formula cell whose value follows in a STRING record
+	depth := 0
+	r := biffReader{wb.stream[sheet.offset:]}
+	for rec, ok := r.next(); ok; rec, ok = r.next() {
+		d := rec.data
+		if rec.id == recBOF {
+			depth++ // embedded charts have their own BOF/EOF
+			continue
+		}
+		if rec.id == recEOF {
+			depth--
+			if depth == 0 {
+				break
+			}
+			continue
+		}
+		if depth != 1 {
+			continue
+		}
+		switch rec.id {
+		case recColInfo:
+			if len(d) >= 10 && binary.LittleEndian.Uint16(d[8:])&0x0001 != 0 {
+				first, last := int(binary.LittleEndian.Uint16(d)), int(binary.LittleEndian.Uint16(d[2:]))
+				for j := first; j <= last && j < maxXlsCols; j++ {
+					l.hiddenCols[j] = true
+				}
+			}
+			continue
+		case recRow:
+			if len(d) >= 16 && binary.LittleEndian.Uint16(d[12:])&0x0020 != 0 {
+				l.hiddenRows[int(binary.LittleEndian.Uint16(d))] = true
+			}
+			continue
+		case recMergeCells:
+			if len(d) < 2 {
+				continue
+			}
+			n := int(binary.LittleEndian.Uint16(d))
+			for i := 0; i < n && 2+8*i+8 <= len(d); i++ {
+				r := d[2+8*i:]
+				l.merged = append(l.merged, cellRange{
+					firstRow: int(binary.LittleEndian.Uint16(r)),
+					lastRow:  int(binary.LittleEndian.Uint16(r[2:])),
+					firstCol: int(binary.LittleEndian.Uint16(r[4:])),
+					lastCol:  int(binary.LittleEndian.Uint16(r[6:])),
+				})
+			}
+			continue
+		}
+		if rec.id == recString && pendingString != nil {
+			sr := biffStringReader{segs: [][]byte{d}}
+			c := stringCell(sr.unicodeString(2))
+			c.IsFormula = c.Type != CellEmpty
+			s.set(pendingString[0], pendingString[1], c)
+			pendingString = nil
+			continue
+		}
+		if len(d) < 6 {
+			continue
+		}
+		row := int(binary.LittleEndian.Uint16(d))
+		col := int(binary.LittleEndian.Uint16(d[2:]))
+		ixfe := binary.LittleEndian.Uint16(d[4:])
+		switch rec.id {
+		case recLabelSST:
+			if len(d) >= 10 {
+				if i := int(binary.LittleEndian.Uint32(d[6:])); i < len(wb.sst) {
+					s.set(row, col, stringCell(wb.sst[i]))
+				}
+			}
+		case recLabel:
+			sr := biffStringReader{segs: [][]byte{d[6:]}}
+			s.set(row, col, stringCell(sr.unicodeString(2)))
+		case recNumber:
+			if len(d) >= 14 {
+				v := math.Float64frombits(binary.LittleEndian.Uint64(d[6:]))
+				s.set(row, col, wb.numberCell(ixfe, v))
+			}
+		case recRK:
+			if len(d) >= 10 {
+				s.set(row, col, wb.numberCell(ixfe, rkValue(binary.LittleEndian.Uint32(d[6:]))))
+			}
+		case recMulRK:
+			for i := 4; i+6 <= len(d)-2; i += 6 {
+				ixfe := binary.LittleEndian.Uint16(d[i:])
+				v := rkValue(binary.LittleEndian.Uint32(d[i+2:]))
+				s.set(row, col, wb.numberCell(ixfe, v))
+				col++
+			}
+		case recBoolErr:
+			if len(d) >= 8 && d[7] == 0 { // d[7] == 1 means error value
+				s.set(row, col, Cell{Type: CellBool, Bool: d[6] != 0})
+			}
+		case recFormula:
+			if len(d) < 14 {
+				continue
+			}
+			var c Cell
+			val := d[6:14]
+			if val[6] == 0xFF && val[7] == 0xFF {
+				switch val[0] {
+				case 0: // string, in the following STRING record
+					pendingString = &[2]int{row, col}
+					continue
+				case 1:
+					c = Cell{Type: CellBool, Bool: val[2] != 0}
+				default: // error or empty string
+					continue
+				}
+			} else {
+				c = wb.numberCell(ixfe, math.Float64frombits(binary.LittleEndian.Uint64(val)))
+			}
+			c.IsFormula = true
+			s.set(row, col, c)
+		}
+	}
+	return wb.applyOptions(sheetName, s.rows(), &l)
+}
+
+func (wb *xlsWorkBook) numberCell(ixfe uint16, v float64) Cell {
+	if int(ixfe) < len(wb.xfFormat) {
+		ifmt := wb.xfFormat[ixfe]
+		if isBuiltinDateFormat(ifmt) || isDateFormat(wb.formats[ifmt]) {
+			return Cell{Type: CellDate, Time: excelTime(v, wb.date1904)}
+		}
+	}
+	return Cell{Type: CellNumber, Num: v}
+}
+
+func rkValue(rk uint32) float64 {
+	var v float64
+	if rk&0x02 != 0 { // integer
+		v = float64(int32(rk) >> 2)
+	} else {
+		v = math.Float64frombits(uint64(rk&0xFFFFFFFC) << 32)
+	}
+	if rk&0x01 != 0 {
+		v /= 100
+	}
+	return v
+}
+
+func isBuiltinDateFormat(ifmt uint16) bool {
+	return 14 <= ifmt && ifmt <= 22 || 27 <= ifmt && ifmt <= 36 ||
+		45 <= ifmt && ifmt <= 47 || 50 <= ifmt && ifmt <= 58
+}
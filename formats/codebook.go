@@ -0,0 +1,434 @@
+package formats
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A Codebook documents the data collected by a form, field by field,
+// for the people analyzing it.
+type Codebook struct {
+	Langs  []string // languages of the translations, besides the default one
+	Fields []CodebookField
+}
+
+type CodebookField struct {
+	// Path is the name of the field, preceded by the names
+	// of the slides and groups containing it, separated by "/".
+	Path   string
+	Labels []string // the default label, then the label in each language
+	Type   string
+	// Choices are the choices of single and multiple choice fields,
+	// from the list named ChoiceList.
+	ChoiceList  string
+	Choices     []CodebookChoice
+	Required    bool
+	Constraints []string // in readable form, with their error message
+	Relevance   string   // in readable form, including the relevance of groups
+	Calculation string   // in readable form
+}
+
+type CodebookChoice struct {
+	Code   string
+	Labels []string
+}
+
+// BuildCodebook describes the fields of ajf, in the order of the form.
+// Notes are omitted, as they collect no data; the cells of tables
+// follow their table, and are named like table__row__column.
+func BuildCodebook(ajf *AjfForm) *Codebook {
+	b := codebookBuilder{ajf: ajf, cb: &Codebook{Langs: sortedLangs(translationLangs(ajf))}}
+	b.addNodes(ajf.Slides, "", nil)
+	return b.cb
+}
+
+func translationLangs(ajf *AjfForm) map[string]bool {
+	langs := make(map[string]bool)
+	for lang := range ajf.Translations {
+		langs[lang] = true
+	}
+	return langs
+}
+
+type codebookBuilder struct {
+	ajf *AjfForm
+	cb  *Codebook
+}
+
+// addNodes adds the fields in nodes; relevance is the condition
+// for the visibility of their container.
+func (b *codebookBuilder) addNodes(nodes []Node, path string, relevance exprNode) {
+	for i := range nodes {
+		n := &nodes[i]
+		rel := relevance
+		if n.Visibility != nil {
+			rel = andNode(rel, parseReadable(n.Visibility.Condition))
+		}
+		if n.Type != NtField {
+			b.addNodes(n.Nodes, path+n.Name+"/", rel)
+			continue
+		}
+		if n.FieldType != nil && *n.FieldType == FtNote {
+			continue
+		}
+		f := CodebookField{
+			Path:      path + n.Name,
+			Labels:    b.labels(n.Label),
+			Type:      codebookType(n),
+			Relevance: readable(rel),
+		}
+		if n.ChoicesOriginRef != "" {
+			f.ChoiceList = n.ChoicesOriginRef
+			for _, o := range b.ajf.ChoicesOrigins {
+				if o.Name != n.ChoicesOriginRef {
+					continue
+				}
+				for _, c := range o.Choices {
+					f.Choices = append(f.Choices, CodebookChoice{c["value"], b.labels(c["label"])})
+				}
+			}
+		}
+		if v := n.Validation; v != nil {
+			f.Required = v.NotEmpty
+			for _, c := range v.Conditions {
+				if c.Condition == integerCondition(n.Name) {
+					continue // the type is integer
+				}
+				con := readable(parseReadable(c.Condition))
+				if c.ErrorMessage != "" {
+					con += " (" + c.ErrorMessage + ")"
+				}
+				f.Constraints = append(f.Constraints, con)
+			}
+		}
+		if n.Formula != nil {
+			f.Calculation = readable(parseReadable(n.Formula.Formula))
+		}
+		b.cb.Fields = append(b.cb.Fields, f)
+		b.addCells(n, path, f.Relevance)
+	}
+}
+
+// addCells adds the cells of a table field.
+func (b *codebookBuilder) addCells(table *Node, path, relevance string) {
+	for i, row := range table.Rows {
+		for j, cell := range row {
+			f := CodebookField{
+				Path:      path + table.Name + "/" + cellName(table.Name, i, j),
+				Labels:    make([]string, 1+len(b.cb.Langs)),
+				Relevance: relevance,
+			}
+			rowLabels, colLabels := b.labels(table.RowLabels[i]), b.labels(table.ColumnLabels[j])
+			for l := range f.Labels {
+				f.Labels[l] = rowLabels[l] + ", " + colLabels[l]
+				if rowLabels[l] == "" || colLabels[l] == "" {
+					f.Labels[l] = ""
+				}
+			}
+			f.Type = table.ColumnTypes[j]
+			if formula, ok := cell.(Formula); ok {
+				f.Type = "calculate"
+				f.Calculation = readable(parseReadable(formula.Formula))
+			}
+			b.cb.Fields = append(b.cb.Fields, f)
+		}
+	}
+}
+
+// labels returns label and its translations.
+func (b *codebookBuilder) labels(label string) []string {
+	labels := []string{label}
+	for _, lang := range b.cb.Langs {
+		labels = append(labels, b.ajf.Translations[lang][label])
+	}
+	return labels
+}
+
+func codebookType(n *Node) string {
+	switch kind := fieldKind(*n); kind {
+	case "number":
+		if isIntegerField(n) {
+			return "integer"
+		}
+		return "decimal"
+	case "single":
+		return "single choice"
+	case "multiple":
+		return "multiple choice"
+	case "formula":
+		return "calculate"
+	case "range":
+		if n.RangeStart != nil && n.RangeEnd != nil && n.RangeStep != nil {
+			return fmt.Sprintf("range %d to %d, step %d", *n.RangeStart, *n.RangeEnd, *n.RangeStep)
+		}
+		return kind
+	default:
+		return kind
+	}
+}
+
+// Readable formulas.
+
+// parseReadable parses a formula for printing it in readable form;
+// if it can't be parsed, it is kept as it is.
+func parseReadable(js string) exprNode {
+	e, err := ParseExpr(js)
+	if err != nil {
+		return &identNode{js} // printed verbatim
+	}
+	return e.root
+}
+
+func andNode(x, y exprNode) exprNode {
+	if x == nil {
+		return y
+	}
+	return &binaryNode{"&&", x, y}
+}
+
+// readable prints a formula for people who don't know javascript,
+// like "age ≥ 18 and pets includes 'dog'".
+func readable(n exprNode) string {
+	if n == nil {
+		return ""
+	}
+	var b strings.Builder
+	printReadable(&b, n, 0)
+	return b.String()
+}
+
+var readableOps = map[string]string{
+	"||": "or", "&&": "and", "===": "=", "==": "=", "!==": "≠", "!=": "≠", "<=": "≤", ">=": "≥",
+}
+
+// Precedences of readable formulas, as in binaryLevels.
+const (
+	precCond = iota
+	precOr
+	precAnd
+	precEq
+	precRel
+	precAdd
+	precMul
+	precUnary
+	precPostfix
+)
+
+func binaryPrec(op string) int {
+	for level, ops := range binaryLevels {
+		if contains(ops, op) {
+			return precOr + level
+		}
+	}
+	panic("unknown operator " + op)
+}
+
+// printReadable prints n, in parentheses if its precedence is less than prec.
+func printReadable(b *strings.Builder, n exprNode, prec int) {
+	paren := func(p int) func() {
+		if p >= prec {
+			return func() {}
+		}
+		b.WriteString("(")
+		return func() { b.WriteString(")") }
+	}
+	switch n := n.(type) {
+	case *litNode:
+		switch v := n.v.(type) {
+		case string:
+			b.WriteString("'" + v + "'")
+		case float64:
+			b.WriteString(numberToString(v))
+		case nil:
+			b.WriteString("null")
+		default:
+			b.WriteString(toString(v))
+		}
+	case *identNode:
+		b.WriteString(n.name)
+	case *arrayNode:
+		b.WriteString("[")
+		for i, e := range n.elems {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			printReadable(b, e, precCond)
+		}
+		b.WriteString("]")
+	case *unaryNode:
+		defer paren(precUnary)()
+		if n.op == "!" {
+			b.WriteString("not ")
+		} else {
+			b.WriteString(n.op)
+		}
+		printReadable(b, n.x, precUnary)
+	case *binaryNode:
+		if n.op == "||" {
+			// Permissions are checked by the ajf app.
+			if id, ok := n.y.(*identNode); ok && id.name == "dino_permissions_end" {
+				printReadable(b, n.x, prec)
+				return
+			}
+			if id, ok := n.x.(*identNode); ok && id.name == "dino_permissions_begin" {
+				printReadable(b, n.y, prec)
+				return
+			}
+		}
+		p := binaryPrec(n.op)
+		defer paren(p)()
+		printReadable(b, n.x, p)
+		op := n.op
+		if r, ok := readableOps[op]; ok {
+			op = r
+		}
+		b.WriteString(" " + op + " ")
+		printReadable(b, n.y, p+1)
+	case *condNode:
+		defer paren(precCond)()
+		b.WriteString("if ")
+		printReadable(b, n.cond, precOr)
+		b.WriteString(" then ")
+		printReadable(b, n.then, precOr)
+		b.WriteString(" else ")
+		printReadable(b, n.els, precCond)
+	case *memberNode:
+		printReadable(b, n.x, precPostfix)
+		if lit, ok := n.prop.(*litNode); ok {
+			if s, ok := lit.v.(string); ok && isIdentifier(s) {
+				b.WriteString("." + s)
+				return
+			}
+		}
+		b.WriteString("[")
+		printReadable(b, n.prop, precCond)
+		b.WriteString("]")
+	case *callNode:
+		if id, ok := n.fn.(*identNode); ok {
+			switch {
+			case id.name == "valueInChoice" && len(n.args) == 2:
+				defer paren(precEq)()
+				printReadable(b, n.args[0], precRel)
+				b.WriteString(" includes ")
+				printReadable(b, n.args[1], precRel)
+				return
+			case id.name == "notEmpty" && len(n.args) == 1:
+				defer paren(precEq)()
+				printReadable(b, n.args[0], precRel)
+				b.WriteString(" is answered")
+				return
+			}
+		}
+		printReadable(b, n.fn, precPostfix)
+		b.WriteString("(")
+		for i, a := range n.args {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			printReadable(b, a, precCond)
+		}
+		b.WriteString(")")
+	default:
+		panic(fmt.Sprintf("unexpected node %T", n))
+	}
+}
+
+// Encoding.
+
+// header returns the names of the columns of the codebook.
+func (cb *Codebook) header() []string {
+	head := []string{"path", "type", "label"}
+	for _, lang := range cb.Langs {
+		head = append(head, "label::"+lang)
+	}
+	return append(head, "choices", "required", "constraint", "relevance", "calculation")
+}
+
+// rows returns the rows of the codebook, a field per row; choices are
+// listed one per line as "code = label", with the default label.
+func (cb *Codebook) rows() [][]string {
+	var rows [][]string
+	for _, f := range cb.Fields {
+		row := append([]string{f.Path, f.Type}, f.Labels...)
+		var choices []string
+		for _, c := range f.Choices {
+			choices = append(choices, c.Code+" = "+c.Labels[0])
+		}
+		required := ""
+		if f.Required {
+			required = "yes"
+		}
+		row = append(row, strings.Join(choices, "\n"), required,
+			strings.Join(f.Constraints, "\n"), f.Relevance, f.Calculation)
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// EncCodebookCsv writes the codebook as csv, with a header row.
+func EncCodebookCsv(w io.Writer, cb *Codebook) error {
+	cw := csv.NewWriter(w)
+	cw.Write(cb.header())
+	cw.WriteAll(cb.rows())
+	return cw.Error()
+}
+
+// EncCodebookXlsx writes the codebook as an xlsx workbook, with a sheet
+// for the fields and one for the choices, with labels in all the languages.
+func EncCodebookXlsx(w io.Writer, cb *Codebook) error {
+	fields := Sheet{Name: "fields", Rows: [][]interface{}{stringsRow(cb.header())}}
+	for _, row := range cb.rows() {
+		fields.Rows = append(fields.Rows, stringsRow(row))
+	}
+	choicesHead := []string{"list name", "name", "label"}
+	for _, lang := range cb.Langs {
+		choicesHead = append(choicesHead, "label::"+lang)
+	}
+	choices := Sheet{Name: "choices", Rows: [][]interface{}{stringsRow(choicesHead)}}
+	listed := make(map[string]bool)
+	for _, f := range cb.Fields {
+		if f.ChoiceList == "" || listed[f.ChoiceList] {
+			continue
+		}
+		listed[f.ChoiceList] = true
+		for _, c := range f.Choices {
+			choices.Rows = append(choices.Rows, stringsRow(append([]string{f.ChoiceList, c.Code}, c.Labels...)))
+		}
+	}
+	return EncXlsx(w, []Sheet{fields, choices})
+}
+
+func stringsRow(row []string) []interface{} {
+	cells := make([]interface{}, len(row))
+	for i, s := range row {
+		if s != "" {
+			cells[i] = s
+		}
+	}
+	return cells
+}
+
+var markdownEscaper = strings.NewReplacer("|", `\|`, "\r\n", "<br>", "\n", "<br>")
+
+// EncCodebookMarkdown writes the codebook as a markdown table, under a title.
+func EncCodebookMarkdown(w io.Writer, cb *Codebook, title string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", title)
+	writeRow := func(row []string) {
+		b.WriteString("|")
+		for _, cell := range row {
+			b.WriteString(" " + markdownEscaper.Replace(cell) + " |")
+		}
+		b.WriteString("\n")
+	}
+	head := cb.header()
+	writeRow(head)
+	b.WriteString(strings.Repeat("| --- ", len(head)) + "|\n")
+	for _, row := range cb.rows() {
+		writeRow(row)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -1,7 +1,6 @@
 package formats
 
 import (
-	"errors"
 	"fmt"
 	"math"
 	"sort"
@@ -23,7 +22,7 @@ func Convert(xls *XlsForm) (*AjfForm, error) {
 	var ajf AjfForm
 	var choicesMap map[string][]Choice
 	ajf.ChoicesOrigins, choicesMap = buildChoicesOrigins(xls.Choices)
-	err = choicesError(xls.Survey, choicesMap)
+	err = choicesError(xls.Survey, xls.Choices, choicesMap)
 	if err != nil {
 		return nil, err
 	}
@@ -84,19 +83,17 @@ func (co coSlice) Len() int           { return len(co) }
 func (co coSlice) Less(i, j int) bool { return co[i].Name < co[j].Name }
 func (co coSlice) Swap(i, j int)      { co[i], co[j] = co[j], co[i] }
 
-func choicesError(survey []SurveyRow, choicesMap map[string][]Choice) error {
-	for listName, choices := range choicesMap {
-		for _, c := range choices {
-			if c["label"] == "" {
-				return fmt.Errorf("Choice list %q contains a choice with no label", listName)
-			}
+func choicesError(survey []SurveyRow, choices []ChoicesRow, choicesMap map[string][]Choice) error {
+	for _, row := range choices {
+		if row.Label("") == "" {
+			return row.errorf("missing-label", "label", "Choice list %q contains a choice with no label.", row.ListName())
 		}
 	}
 	for _, row := range survey {
 		if isSelectOne(row.Type) || isSelectMultiple(row.Type) {
 			c := choiceName(row.Type)
 			if _, ok := choicesMap[c]; !ok {
-				return fmtSrcErr(row.LineNum, "Undefined single or multiple choice %q.", c)
+				return row.errorf("undefined-choices", "type", "Undefined single or multiple choice %q.", c)
 			}
 		}
 	}
@@ -119,25 +116,21 @@ func choiceName(rowType string) string {
 	return rowType[strings.Index(rowType, " ")+1:]
 }
 
-func fmtSrcErr(lineNum int, format string, a ...interface{}) error {
-	return fmt.Errorf("line %d: "+format, append([]interface{}{lineNum}, a...)...)
-}
-
 func checkTypes(survey []SurveyRow) error {
 	for _, row := range survey {
 		switch {
 		case isSupportedField(row.Type) || isIgnoredField(row.Type):
 			continue
 		case isUnsupportedField(row.Type):
-			return fmtSrcErr(row.LineNum, "Questions of type %q are not supported.", row.Type)
+			return row.errorf("unsupported-type", "type", "Questions of type %q are not supported.", row.Type)
 		case row.Type == beginGroup || row.Type == endGroup:
 			continue
 		case row.Type == beginRepeat || row.Type == endRepeat:
 			continue
 		case row.Type == "":
-			return fmtSrcErr(row.LineNum, "Empty type in non-empty survey row.", row.Type)
+			return row.errorf("empty-type", "type", "Empty type in non-empty survey row.")
 		default:
-			return fmtSrcErr(row.LineNum, "Invalid type %q in survey.", row.Type)
+			return row.errorf("invalid-type", "type", "Invalid type %q in survey.", row.Type)
 		}
 	}
 	return nil
@@ -150,7 +143,7 @@ func checkNames(survey []SurveyRow) error {
 		switch row.Type {
 		case endGroup, endRepeat:
 			if name != "" {
-				return fmtSrcErr(row.LineNum, "End of group/repeat can't have a name.")
+				return row.errorf("end-with-name", "name", "End of group/repeat can't have a name.")
 			}
 		case "note":
 			if name == "" {
@@ -159,11 +152,11 @@ func checkNames(survey []SurveyRow) error {
 			fallthrough
 		default:
 			if !isIdentifier(name) {
-				return fmtSrcErr(row.LineNum, "Name %q is not a valid identifier.", name)
+				return row.errorf("invalid-name", "name", "Name %q is not a valid identifier.", name)
 			}
 			r, seen := fieldHasRelevant[name]
 			if seen && (!r || row.Relevant() == "") {
-				return fmtSrcErr(row.LineNum, "Field name %q is already used.", name)
+				return row.errorf("duplicate-name", "name", "Field name %q is already used.", name)
 			}
 			fieldHasRelevant[name] = row.Relevant() != ""
 		}
@@ -192,7 +185,7 @@ func preprocessGroups(survey []SurveyRow) ([]SurveyRow, error) {
 		switch row.Type {
 		case beginRepeat:
 			if len(stack) > 0 {
-				return nil, fmtSrcErr(row.LineNum, "Repeats can't be nested.")
+				return nil, row.errorf("nested-repeat", "type", "Repeats can't be nested.")
 			}
 			fallthrough
 		case beginGroup:
@@ -200,13 +193,13 @@ func preprocessGroups(survey []SurveyRow) ([]SurveyRow, error) {
 		case endRepeat, endGroup:
 			if len(stack) == 0 ||
 				stack[len(stack)-1].Type[len("begin"):] != row.Type[len("end"):] {
-				return nil, fmtSrcErr(row.LineNum, "Unexpected end of group/repeat.")
+				return nil, row.errorf("unbalanced-group", "type", "Unexpected end of group/repeat.")
 			}
 			stack = stack[0 : len(stack)-1]
 		}
 	}
 	if len(stack) > 0 {
-		return nil, fmtSrcErr(stack[len(stack)-1].LineNum, "Unclosed group/repeat.")
+		return nil, stack[len(stack)-1].errorf("unbalanced-group", "type", "Unclosed group/repeat.")
 	}
 
 	// Wrap everything into a temporary global group,
@@ -248,7 +241,7 @@ func preprocessGroups(survey []SurveyRow) ([]SurveyRow, error) {
 
 type nodeBuilder struct {
 	parser formulaParser
-	tables map[string][][]string
+	tables map[string][][]Cell
 }
 
 func (b *nodeBuilder) buildGroup(survey []SurveyRow) (Node, error) {
@@ -276,7 +269,7 @@ func (b *nodeBuilder) buildGroup(survey []SurveyRow) (Node, error) {
 		if row.RepeatCount() != "" {
 			reps, ok := parseExcelUint(row.RepeatCount())
 			if !ok {
-				return Node{}, fmtSrcErr(row.LineNum, "repeat_count is not an unsigned integer.")
+				return Node{}, row.errorf("invalid-repeat-count", "repeat_count", "repeat_count is not an unsigned integer.")
 			}
 			group.MaxReps = &reps
 		}
@@ -312,7 +305,7 @@ func (b *nodeBuilder) buildGroup(survey []SurveyRow) (Node, error) {
 }
 
 func parseExcelUint(s string) (i int, ok bool) {
-	// xlsx files from google sheets may contain ints like 1.23e2
+	// Accept float representations of integers, like 1.23e2.
 	f, err := strconv.ParseFloat(s, 64)
 	if err != nil || f < 0 || f > math.MaxInt32 || f != math.Floor(f) {
 		return -1, false
@@ -346,7 +339,7 @@ func (b *nodeBuilder) groupReadonly(row SurveyRow) (*Condition, error) {
 	}
 	js, err := b.parser.Parse(ro, "readonly", row.Name())
 	if err != nil {
-		return nil, fmtSrcErr(row.LineNum, "%s", err)
+		return nil, row.errorf("invalid-formula", "readonly", "%s", err)
 	}
 	return &Condition{Condition: js}, nil
 }
@@ -361,7 +354,7 @@ func (b *nodeBuilder) buildField(row SurveyRow) (Node, error) {
 	if def := row.Default(); def != "" {
 		js, err := b.parser.Parse(def, "default", row.Name())
 		if err != nil {
-			return Node{}, fmtSrcErr(row.LineNum, "%s", err)
+			return Node{}, row.errorf("invalid-formula", "default", "%s", err)
 		}
 		field.DefaultVal = &Formula{Formula: js}
 	}
@@ -369,7 +362,7 @@ func (b *nodeBuilder) buildField(row SurveyRow) (Node, error) {
 	if ro == "yes" || ro == "true" {
 		field.Editable = new(bool) // &false
 	} else if ro != "" && ro != "no" && ro != "false" {
-		return Node{}, fmtSrcErr(row.LineNum, "readonly of field can't be a formula")
+		return Node{}, row.errorf("readonly-formula", "readonly", "readonly of field can't be a formula")
 	}
 	var err error
 	field.Visibility, err = b.nodeVisibility(row)
@@ -387,7 +380,7 @@ func (b *nodeBuilder) buildField(row SurveyRow) (Node, error) {
 		field.FieldType = &FtRange
 		start, end, step, err := parseRangeParams(row.Parameters())
 		if err != nil {
-			return Node{}, fmtSrcErr(row.LineNum, "%s", err)
+			return Node{}, row.errorf("invalid-parameters", "parameters", "%s", err)
 		}
 		field.RangeStart, field.RangeEnd, field.RangeStep = &start, &end, &step
 		field.Appearance = row.Appearance()
@@ -405,7 +398,7 @@ func (b *nodeBuilder) buildField(row SurveyRow) (Node, error) {
 		if filter := row.ChoiceFilter(); filter != "" {
 			js, err := b.parser.Parse(filter, "choice_filter", row.Name())
 			if err != nil {
-				return Node{}, fmtSrcErr(row.LineNum, "%s", err)
+				return Node{}, row.errorf("invalid-formula", "choice_filter", "%s", err)
 			}
 			field.ChoicesFilter = &Formula{Formula: js}
 		}
@@ -422,7 +415,7 @@ func (b *nodeBuilder) buildField(row SurveyRow) (Node, error) {
 		field.FieldType = &FtFormula
 		js, err := b.parser.Parse(row.Calculation(), "calculation", row.Name())
 		if err != nil {
-			return Node{}, fmtSrcErr(row.LineNum, "%s", err)
+			return Node{}, row.errorf("invalid-formula", "calculation", "%s", err)
 		}
 		field.Formula = &Formula{Formula: js}
 	case row.Type == "table":
@@ -467,13 +460,13 @@ func (b *nodeBuilder) nodeVisibility(row SurveyRow) (*Condition, error) {
 	if rel != "" {
 		relJs, err = b.parser.Parse(rel, "relevant", row.Name())
 		if err != nil {
-			return nil, fmtSrcErr(row.LineNum, "%s", err)
+			return nil, row.errorf("invalid-formula", "relevant", "%s", err)
 		}
 	}
 	if perm != "" {
 		permJs, err = b.parser.Parse(perm, "permissions_relevant", row.Name())
 		if err != nil {
-			return nil, fmtSrcErr(row.LineNum, "%s", err)
+			return nil, row.errorf("invalid-formula", "permissions_relevant", "%s", err)
 		}
 		permJs = "dino_permissions_begin||(" + permJs + ")||dino_permissions_end"
 	}
@@ -500,7 +493,7 @@ func (b *nodeBuilder) fieldValidation(row SurveyRow) (*FieldValidation, error) {
 	v := new(FieldValidation)
 
 	if !requiredVals[req] {
-		return nil, fmtSrcErr(row.LineNum, `Invalid value %q in "required" column.`, req)
+		return nil, row.errorf("invalid-required", "required", `Invalid value %q in "required" column.`, req)
 	}
 	if req == "yes" || req == "true" {
 		v.NotEmpty = true
@@ -509,7 +502,7 @@ func (b *nodeBuilder) fieldValidation(row SurveyRow) (*FieldValidation, error) {
 
 	if row.Type == "integer" {
 		v.Conditions = []ValidationCondition{{
-			Condition:        "!notEmpty(" + row.Name() + ") || isInt(" + row.Name() + ")",
+			Condition:        integerCondition(row.Name()),
 			ClientValidation: true,
 			ErrorMessage:     "The field value must be an integer.",
 		}}
@@ -519,7 +512,7 @@ func (b *nodeBuilder) fieldValidation(row SurveyRow) (*FieldValidation, error) {
 	}
 	js, err := b.parser.Parse(con, "constraint", row.Name())
 	if err != nil {
-		return nil, fmtSrcErr(row.LineNum, "%s", err)
+		return nil, row.errorf("invalid-formula", "constraint", "%s", err)
 	}
 	v.Conditions = append(v.Conditions, ValidationCondition{
 		Condition:        js,
@@ -529,70 +522,89 @@ func (b *nodeBuilder) fieldValidation(row SurveyRow) (*FieldValidation, error) {
 	return v, nil
 }
 
-func (b *nodeBuilder) convertTableField(field *Node, name string) (err error) {
-	defer func() {
-		if err != nil {
-			err = fmt.Errorf("Table %s: %s", name, err)
+// integerCondition is the validation condition of integer fields.
+func integerCondition(name string) string {
+	return "!notEmpty(" + name + ") || isInt(" + name + ")"
+}
+
+// isIntegerField tells whether a field has the validation of integers.
+func isIntegerField(n *Node) bool {
+	if n.Validation == nil {
+		return false
+	}
+	for _, c := range n.Validation.Conditions {
+		if c.Condition == integerCondition(n.Name) {
+			return true
 		}
-	}()
+	}
+	return false
+}
+
+func (b *nodeBuilder) convertTableField(field *Node, name string) error {
+	// row and col are 0-based positions in the table sheet, -1 if unknown.
+	tableErr := func(row, col int, format string, a ...interface{}) error {
+		return &Diagnostic{Rule: "invalid-table", Severity: SevError, Sheet: name,
+			Row: row + 1, Col: col + 1, Message: fmt.Sprintf(format, a...)}
+	}
 	tab := b.tables[name]
 	if len(tab) < 2 {
-		return errors.New("no rows.")
+		return tableErr(-1, -1, "Table %s has no rows.", name)
 	}
 	if len(tab[0]) < 2 {
-		return errors.New("no columns.")
+		return tableErr(-1, -1, "Table %s has no columns.", name)
 	}
 
 	for i := 1; i < len(tab[0]); i++ {
-		col := tab[0][i]
+		col := tab[0][i].String()
 		if col == "" {
 			break
 		}
 		s := strings.Index(col, " ")
 		if s == -1 {
-			return fmt.Errorf("column header %q must be in the format \"type label\".", col)
+			return tableErr(0, i, "Column header %q must be in the format \"type label\".", col)
 		}
 		typ := col[0:s]
 		label := col[s+1:]
 		if typ != "number" && typ != "text" && typ != "date" {
-			return fmt.Errorf("invalid column type %q", typ)
+			return tableErr(0, i, "Invalid column type %q.", typ)
 		}
 		field.ColumnTypes = append(field.ColumnTypes, typ)
 		field.ColumnLabels = append(field.ColumnLabels, label)
 	}
 	if len(field.ColumnTypes) == 0 {
-		return errors.New("no columns.")
+		return tableErr(-1, -1, "Table %s has no columns.", name)
 	}
 
 	for i := 1; i < len(tab); i++ {
 		row := tab[i]
-		if len(row) == 0 || row[0] == "" {
+		if len(row) == 0 || row[0].Type == CellEmpty {
 			break
 		}
-		field.RowLabels = append(field.RowLabels, row[0])
+		field.RowLabels = append(field.RowLabels, row[0].String())
 	}
 	if len(field.RowLabels) == 0 {
-		return errors.New("no rows.")
+		return tableErr(-1, -1, "Table %s has no rows.", name)
 	}
 
 	field.Rows = make([][]interface{}, len(field.RowLabels))
 	for i := range field.RowLabels {
 		row := tab[i+1]
 		for j := range field.ColumnLabels {
-			cell := ""
+			var cell Cell
 			if j+1 < len(row) {
 				cell = row[j+1]
 			}
 			cellName := fmt.Sprintf("%s__%d__%d", name, i, j)
-			if cell == "" {
+			if cell.Type == CellEmpty {
 				field.Rows[i] = append(field.Rows[i], cellName)
 				continue
 			}
 			var f Formula
+			var err error
 			f.Editable = new(bool) // &false
-			f.Formula, err = b.parser.Parse(cell, cellName, cellName)
+			f.Formula, err = b.parser.Parse(cell.formulaText(), cellName, cellName)
 			if err != nil {
-				return err
+				return tableErr(i+1, j+1, "%s", err)
 			}
 			field.Rows[i] = append(field.Rows[i], f)
 		}
@@ -651,7 +663,7 @@ func processSettings(settings []SettingsRow, ajf *AjfForm) error {
 			continue
 		}
 		if !isIdentifier(val) {
-			return fmtSrcErr(row.LineNum, "Tag value %q is not a valid identifier.", val)
+			return row.errorf("invalid-tag", "tag value", "Tag value %q is not a valid identifier.", val)
 		}
 		var t Tag
 		t.Label = lab
@@ -676,17 +688,17 @@ func buildTranslations(xls *XlsForm) (map[string]Translation, error) {
 	return res, nil
 }
 
+// translatedCols are the columns of the survey that can be translated.
+var translatedCols = []string{"label", "hint", "constraint_message", "required_message"}
+
 func buildTranslation(xls *XlsForm, lang string) (Translation, error) {
 	res := make(Translation)
 	for _, row := range xls.Survey {
-		cols := [](func(lang string) string){
-			row.Label, row.Hint, row.ConstraintMsg, row.RequiredMessage,
-		}
-		for _, col := range cols {
-			a, b := col(""), col(lang)
+		for _, col := range translatedCols {
+			a, b := row.langCell(col, ""), row.langCell(col, lang)
 			if a != "" && b != "" {
 				if strings.ContainsAny(a, "[]") {
-					return nil, fmtSrcErr(row.LineNum, "Translation key cannot contain square brackets")
+					return nil, row.errorf("translation-brackets", col, "Translation key cannot contain square brackets")
 				}
 				res[a] = b
 			}
@@ -696,7 +708,7 @@ func buildTranslation(xls *XlsForm, lang string) (Translation, error) {
 		a, b := row.Label(""), row.Label(lang)
 		if a != "" && b != "" {
 			if strings.ContainsAny(a, "[]") {
-				return nil, fmtSrcErr(row.LineNum, "Translation key cannot contain square brackets (choices sheet)")
+				return nil, row.errorf("translation-brackets", "label", "Translation key cannot contain square brackets")
 			}
 			res[a] = b
 		}
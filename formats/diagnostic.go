@@ -0,0 +1,89 @@
+package formats
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type Severity string
+
+const (
+	SevError   Severity = "error"
+	SevWarning Severity = "warning"
+)
+
+// A Diagnostic describes a problem found in a workbook and its position.
+// The errors returned by DecXlsform and Convert are usually Diagnostics.
+type Diagnostic struct {
+	Rule     string   `json:"rule"` // identifier of the kind of problem, like "invalid-name"
+	Severity Severity `json:"severity"`
+	File     string   `json:"file,omitempty"` // left to be filled by the caller
+	Sheet    string   `json:"sheet,omitempty"`
+	Row      int      `json:"row,omitempty"`    // 1-based, 0 if unknown
+	Column   string   `json:"column,omitempty"` // name in the header of the sheet
+	Col      int      `json:"col,omitempty"`    // 1-based index of the column, 0 if unknown
+	Message  string   `json:"message"`
+}
+
+// Error formats the diagnostic like "line 3: message (choices sheet)",
+// the sheet is omitted for the survey.
+func (d *Diagnostic) Error() string {
+	var b strings.Builder
+	if d.Row > 0 {
+		fmt.Fprintf(&b, "line %d: ", d.Row)
+	}
+	b.WriteString(d.Message)
+	if (d.Row > 0 || d.Col > 0) && d.Sheet != "" && d.Sheet != "survey" {
+		fmt.Fprintf(&b, " (%s sheet)", d.Sheet)
+	}
+	return b.String()
+}
+
+// Cell returns the reference of the cell of the diagnostic, like "C12";
+// only the row or column if the other is unknown.
+func (d *Diagnostic) Cell() string {
+	var ref string
+	if d.Col > 0 {
+		ref = ColumnName(d.Col - 1)
+	}
+	if d.Row > 0 {
+		ref += fmt.Sprint(d.Row)
+	}
+	return ref
+}
+
+// diag creates a diagnostic for a row; column, if not empty,
+// is the name of the column containing the problem.
+func (r Row) diag(sev Severity, rule, column, format string, a ...interface{}) *Diagnostic {
+	d := &Diagnostic{
+		Rule:     rule,
+		Severity: sev,
+		Sheet:    r.sheet,
+		Row:      r.LineNum,
+		Column:   column,
+		Message:  fmt.Sprintf(format, a...),
+	}
+	for j, name := range r.head {
+		if column != "" && name == column {
+			d.Col = j + 1
+			break
+		}
+	}
+	return d
+}
+
+func (r Row) errorf(rule, column, format string, a ...interface{}) error {
+	return r.diag(SevError, rule, column, format, a...)
+}
+
+// AsDiagnostic returns the Diagnostic wrapped in err,
+// or a diagnostic with the rule "invalid-file" if there is none
+// (for instance if the file isn't a workbook).
+func AsDiagnostic(err error) Diagnostic {
+	var d *Diagnostic
+	if errors.As(err, &d) {
+		return *d
+	}
+	return Diagnostic{Rule: "invalid-file", Severity: SevError, Message: err.Error()}
+}
@@ -0,0 +1,1035 @@
+package formats
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// An Expr is a formula compiled for evaluation in Go.
+// Formulas are parsed in the subset of JavaScript produced by the conversion
+// of xlsform formulas, and evaluated with the semantics of JavaScript.
+// Values are nil (null), bool, float64, string, []interface{} (arrays,
+// like the answers of select_multiple fields) or map[string]interface{}.
+type Expr struct {
+	src  string
+	root exprNode
+}
+
+// Vars are the values of the identifiers of an expression.
+type Vars map[string]interface{}
+
+// undefined is the JavaScript undefined, null is nil.
+type undefinedType struct{}
+
+var undefined = undefinedType{}
+
+// CompileFormula compiles an xlsform formula (or a formula in javascript,
+// if it starts with "js:"); fieldName is the field that "." refers to.
+func CompileFormula(formula, fieldName string) (*Expr, error) {
+	var p formulaParser
+	js, err := p.Parse(formula, "formula", fieldName)
+	if err != nil {
+		return nil, err
+	}
+	return ParseExpr(js)
+}
+
+// ParseExpr parses a formula in javascript, like the ones in ajf forms.
+func ParseExpr(js string) (*Expr, error) {
+	p := exprParser{lex: exprLexer{src: js}}
+	p.next()
+	root := p.parseCond()
+	if p.err == nil && p.tok.kind != tokEOF {
+		p.errorf("Unexpected %s.", p.tok)
+	}
+	if p.err != nil {
+		return nil, fmt.Errorf("formula %q: %s", js, p.err)
+	}
+	return &Expr{js, root}, nil
+}
+
+func (e *Expr) String() string { return e.src }
+
+// Eval evaluates the expression; identifiers not in vars are looked up
+// in the builtin functions, or are an error.
+func (e *Expr) Eval(vars Vars) (v interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			jsErr, ok := r.(jsError)
+			if !ok {
+				panic(r)
+			}
+			v, err = nil, fmt.Errorf("formula %q: %s", e.src, string(jsErr))
+		}
+	}()
+	v = e.root.eval(vars)
+	if v == undefined {
+		v = nil
+	}
+	return v, nil
+}
+
+// EvalBool evaluates the expression as a condition.
+func (e *Expr) EvalBool(vars Vars) (bool, error) {
+	v, err := e.Eval(vars)
+	return toBool(v), err
+}
+
+// jsError is panicked during evaluation and recovered by Eval.
+type jsError string
+
+func throwf(format string, a ...interface{}) { panic(jsError(fmt.Sprintf(format, a...))) }
+
+// Lexer.
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokNum
+	tokStr
+	tokIdent
+	tokPunct
+)
+
+type token struct {
+	kind tokKind
+	text string  // identifier or punctuation
+	num  float64 // value of tokNum
+	str  string  // value of tokStr
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of formula"
+	case tokNum:
+		return numberToString(t.num)
+	case tokStr:
+		return strconv.Quote(t.str)
+	}
+	return strconv.Quote(t.text)
+}
+
+type exprLexer struct {
+	src string
+	pos int
+}
+
+var puncts = []string{"===", "!==", "==", "!=", "<=", ">=", "&&", "||",
+	"(", ")", "[", "]", ",", ".", "?", ":", "+", "-", "*", "/", "%", "!", "<", ">"}
+
+func isIdentChar(c byte, first bool) bool {
+	return c == '_' || c == '$' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' ||
+		!first && '0' <= c && c <= '9' || c >= utf8.RuneSelf
+}
+
+func (l *exprLexer) scan() (token, error) {
+	for l.pos < len(l.src) && strings.IndexByte(" \t\r\n", l.src[l.pos]) >= 0 {
+		l.pos++
+	}
+	if l.pos == len(l.src) {
+		return token{kind: tokEOF}, nil
+	}
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case '0' <= c && c <= '9' || c == '.' && l.pos+1 < len(l.src) && '0' <= l.src[l.pos+1] && l.src[l.pos+1] <= '9':
+		for l.pos < len(l.src) && (isIdentChar(l.src[l.pos], false) || l.src[l.pos] == '.' ||
+			(l.src[l.pos] == '+' || l.src[l.pos] == '-') && strings.ContainsRune("eE", rune(l.src[l.pos-1]))) {
+			l.pos++
+		}
+		text := l.src[start:l.pos]
+		n, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			i, ierr := strconv.ParseInt(text, 0, 64)
+			if ierr != nil {
+				return token{}, fmt.Errorf("Invalid number %s.", text)
+			}
+			n = float64(i)
+		}
+		return token{kind: tokNum, num: n}, nil
+	case c == '"' || c == '\'':
+		s, err := l.scanString(c)
+		return token{kind: tokStr, str: s}, err
+	case isIdentChar(c, true):
+		for l.pos < len(l.src) && isIdentChar(l.src[l.pos], false) {
+			l.pos++
+		}
+		return token{kind: tokIdent, text: l.src[start:l.pos]}, nil
+	}
+	for _, p := range puncts {
+		if strings.HasPrefix(l.src[l.pos:], p) {
+			l.pos += len(p)
+			return token{kind: tokPunct, text: p}, nil
+		}
+	}
+	return token{}, fmt.Errorf("Unexpected character %q.", c)
+}
+
+func (l *exprLexer) scanString(quote byte) (string, error) {
+	l.pos++ // opening quote
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		l.pos++
+		switch {
+		case c == quote:
+			return b.String(), nil
+		case c == '\n':
+			return "", fmt.Errorf("String literal not terminated.")
+		case c != '\\':
+			b.WriteByte(c)
+			continue
+		}
+		if l.pos == len(l.src) {
+			break
+		}
+		e := l.src[l.pos]
+		l.pos++
+		switch e {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'v':
+			b.WriteByte('\v')
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			end := l.pos - 1
+			for end < len(l.src) && end < l.pos+2 && '0' <= l.src[end] && l.src[end] <= '7' {
+				end++
+			}
+			n, _ := strconv.ParseUint(l.src[l.pos-1:end], 8, 32)
+			b.WriteRune(rune(n))
+			l.pos = end
+		case 'x', 'u', 'U':
+			size := map[byte]int{'x': 2, 'u': 4, 'U': 8}[e]
+			if l.pos+size > len(l.src) {
+				return "", fmt.Errorf("Illegal char escape.")
+			}
+			n, err := strconv.ParseUint(l.src[l.pos:l.pos+size], 16, 32)
+			if err != nil {
+				return "", fmt.Errorf("Illegal char escape.")
+			}
+			b.WriteRune(rune(n))
+			l.pos += size
+		default:
+			b.WriteByte(e)
+		}
+	}
+	return "", fmt.Errorf("String literal not terminated.")
+}
+
+// Parser, with the precedence of javascript operators.
+
+type exprParser struct {
+	lex exprLexer
+	tok token
+	err error
+}
+
+func (p *exprParser) errorf(format string, a ...interface{}) {
+	if p.err == nil {
+		p.err = fmt.Errorf(format, a...)
+	}
+}
+
+func (p *exprParser) next() {
+	if p.err != nil {
+		p.tok = token{kind: tokEOF}
+		return
+	}
+	var err error
+	p.tok, err = p.lex.scan()
+	if err != nil {
+		p.errorf("%s", err)
+		p.tok = token{kind: tokEOF}
+	}
+}
+
+func (p *exprParser) is(punct string) bool {
+	return p.tok.kind == tokPunct && p.tok.text == punct
+}
+
+func (p *exprParser) expect(punct string) {
+	if !p.is(punct) {
+		p.errorf("Expected %q, found %s.", punct, p.tok)
+	}
+	p.next()
+}
+
+func (p *exprParser) parseCond() exprNode {
+	cond := p.parseBinary(0)
+	if !p.is("?") {
+		return cond
+	}
+	p.next()
+	then := p.parseCond()
+	p.expect(":")
+	return &condNode{cond, then, p.parseCond()}
+}
+
+// binaryLevels lists the binary operators by increasing precedence.
+var binaryLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"===", "!==", "==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *exprParser) parseBinary(level int) exprNode {
+	if level == len(binaryLevels) {
+		return p.parseUnary()
+	}
+	x := p.parseBinary(level + 1)
+	for p.tok.kind == tokPunct && contains(binaryLevels[level], p.tok.text) {
+		op := p.tok.text
+		p.next()
+		x = &binaryNode{op, x, p.parseBinary(level + 1)}
+	}
+	return x
+}
+
+func (p *exprParser) parseUnary() exprNode {
+	if p.is("!") || p.is("-") || p.is("+") {
+		op := p.tok.text
+		p.next()
+		return &unaryNode{op, p.parseUnary()}
+	}
+	return p.parsePostfix()
+}
+
+func (p *exprParser) parsePostfix() exprNode {
+	x := p.parsePrimary()
+	for p.err == nil {
+		switch {
+		case p.is("."):
+			p.next()
+			if p.tok.kind != tokIdent {
+				p.errorf("Expected a property name, found %s.", p.tok)
+			}
+			x = &memberNode{x, &litNode{p.tok.text}}
+			p.next()
+		case p.is("["):
+			p.next()
+			x = &memberNode{x, p.parseCond()}
+			p.expect("]")
+		case p.is("("):
+			p.next()
+			x = &callNode{x, p.parseList(")")}
+		default:
+			return x
+		}
+	}
+	return x
+}
+
+// parseList parses a comma separated list of expressions, and its end.
+func (p *exprParser) parseList(end string) []exprNode {
+	var list []exprNode
+	for p.err == nil && !p.is(end) {
+		list = append(list, p.parseCond())
+		if !p.is(end) {
+			p.expect(",")
+		}
+	}
+	p.expect(end)
+	return list
+}
+
+func (p *exprParser) parsePrimary() exprNode {
+	tok := p.tok
+	p.next()
+	switch tok.kind {
+	case tokNum:
+		return &litNode{tok.num}
+	case tokStr:
+		return &litNode{tok.str}
+	case tokIdent:
+		switch tok.text {
+		case "true", "false":
+			return &litNode{tok.text == "true"}
+		case "null":
+			return &litNode{nil}
+		case "undefined":
+			return &litNode{undefined}
+		}
+		return &identNode{tok.text}
+	case tokPunct:
+		switch tok.text {
+		case "(":
+			x := p.parseCond()
+			p.expect(")")
+			return x
+		case "[":
+			return &arrayNode{p.parseList("]")}
+		}
+	}
+	p.errorf("Unexpected %s.", tok)
+	return &litNode{nil}
+}
+
+// Evaluation.
+
+type exprNode interface {
+	eval(vars Vars) interface{}
+}
+
+type litNode struct{ v interface{} }
+
+type identNode struct{ name string }
+
+type arrayNode struct{ elems []exprNode }
+
+type unaryNode struct {
+	op string
+	x  exprNode
+}
+
+type binaryNode struct {
+	op   string
+	x, y exprNode
+}
+
+type condNode struct{ cond, then, els exprNode }
+
+type memberNode struct{ x, prop exprNode }
+
+type callNode struct {
+	fn   exprNode
+	args []exprNode
+}
+
+// A jsFunc is a builtin function; this is undefined for functions.
+type jsFunc func(this interface{}, args []interface{}) interface{}
+
+func (n *litNode) eval(Vars) interface{} { return n.v }
+
+func (n *identNode) eval(vars Vars) interface{} {
+	if v, ok := vars[n.name]; ok {
+		return normalizeValue(v)
+	}
+	if v, ok := builtins[n.name]; ok {
+		return v
+	}
+	throwf("%s is not defined.", n.name)
+	return nil
+}
+
+func (n *arrayNode) eval(vars Vars) interface{} {
+	a := make([]interface{}, len(n.elems))
+	for i, e := range n.elems {
+		a[i] = e.eval(vars)
+	}
+	return a
+}
+
+func (n *unaryNode) eval(vars Vars) interface{} {
+	x := n.x.eval(vars)
+	switch n.op {
+	case "!":
+		return !toBool(x)
+	case "-":
+		return -toNumber(x)
+	}
+	return toNumber(x)
+}
+
+func (n *condNode) eval(vars Vars) interface{} {
+	if toBool(n.cond.eval(vars)) {
+		return n.then.eval(vars)
+	}
+	return n.els.eval(vars)
+}
+
+func (n *binaryNode) eval(vars Vars) interface{} {
+	x := n.x.eval(vars)
+	switch n.op { // short circuit
+	case "&&":
+		if !toBool(x) {
+			return x
+		}
+		return n.y.eval(vars)
+	case "||":
+		if toBool(x) {
+			return x
+		}
+		return n.y.eval(vars)
+	}
+	y := n.y.eval(vars)
+	switch n.op {
+	case "===":
+		return strictEquals(x, y)
+	case "!==":
+		return !strictEquals(x, y)
+	case "==":
+		return looseEquals(x, y)
+	case "!=":
+		return !looseEquals(x, y)
+	case "+":
+		x, y = toPrimitive(x), toPrimitive(y)
+		_, xs := x.(string)
+		_, ys := y.(string)
+		if xs || ys {
+			return toString(x) + toString(y)
+		}
+		return toNumber(x) + toNumber(y)
+	case "-":
+		return toNumber(x) - toNumber(y)
+	case "*":
+		return toNumber(x) * toNumber(y)
+	case "/":
+		return toNumber(x) / toNumber(y)
+	case "%":
+		return math.Mod(toNumber(x), toNumber(y))
+	}
+	// Relational operators.
+	x, y = toPrimitive(x), toPrimitive(y)
+	xs, xok := x.(string)
+	ys, yok := y.(string)
+	if xok && yok {
+		switch n.op {
+		case "<":
+			return xs < ys
+		case "<=":
+			return xs <= ys
+		case ">":
+			return xs > ys
+		}
+		return xs >= ys
+	}
+	a, b := toNumber(x), toNumber(y)
+	switch n.op {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	}
+	return a >= b
+}
+
+func (n *memberNode) eval(vars Vars) interface{} {
+	return getProperty(n.x.eval(vars), n.prop.eval(vars))
+}
+
+func getProperty(x, prop interface{}) interface{} {
+	name := toString(prop)
+	switch x := x.(type) {
+	case nil, undefinedType:
+		throwf("Cannot read property %q of %s.", name, toString(x))
+	case string:
+		u := utf16.Encode([]rune(x))
+		if name == "length" {
+			return float64(len(u))
+		}
+		if i, ok := arrayIndex(prop, len(u)); ok {
+			return string(utf16.Decode(u[i : i+1]))
+		}
+		if m, ok := stringMethods[name]; ok {
+			return m
+		}
+	case []interface{}:
+		if name == "length" {
+			return float64(len(x))
+		}
+		if i, ok := arrayIndex(prop, len(x)); ok {
+			return x[i]
+		}
+		if m, ok := arrayMethods[name]; ok {
+			return m
+		}
+	case map[string]interface{}:
+		if v, ok := x[name]; ok {
+			return normalizeValue(v)
+		}
+	}
+	return undefined
+}
+
+func arrayIndex(prop interface{}, length int) (int, bool) {
+	f, ok := prop.(float64)
+	if !ok || f != math.Trunc(f) || f < 0 || f >= float64(length) {
+		return 0, false
+	}
+	return int(f), true
+}
+
+func (n *callNode) eval(vars Vars) interface{} {
+	var this, fn interface{}
+	if m, ok := n.fn.(*memberNode); ok {
+		this = m.x.eval(vars)
+		fn = getProperty(this, m.prop.eval(vars))
+	} else {
+		fn = n.fn.eval(vars)
+	}
+	f, ok := fn.(jsFunc)
+	if !ok {
+		throwf("%s is not a function.", exprName(n.fn))
+	}
+	args := make([]interface{}, len(n.args))
+	for i, a := range n.args {
+		args[i] = a.eval(vars)
+	}
+	return f(this, args)
+}
+
+func exprName(n exprNode) string {
+	switch n := n.(type) {
+	case *identNode:
+		return n.name
+	case *memberNode:
+		if lit, ok := n.prop.(*litNode); ok {
+			return exprName(n.x) + "." + toString(lit.v)
+		}
+	}
+	return "expression"
+}
+
+// Conversions, following the ECMAScript specification.
+
+// normalizeValue converts go values to the types used in evaluation.
+func normalizeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case []string:
+		a := make([]interface{}, len(v))
+		for i, s := range v {
+			a[i] = s
+		}
+		return a
+	}
+	return v
+}
+
+func toPrimitive(v interface{}) interface{} {
+	switch v.(type) {
+	case []interface{}, map[string]interface{}, jsFunc:
+		return toString(v)
+	}
+	return v
+}
+
+func toBool(v interface{}) bool {
+	switch v := v.(type) {
+	case nil, undefinedType:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case string:
+		return v != ""
+	}
+	return true
+}
+
+func toNumber(v interface{}) float64 {
+	switch v := v.(type) {
+	case nil:
+		return 0
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case float64:
+		return v
+	case string:
+		s := strings.TrimSpace(v)
+		switch s {
+		case "":
+			return 0
+		case "Infinity", "+Infinity":
+			return math.Inf(1)
+		case "-Infinity":
+			return math.Inf(-1)
+		}
+		if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+			if i, err := strconv.ParseUint(s[2:], 16, 64); err == nil {
+				return float64(i)
+			}
+			return math.NaN()
+		}
+		if strings.ContainsAny(s, "_xXpPnN") { // accepted by ParseFloat, not by js
+			return math.NaN()
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil && !strings.Contains(err.Error(), "range") {
+			return math.NaN()
+		}
+		return f
+	case []interface{}, map[string]interface{}:
+		return toNumber(toString(v))
+	}
+	return math.NaN()
+}
+
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case undefinedType:
+		return "undefined"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return numberToString(v)
+	case string:
+		return v
+	case []interface{}:
+		s := make([]string, len(v))
+		for i, e := range v {
+			if e != nil && e != undefined {
+				s[i] = toString(e)
+			}
+		}
+		return strings.Join(s, ",")
+	case map[string]interface{}:
+		return "[object Object]"
+	case jsFunc:
+		return "function () { [native code] }"
+	}
+	return fmt.Sprint(v)
+}
+
+func numberToString(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	case f == 0:
+		return "0"
+	}
+	if a := math.Abs(f); a >= 1e-6 && a < 1e21 {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	s := strconv.FormatFloat(f, 'e', -1, 64) // like 1.5e-07
+	mant, exp := s[:strings.IndexByte(s, 'e')+2], s[strings.IndexByte(s, 'e')+2:]
+	return mant + strings.TrimLeft(exp, "0")
+}
+
+func strictEquals(x, y interface{}) bool {
+	switch x := x.(type) {
+	case nil, undefinedType, bool, string:
+		return x == y
+	case float64:
+		y, ok := y.(float64)
+		return ok && x == y
+	}
+	return false // objects are compared by identity
+}
+
+func looseEquals(x, y interface{}) bool {
+	isNull := func(v interface{}) bool { return v == nil || v == undefined }
+	if isNull(x) || isNull(y) {
+		return isNull(x) && isNull(y)
+	}
+	_, xb := x.(bool)
+	_, yb := y.(bool)
+	_, xs := x.(string)
+	_, ys := y.(string)
+	_, xn := x.(float64)
+	_, yn := y.(float64)
+	switch {
+	case xb || yb || xn && ys || xs && yn:
+		return toNumber(x) == toNumber(y)
+	case (xs || xn) && !(ys || yn):
+		return strictEquals(x, toPrimitive(y)) || looseEquals(x, toPrimitive(y)) && !strictEquals(y, toPrimitive(y))
+	case (ys || yn) && !(xs || xn):
+		return looseEquals(y, x)
+	}
+	return strictEquals(x, y)
+}
+
+// Builtins: the javascript functions used by converted formulas
+// and the functions of the ajf runtime.
+
+func argNum(args []interface{}, i int) float64 {
+	if i >= len(args) {
+		return math.NaN()
+	}
+	return toNumber(args[i])
+}
+
+func mathFunc(f func(float64) float64) jsFunc {
+	return func(_ interface{}, args []interface{}) interface{} { return f(argNum(args, 0)) }
+}
+
+// jsRound is Math.round: halves are rounded towards +Infinity.
+func jsRound(x float64) float64 {
+	if math.IsNaN(x) || math.IsInf(x, 0) {
+		return x
+	}
+	return math.Floor(x + 0.5)
+}
+
+var mathObject = map[string]interface{}{
+	"PI":    math.Pi,
+	"E":     math.E,
+	"floor": mathFunc(math.Floor),
+	"ceil":  mathFunc(math.Ceil),
+	"trunc": mathFunc(math.Trunc),
+	"round": mathFunc(jsRound),
+	"log":   mathFunc(math.Log),
+	"log10": mathFunc(math.Log10),
+	"abs":   mathFunc(math.Abs),
+	"sin":   mathFunc(math.Sin),
+	"cos":   mathFunc(math.Cos),
+	"tan":   mathFunc(math.Tan),
+	"asin":  mathFunc(math.Asin),
+	"acos":  mathFunc(math.Acos),
+	"atan":  mathFunc(math.Atan),
+	"sqrt":  mathFunc(math.Sqrt),
+	"exp":   mathFunc(math.Exp),
+	"pow": jsFunc(func(_ interface{}, args []interface{}) interface{} {
+		return math.Pow(argNum(args, 0), argNum(args, 1))
+	}),
+	"atan2": jsFunc(func(_ interface{}, args []interface{}) interface{} {
+		return math.Atan2(argNum(args, 0), argNum(args, 1))
+	}),
+	"random": jsFunc(func(interface{}, []interface{}) interface{} { return rand.Float64() }),
+	"max": jsFunc(func(_ interface{}, args []interface{}) interface{} {
+		m := math.Inf(-1)
+		for i := range args {
+			n := argNum(args, i)
+			if math.IsNaN(n) {
+				return n
+			}
+			m = math.Max(m, n)
+		}
+		return m
+	}),
+	"min": jsFunc(func(_ interface{}, args []interface{}) interface{} {
+		m := math.Inf(1)
+		for i := range args {
+			n := argNum(args, i)
+			if math.IsNaN(n) {
+				return n
+			}
+			m = math.Min(m, n)
+		}
+		return m
+	}),
+}
+
+var builtins map[string]interface{}
+
+func init() {
+	builtins = map[string]interface{}{
+		"Math": mathObject,
+		"String": jsFunc(func(_ interface{}, args []interface{}) interface{} {
+			if len(args) == 0 {
+				return ""
+			}
+			return toString(args[0])
+		}),
+		"Number": jsFunc(func(_ interface{}, args []interface{}) interface{} {
+			if len(args) == 0 {
+				return 0.0
+			}
+			return toNumber(args[0])
+		}),
+		"Boolean": jsFunc(func(_ interface{}, args []interface{}) interface{} {
+			return len(args) > 0 && toBool(args[0])
+		}),
+		"NaN":      math.NaN(),
+		"Infinity": math.Inf(1),
+		// round(x, digits) of the ajf runtime.
+		"round": jsFunc(func(_ interface{}, args []interface{}) interface{} {
+			digits := 0.0
+			if len(args) > 1 {
+				digits = toNumber(args[1])
+			}
+			p := math.Pow(10, digits)
+			return jsRound(argNum(args, 0)*p) / p
+		}),
+		// valueInChoice(answer, value) tells whether value has been selected.
+		"valueInChoice": jsFunc(func(_ interface{}, args []interface{}) interface{} {
+			if len(args) < 2 {
+				return false
+			}
+			if a, ok := args[0].([]interface{}); ok {
+				for _, v := range a {
+					if looseEquals(v, args[1]) {
+						return true
+					}
+				}
+				return false
+			}
+			return looseEquals(args[0], args[1])
+		}),
+		"notEmpty": jsFunc(func(_ interface{}, args []interface{}) interface{} {
+			if len(args) == 0 || args[0] == nil || args[0] == undefined {
+				return false
+			}
+			return len(toString(args[0])) > 0
+		}),
+		"isInt": jsFunc(func(_ interface{}, args []interface{}) interface{} {
+			if len(args) == 0 {
+				return false
+			}
+			if s, ok := args[0].(string); ok {
+				return regexp.MustCompile(`^-?\d+$`).MatchString(s)
+			}
+			n := toNumber(args[0])
+			return !math.IsInf(n, 0) && n == math.Trunc(n)
+		}),
+		// Permissions are granted to everyone.
+		"isUserInGroup":          jsFunc(func(interface{}, []interface{}) interface{} { return true }),
+		"dino_permissions_begin": false,
+		"dino_permissions_end":   false,
+	}
+}
+
+func thisString(this interface{}) string {
+	if this == nil || this == undefined {
+		throwf("Cannot call a string method on %s.", toString(this))
+	}
+	return toString(this)
+}
+
+func argString(args []interface{}, i int) string {
+	if i >= len(args) {
+		return "undefined"
+	}
+	return toString(args[i])
+}
+
+// clampIndex converts a javascript position argument to an index in [0, length].
+func clampIndex(args []interface{}, i, length, def int) int {
+	if i >= len(args) || args[i] == undefined {
+		return def
+	}
+	n := toNumber(args[i])
+	switch {
+	case math.IsNaN(n) || n < 0:
+		return 0
+	case n > float64(length):
+		return length
+	}
+	return int(n)
+}
+
+var stringMethods = map[string]interface{}{
+	"includes": jsFunc(func(this interface{}, args []interface{}) interface{} {
+		s := utf16.Encode([]rune(thisString(this)))
+		start := clampIndex(args, 1, len(s), 0)
+		return strings.Contains(string(utf16.Decode(s[start:])), argString(args, 0))
+	}),
+	"startsWith": jsFunc(func(this interface{}, args []interface{}) interface{} {
+		s := utf16.Encode([]rune(thisString(this)))
+		start := clampIndex(args, 1, len(s), 0)
+		return strings.HasPrefix(string(utf16.Decode(s[start:])), argString(args, 0))
+	}),
+	"endsWith": jsFunc(func(this interface{}, args []interface{}) interface{} {
+		s := utf16.Encode([]rune(thisString(this)))
+		end := clampIndex(args, 1, len(s), len(s))
+		return strings.HasSuffix(string(utf16.Decode(s[:end])), argString(args, 0))
+	}),
+	"indexOf": jsFunc(func(this interface{}, args []interface{}) interface{} {
+		s := thisString(this)
+		i := strings.Index(s, argString(args, 0))
+		if i < 0 {
+			return -1.0
+		}
+		return float64(len(utf16.Encode([]rune(s[:i]))))
+	}),
+	"substring": jsFunc(func(this interface{}, args []interface{}) interface{} {
+		s := utf16.Encode([]rune(thisString(this)))
+		start, end := clampIndex(args, 0, len(s), 0), clampIndex(args, 1, len(s), len(s))
+		if start > end {
+			start, end = end, start
+		}
+		return string(utf16.Decode(s[start:end]))
+	}),
+	"concat": jsFunc(func(this interface{}, args []interface{}) interface{} {
+		s := thisString(this)
+		for _, a := range args {
+			s += toString(a)
+		}
+		return s
+	}),
+	"toUpperCase": jsFunc(func(this interface{}, _ []interface{}) interface{} {
+		return strings.ToUpper(thisString(this))
+	}),
+	"toLowerCase": jsFunc(func(this interface{}, _ []interface{}) interface{} {
+		return strings.ToLower(thisString(this))
+	}),
+	"trim": jsFunc(func(this interface{}, _ []interface{}) interface{} {
+		return strings.TrimSpace(thisString(this))
+	}),
+	// match returns the match and its groups, or null.
+	// Regular expressions have the syntax of Go, mostly compatible with javascript.
+	"match": jsFunc(func(this interface{}, args []interface{}) interface{} {
+		re, err := regexp.Compile(argString(args, 0))
+		if err != nil {
+			throwf("Invalid regular expression %q.", argString(args, 0))
+		}
+		m := re.FindStringSubmatch(thisString(this))
+		if m == nil {
+			return nil
+		}
+		res := make([]interface{}, len(m))
+		for i, s := range m {
+			res[i] = s
+		}
+		return res
+	}),
+}
+
+var arrayMethods = map[string]interface{}{
+	"includes": jsFunc(func(this interface{}, args []interface{}) interface{} {
+		for _, v := range this.([]interface{}) {
+			if len(args) > 0 && strictEquals(v, args[0]) {
+				return true
+			}
+		}
+		return false
+	}),
+	"indexOf": jsFunc(func(this interface{}, args []interface{}) interface{} {
+		for i, v := range this.([]interface{}) {
+			if len(args) > 0 && strictEquals(v, args[0]) {
+				return float64(i)
+			}
+		}
+		return -1.0
+	}),
+	"join": jsFunc(func(this interface{}, args []interface{}) interface{} {
+		sep := ","
+		if len(args) > 0 && args[0] != undefined {
+			sep = toString(args[0])
+		}
+		a := this.([]interface{})
+		s := make([]string, len(a))
+		for i, v := range a {
+			if v != nil && v != undefined {
+				s[i] = toString(v)
+			}
+		}
+		return strings.Join(s, sep)
+	}),
+}
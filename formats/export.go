@@ -0,0 +1,207 @@
+package formats
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// DecSubmissions decodes submissions in json,
+// either a list of objects or a single object.
+func DecSubmissions(data []byte) ([]Submission, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '{' {
+		var sub Submission
+		if err := json.Unmarshal(data, &sub); err != nil {
+			return nil, err
+		}
+		return []Submission{sub}, nil
+	}
+	var subs []Submission
+	if err := json.Unmarshal(data, &subs); err != nil {
+		return nil, err
+	}
+	return subs, nil
+}
+
+// ExportSubmissions flattens submissions in sheets, for analysis:
+//   - a sheet named "submissions", with a row for each submission;
+//   - a sheet for each repeat, named like it, with a row for each repetition;
+//   - a sheet for each table, named like it, with a row for each submission
+//     (or repetition, for tables in repeats) and a column for each cell.
+//
+// Submissions and repetitions are numbered from 1 in the first columns.
+// Multiple choice fields have a column for each choice, with 1 if
+// the choice is selected and 0 if not. The header has the names of the
+// fields (like field/choice for the columns of choices), or their labels
+// if labels is true. Notes are omitted.
+func ExportSubmissions(ajf *AjfForm, subs []Submission, labels bool) []Sheet {
+	main := &exportSheet{name: "submissions"}
+	e := exporter{ajf: ajf, sheets: []*exportSheet{main}}
+	e.addColumns(main, ajf.Slides, nil)
+	sheets := make([]Sheet, len(e.sheets))
+	for i, s := range e.sheets {
+		sheets[i] = s.export(subs, labels)
+	}
+	return sheets
+}
+
+type exporter struct {
+	ajf    *AjfForm
+	sheets []*exportSheet
+}
+
+type exportSheet struct {
+	name   string
+	repeat *Node // the repeat of the rows, nil for a row per submission
+	cols   []exportColumn
+}
+
+type exportColumn struct {
+	name, label string
+	field       string // the field with the value
+	choice      string // the choice of the column, for multiple choice fields
+}
+
+func (e *exporter) addColumns(sheet *exportSheet, nodes []Node, repeat *Node) {
+	for i := range nodes {
+		n := &nodes[i]
+		switch n.Type {
+		case NtRepeatingSlide:
+			rep := &exportSheet{name: n.Name, repeat: n}
+			e.sheets = append(e.sheets, rep)
+			e.addColumns(rep, n.Nodes, n)
+			continue
+		case NtSlide, NtGroup:
+			e.addColumns(sheet, n.Nodes, repeat)
+			continue
+		}
+		ft := FtString
+		if n.FieldType != nil {
+			ft = *n.FieldType
+		}
+		switch ft {
+		case FtNote:
+		case FtTable:
+			table := &exportSheet{name: n.Name, repeat: repeat}
+			e.sheets = append(e.sheets, table)
+			for i, row := range n.Rows {
+				for j := range row {
+					cell := cellName(n.Name, i, j)
+					table.cols = append(table.cols, exportColumn{cell, n.RowLabels[i] + ", " + n.ColumnLabels[j], cell, ""})
+				}
+			}
+		case FtMultipleChoice:
+			for _, o := range e.ajf.ChoicesOrigins {
+				if o.Name != n.ChoicesOriginRef {
+					continue
+				}
+				for _, c := range o.Choices {
+					sheet.cols = append(sheet.cols,
+						exportColumn{n.Name + "/" + c["value"], n.Label + ": " + c["label"], n.Name, c["value"]})
+				}
+			}
+		default:
+			sheet.cols = append(sheet.cols, exportColumn{n.Name, n.Label, n.Name, ""})
+		}
+	}
+}
+
+func (s *exportSheet) export(subs []Submission, labels bool) Sheet {
+	var head []interface{}
+	head = append(head, "submission")
+	if s.repeat != nil {
+		head = append(head, "repetition")
+	}
+	for _, c := range s.cols {
+		if labels && c.label != "" {
+			head = append(head, c.label)
+		} else {
+			head = append(head, c.name)
+		}
+	}
+	sheet := Sheet{Name: s.name, Rows: [][]interface{}{head}}
+	for i, sub := range subs {
+		if s.repeat == nil {
+			row := []interface{}{float64(i + 1)}
+			sheet.Rows = append(sheet.Rows, s.appendValues(row, sub, ""))
+			continue
+		}
+		for r := 0; r < Reps(s.repeat, sub[s.repeat.Name]); r++ {
+			row := []interface{}{float64(i + 1), float64(r + 1)}
+			sheet.Rows = append(sheet.Rows, s.appendValues(row, sub, repSuffix(r)))
+		}
+	}
+	return sheet
+}
+
+func (s *exportSheet) appendValues(row []interface{}, sub Submission, suffix string) []interface{} {
+	for _, c := range s.cols {
+		v := normalizeValue(sub[c.field+suffix])
+		if c.choice != "" {
+			row = append(row, choiceSelected(v, c.choice))
+			continue
+		}
+		switch v.(type) {
+		case nil, string, float64, bool:
+			row = append(row, v)
+		default:
+			row = append(row, csvValue(v))
+		}
+	}
+	return row
+}
+
+// choiceSelected returns 1 if the answer of a multiple choice field
+// includes choice, 0 if it doesn't and nil if there's no answer.
+func choiceSelected(answer interface{}, choice string) interface{} {
+	var selected []string
+	switch a := answer.(type) {
+	case nil:
+		return nil
+	case string:
+		selected = strings.Fields(a)
+	case []interface{}:
+		for _, e := range a {
+			selected = append(selected, toString(e))
+		}
+	default:
+		selected = []string{toString(a)}
+	}
+	if contains(selected, choice) {
+		return 1.0
+	}
+	return 0.0
+}
+
+// EncSheetCsv writes a sheet in csv.
+func EncSheetCsv(w io.Writer, sheet Sheet) error {
+	cw := csv.NewWriter(w)
+	for _, row := range sheet.Rows {
+		record := make([]string, len(row))
+		for i, v := range row {
+			record[i] = csvValue(v)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func csvValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		s := make([]string, len(v))
+		for i, e := range v {
+			s[i] = toString(e)
+		}
+		return strings.Join(s, " ")
+	}
+	return toString(v)
+}
@@ -0,0 +1,318 @@
+package formats
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// A Submission holds the values of a filled in form, as stored by ajf:
+// fields are named as in Simulate, and repeating slides have
+// their number of repetitions.
+type Submission map[string]interface{}
+
+// FakeSubmissions generates n random submissions of a form, as valid
+// as random answers can make them: values depend on the type of fields
+// and their choices and ranges, hidden fields are left empty, calculations
+// are computed and answers that don't satisfy the constraints are retried.
+// Optional fields are left empty once every few submissions.
+func FakeSubmissions(ajf *AjfForm, n int, rnd *rand.Rand) ([]Submission, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("Invalid number of submissions %d.", n)
+	}
+	referenced := make(map[string]bool)
+	for _, f := range formulas(ajf.Slides) {
+		if e, err := ParseExpr(f); err == nil {
+			addIdentifiers(referenced, e.root)
+		}
+	}
+	subs := make([]Submission, n)
+	for i := range subs {
+		g := faker{ajf: ajf, rnd: rnd, answers: make(map[string]interface{}), referenced: referenced}
+		subs[i] = g.submission()
+	}
+	return subs, nil
+}
+
+type faker struct {
+	ajf     *AjfForm
+	rnd     *rand.Rand
+	answers map[string]interface{}
+	sim     *Simulation
+	// referenced are the names used by formulas: only the answers
+	// to these fields (or with constraints) require updating the simulation.
+	referenced map[string]bool
+}
+
+// addIdentifiers adds to names the identifiers used by an expression,
+// excluding the properties of objects.
+func addIdentifiers(names map[string]bool, n exprNode) {
+	switch n := n.(type) {
+	case *identNode:
+		names[n.name] = true
+	case *arrayNode:
+		for _, e := range n.elems {
+			addIdentifiers(names, e)
+		}
+	case *unaryNode:
+		addIdentifiers(names, n.x)
+	case *binaryNode:
+		addIdentifiers(names, n.x)
+		addIdentifiers(names, n.y)
+	case *condNode:
+		addIdentifiers(names, n.cond)
+		addIdentifiers(names, n.then)
+		addIdentifiers(names, n.els)
+	case *memberNode:
+		addIdentifiers(names, n.x)
+		if _, ok := n.prop.(*litNode); !ok {
+			addIdentifiers(names, n.prop)
+		}
+	case *callNode:
+		addIdentifiers(names, n.fn)
+		for _, a := range n.args {
+			addIdentifiers(names, a)
+		}
+	}
+}
+
+// formulas lists all the formulas of nodes.
+func formulas(nodes []Node) []string {
+	var list []string
+	for _, n := range nodes {
+		if n.Visibility != nil {
+			list = append(list, n.Visibility.Condition)
+		}
+		for _, f := range []*Formula{n.Formula, n.DefaultVal, n.ChoicesFilter} {
+			if f != nil {
+				list = append(list, f.Formula)
+			}
+		}
+		if n.Validation != nil {
+			for _, c := range n.Validation.Conditions {
+				list = append(list, c.Condition)
+			}
+		}
+		for _, row := range n.Rows {
+			for _, cell := range row {
+				if f, ok := cell.(Formula); ok {
+					list = append(list, f.Formula)
+				}
+			}
+		}
+		list = append(list, formulas(n.Nodes)...)
+	}
+	return list
+}
+
+// maxTries is how many random answers are tried for a field with a constraint.
+const maxTries = 20
+
+func (g *faker) submission() Submission {
+	g.update()
+	for i := range g.ajf.Slides {
+		slide := &g.ajf.Slides[i]
+		if !g.sim.Visible[slide.Name] {
+			continue
+		}
+		if slide.Type != NtRepeatingSlide {
+			g.nodes(slide.Nodes, "")
+			g.update()
+			continue
+		}
+		max := 3
+		if slide.MaxReps != nil && *slide.MaxReps > 0 {
+			max = *slide.MaxReps
+		}
+		g.answers[slide.Name] = float64(g.rnd.Intn(max + 1))
+		g.update()
+		for r := 0; r < Reps(slide, g.answers[slide.Name]); r++ {
+			g.nodes(slide.Nodes, repSuffix(r))
+		}
+		g.update()
+	}
+
+	sub := make(Submission, len(g.sim.Values))
+	for name, v := range g.sim.Values {
+		sub[name] = v
+	}
+	for _, slide := range g.ajf.Slides {
+		if slide.Type == NtRepeatingSlide && g.sim.Visible[slide.Name] {
+			sub[slide.Name] = float64(Reps(&slide, g.answers[slide.Name]))
+		}
+	}
+	return sub
+}
+
+func (g *faker) update() { g.sim = Simulate(g.ajf, g.answers) }
+
+func (g *faker) nodes(nodes []Node, suffix string) {
+	for i := range nodes {
+		n := &nodes[i]
+		if !g.sim.Visible[n.Name+suffix] {
+			continue
+		}
+		if n.Type == NtGroup {
+			g.nodes(n.Nodes, suffix)
+			continue
+		}
+		if n.FieldType != nil && *n.FieldType == FtTable {
+			g.table(n, suffix)
+			continue
+		}
+		g.field(n, n.Name+suffix)
+	}
+}
+
+func (g *faker) field(n *Node, name string) {
+	required := n.Validation != nil && n.Validation.NotEmpty
+	if !required && g.rnd.Intn(10) == 0 {
+		return // optional fields are sometimes skipped
+	}
+	if n.DefaultVal != nil && g.rnd.Intn(2) == 0 {
+		return // and defaults sometimes kept
+	}
+	constrained := n.Validation != nil && len(n.Validation.Conditions) > 0
+	for try := 0; try < maxTries; try++ {
+		v := g.value(n, try)
+		if v == nil {
+			return
+		}
+		g.answers[name] = v
+		if !constrained && !g.referenced[n.Name] && !g.referenced[name] {
+			return
+		}
+		g.update()
+		if !g.fails(name) {
+			return
+		}
+	}
+	if !required {
+		delete(g.answers, name)
+		g.update()
+	}
+}
+
+// fails tells whether the constraints of a field fail.
+func (g *faker) fails(name string) bool {
+	for _, f := range g.sim.Failures {
+		if f.Field == name && f.Condition != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *faker) table(n *Node, suffix string) {
+	for i, row := range n.Rows {
+		for j, cell := range row {
+			if _, ok := cell.(Formula); ok {
+				continue
+			}
+			var typ string
+			if j < len(n.ColumnTypes) {
+				typ = n.ColumnTypes[j]
+			}
+			var v interface{}
+			switch typ {
+			case "number":
+				v = float64(g.rnd.Intn(101))
+			case "date":
+				v = g.date()
+			default:
+				v = g.words(1, 2)
+			}
+			g.answers[cellName(n.Name, i, j)+suffix] = v
+		}
+	}
+	g.update()
+}
+
+// value returns a random answer for a field, nil for fields that aren't answered;
+// numbers get larger with the number of tries.
+func (g *faker) value(n *Node, try int) interface{} {
+	ft := FtString
+	if n.FieldType != nil {
+		ft = *n.FieldType
+	}
+	switch ft {
+	case FtString:
+		return g.words(1, 3)
+	case FtText:
+		return g.sentence()
+	case FtNumber:
+		max := 100 * math.Pow(10, float64(try/4))
+		if isIntegerField(n) {
+			return math.Floor(g.rnd.Float64() * (max + 1))
+		}
+		return math.Round(g.rnd.Float64()*max*100) / 100
+	case FtBoolean:
+		return g.rnd.Intn(2) == 0
+	case FtSingleChoice, FtMultipleChoice:
+		choices := g.sim.FilterChoices(g.ajf, n)
+		if len(choices) == 0 {
+			return nil
+		}
+		if ft == FtSingleChoice {
+			return choices[g.rnd.Intn(len(choices))]["value"]
+		}
+		var values []interface{}
+		for _, i := range g.rnd.Perm(len(choices))[:1+g.rnd.Intn(len(choices))] {
+			values = append(values, choices[i]["value"])
+		}
+		return values
+	case FtDate:
+		return g.date()
+	case FtTime:
+		return fmt.Sprintf("%02d:%02d", g.rnd.Intn(24), g.rnd.Intn(60))
+	case FtRange:
+		start, end, step := 0, 10, 1
+		if n.RangeStart != nil && n.RangeEnd != nil && n.RangeStep != nil {
+			start, end, step = *n.RangeStart, *n.RangeEnd, *n.RangeStep
+		}
+		if step <= 0 || end < start {
+			return float64(start)
+		}
+		return float64(start + step*g.rnd.Intn((end-start)/step+1))
+	case FtGeolocation:
+		return fmt.Sprintf("%.6f %.6f 0 0", g.rnd.Float64()*180-90, g.rnd.Float64()*360-180)
+	case FtBarcode:
+		return fmt.Sprintf("%013d", g.rnd.Int63n(1e13))
+	case FtFile:
+		return fmt.Sprintf("%s_%d.pdf", n.Name, g.rnd.Intn(1000))
+	case FtImage, FtSignature:
+		return fmt.Sprintf("%s_%d.png", n.Name, g.rnd.Intn(1000))
+	case FtAudio:
+		return fmt.Sprintf("%s_%d.mp3", n.Name, g.rnd.Intn(1000))
+	case FtVideoUrl:
+		return fmt.Sprintf("https://example.com/videos/%d", g.rnd.Intn(1000))
+	}
+	return nil // notes and formulas
+}
+
+// fakeDateBase is the end of the interval of fake dates.
+var fakeDateBase = time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC)
+
+func (g *faker) date() string {
+	return fakeDateBase.AddDate(0, 0, -g.rnd.Intn(3*365)).Format("2006-01-02")
+}
+
+var fakeWords = strings.Fields(`lorem ipsum dolor sit amet consectetur adipiscing elit sed do
+	eiusmod tempor incididunt ut labore et dolore magna aliqua enim ad minim veniam quis nostrud
+	exercitation ullamco laboris nisi aliquip ex ea commodo consequat`)
+
+func (g *faker) words(min, max int) string {
+	n := min + g.rnd.Intn(max-min+1)
+	w := make([]string, n)
+	for i := range w {
+		w[i] = fakeWords[g.rnd.Intn(len(fakeWords))]
+	}
+	return strings.Join(w, " ")
+}
+
+func (g *faker) sentence() string {
+	s := g.words(5, 15)
+	return strings.ToUpper(s[:1]) + s[1:] + "."
+}
@@ -0,0 +1,636 @@
+package formats
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strings"
+)
+
+// FHIR R4 Questionnaire resources, with the extensions of the
+// Structured Data Capture implementation guide (SDC).
+// Specification: https://hl7.org/fhir/R4/questionnaire.html
+
+type fhirQuestionnaire struct {
+	ResourceType string      `json:"resourceType"`
+	Id           string      `json:"id,omitempty"`
+	Name         string      `json:"name,omitempty"`
+	Title        string      `json:"title,omitempty"`
+	Status       string      `json:"status"`
+	Item         []*fhirItem `json:"item,omitempty"`
+}
+
+type fhirItem struct {
+	Extension      []fhirExtension    `json:"extension,omitempty"`
+	LinkId         string             `json:"linkId"`
+	Text           string             `json:"text,omitempty"`
+	TextExt        *fhirElement       `json:"_text,omitempty"`
+	Type           string             `json:"type"`
+	EnableWhen     []fhirEnableWhen   `json:"enableWhen,omitempty"`
+	EnableBehavior string             `json:"enableBehavior,omitempty"`
+	Required       bool               `json:"required,omitempty"`
+	Repeats        bool               `json:"repeats,omitempty"`
+	ReadOnly       bool               `json:"readOnly,omitempty"`
+	AnswerOption   []fhirAnswerOption `json:"answerOption,omitempty"`
+	Item           []*fhirItem        `json:"item,omitempty"`
+}
+
+// fhirElement holds the extensions of a primitive element, like _text.
+type fhirElement struct {
+	Extension []fhirExtension `json:"extension"`
+}
+
+type fhirExtension struct {
+	URL                  string               `json:"url"`
+	Extension            []fhirExtension      `json:"extension,omitempty"`
+	ValueInteger         *int                 `json:"valueInteger,omitempty"`
+	ValueString          string               `json:"valueString,omitempty"`
+	ValueCode            string               `json:"valueCode,omitempty"`
+	ValueExpression      *fhirExpression      `json:"valueExpression,omitempty"`
+	ValueCodeableConcept *fhirCodeableConcept `json:"valueCodeableConcept,omitempty"`
+}
+
+type fhirExpression struct {
+	Description string `json:"description,omitempty"`
+	Language    string `json:"language"`
+	Expression  string `json:"expression"`
+}
+
+type fhirCodeableConcept struct {
+	Coding []fhirCoding `json:"coding"`
+}
+
+type fhirCoding struct {
+	System     string       `json:"system,omitempty"`
+	Code       string       `json:"code"`
+	Display    string       `json:"display,omitempty"`
+	DisplayExt *fhirElement `json:"_display,omitempty"`
+}
+
+type fhirAnswerOption struct {
+	ValueCoding fhirCoding `json:"valueCoding"`
+}
+
+type fhirEnableWhen struct {
+	Question      string      `json:"question"`
+	Operator      string      `json:"operator"`
+	AnswerBoolean *bool       `json:"answerBoolean,omitempty"`
+	AnswerDecimal *float64    `json:"answerDecimal,omitempty"`
+	AnswerInteger *int        `json:"answerInteger,omitempty"`
+	AnswerDate    string      `json:"answerDate,omitempty"`
+	AnswerTime    string      `json:"answerTime,omitempty"`
+	AnswerString  *string     `json:"answerString,omitempty"`
+	AnswerCoding  *fhirCoding `json:"answerCoding,omitempty"`
+}
+
+const (
+	fhirExt = "http://hl7.org/fhir/StructureDefinition/"
+	sdcExt  = "http://hl7.org/fhir/uv/sdc/StructureDefinition/sdc-questionnaire-"
+
+	fhirItemControl = "http://hl7.org/fhir/questionnaire-item-control"
+)
+
+// EncFhirQuestionnaire writes the form as a FHIR R4 Questionnaire
+// resource in json, with the given title and id.
+//
+// Slides and groups are items of type group (repeating for repeats),
+// tables are groups of rows; fields have the matching item type,
+// choices are listed in answerOption and translations are added
+// with the translation extension.
+// Relevance is written as enableWhen if it's made of simple comparisons
+// of fields with values, otherwise as an SDC enableWhenExpression
+// in FHIRPath; calculations and default values are SDC expressions too.
+// Formulas that can't be written in FHIRPath are kept in javascript.
+func EncFhirQuestionnaire(w io.Writer, ajf *AjfForm, title, id string) error {
+	e := fhirEncoder{ajf: ajf, fields: make(map[string]*Node), cells: make(map[string]bool), langs: sortedLangs(translationLangs(ajf))}
+	e.indexFields(ajf.Slides)
+	q := fhirQuestionnaire{
+		ResourceType: "Questionnaire",
+		Id:           fhirId(id),
+		Name:         exportedName(id),
+		Title:        title,
+		Status:       "draft",
+	}
+	for i := range ajf.Slides {
+		q.Item = append(q.Item, e.item(&ajf.Slides[i]))
+	}
+	return EncIndentedJson(w, q)
+}
+
+var nonFhirIdChars = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+func fhirId(id string) string {
+	id = nonFhirIdChars.ReplaceAllString(id, "-")
+	if len(id) > 64 {
+		id = id[:64]
+	}
+	return id
+}
+
+type fhirEncoder struct {
+	ajf    *AjfForm
+	fields map[string]*Node
+	cells  map[string]bool // the names of table cells
+	langs  []string
+}
+
+func (e *fhirEncoder) indexFields(nodes []Node) {
+	for i := range nodes {
+		n := &nodes[i]
+		if n.Type == NtField {
+			e.fields[n.Name] = n
+		}
+		for i, row := range n.Rows {
+			for j := range row {
+				e.cells[cellName(n.Name, i, j)] = true
+			}
+		}
+		e.indexFields(n.Nodes)
+	}
+}
+
+func (e *fhirEncoder) item(n *Node) *fhirItem {
+	item := &fhirItem{LinkId: n.Name, Text: n.Label}
+	item.TextExt = e.translations(n.Label)
+	if n.Visibility != nil {
+		e.setEnableWhen(item, n.Visibility.Condition)
+	}
+	switch n.Type {
+	case NtSlide, NtGroup, NtRepeatingSlide:
+		item.Type = "group"
+		if n.Type == NtRepeatingSlide {
+			item.Repeats = true
+			if n.MaxReps != nil && *n.MaxReps > 0 {
+				item.Extension = append(item.Extension, fhirExtension{URL: fhirExt + "questionnaire-maxOccurs", ValueInteger: n.MaxReps})
+			}
+		}
+		for i := range n.Nodes {
+			item.Item = append(item.Item, e.item(&n.Nodes[i]))
+		}
+		return item
+	}
+
+	ft := FtString
+	if n.FieldType != nil {
+		ft = *n.FieldType
+	}
+	item.Type = fhirItemType(n, ft)
+	item.Required = n.Validation != nil && n.Validation.NotEmpty
+	item.ReadOnly = n.Editable != nil && !*n.Editable
+	switch ft {
+	case FtNote:
+		item.Text = n.HTML
+		item.TextExt = e.translations(n.HTML)
+	case FtSingleChoice, FtMultipleChoice:
+		item.Repeats = ft == FtMultipleChoice
+		for _, o := range e.ajf.ChoicesOrigins {
+			if o.Name != n.ChoicesOriginRef {
+				continue
+			}
+			for _, c := range o.Choices {
+				item.AnswerOption = append(item.AnswerOption, fhirAnswerOption{fhirCoding{
+					Code: c["value"], Display: c["label"], DisplayExt: e.translations(c["label"]),
+				}})
+			}
+		}
+	case FtRange:
+		if n.RangeStart != nil && n.RangeEnd != nil && n.RangeStep != nil {
+			item.Extension = append(item.Extension,
+				fhirExtension{URL: fhirExt + "minValue", ValueInteger: n.RangeStart},
+				fhirExtension{URL: fhirExt + "maxValue", ValueInteger: n.RangeEnd},
+				fhirExtension{URL: fhirExt + "questionnaire-sliderStepValue", ValueInteger: n.RangeStep})
+		}
+		item.Extension = append(item.Extension, itemControl("slider"))
+	case FtFormula:
+		item.ReadOnly = true
+		if n.Formula != nil {
+			item.Extension = append(item.Extension, e.expressionExt("calculatedExpression", n.Formula.Formula))
+		}
+	case FtTable:
+		for i, row := range n.Rows {
+			rowItem := &fhirItem{LinkId: fmt.Sprintf("%s__%d", n.Name, i), Text: n.RowLabels[i], Type: "group"}
+			rowItem.TextExt = e.translations(n.RowLabels[i])
+			for j, cell := range row {
+				cellItem := &fhirItem{LinkId: cellName(n.Name, i, j), Text: n.ColumnLabels[j], Type: "string"}
+				cellItem.TextExt = e.translations(n.ColumnLabels[j])
+				switch n.ColumnTypes[j] {
+				case "number":
+					cellItem.Type = "decimal"
+				case "date":
+					cellItem.Type = "date"
+				}
+				if f, ok := cell.(Formula); ok {
+					cellItem.ReadOnly = true
+					cellItem.Extension = append(cellItem.Extension, e.expressionExt("calculatedExpression", f.Formula))
+				}
+				rowItem.Item = append(rowItem.Item, cellItem)
+			}
+			item.Item = append(item.Item, rowItem)
+		}
+	}
+	if n.DefaultVal != nil {
+		item.Extension = append(item.Extension, e.expressionExt("initialExpression", n.DefaultVal.Formula))
+	}
+	if n.Hint != "" {
+		help := &fhirItem{LinkId: n.Name + "__hint", Text: n.Hint, Type: "display",
+			Extension: []fhirExtension{itemControl("help")}}
+		help.TextExt = e.translations(n.Hint)
+		item.Item = append(item.Item, help)
+	}
+	return item
+}
+
+func fhirItemType(n *Node, ft FieldType) string {
+	switch ft {
+	case FtText:
+		return "text"
+	case FtNumber:
+		if isIntegerField(n) {
+			return "integer"
+		}
+		return "decimal"
+	case FtRange:
+		return "integer"
+	case FtBoolean:
+		return "boolean"
+	case FtSingleChoice, FtMultipleChoice:
+		return "choice"
+	case FtFormula:
+		if n.Formula != nil {
+			return formulaItemType(n.Formula.Formula)
+		}
+	case FtNote:
+		return "display"
+	case FtDate:
+		return "date"
+	case FtTime:
+		return "time"
+	case FtTable:
+		return "group"
+	case FtFile, FtImage, FtSignature, FtAudio:
+		return "attachment"
+	case FtVideoUrl:
+		return "url"
+	}
+	return "string"
+}
+
+// formulaItemType guesses the type of the result of a calculation.
+func formulaItemType(js string) string {
+	e, err := ParseExpr(js)
+	if err != nil {
+		return "string"
+	}
+	switch n := e.root.(type) {
+	case *litNode:
+		switch n.v.(type) {
+		case float64:
+			return "decimal"
+		case bool:
+			return "boolean"
+		}
+	case *unaryNode:
+		if n.op == "!" {
+			return "boolean"
+		}
+		return "decimal"
+	case *binaryNode:
+		switch binaryPrec(n.op) {
+		case precOr, precAnd, precEq, precRel:
+			return "boolean"
+		case precMul:
+			return "decimal"
+		}
+		if n.op == "-" {
+			return "decimal"
+		}
+	}
+	return "string"
+}
+
+func itemControl(code string) fhirExtension {
+	return fhirExtension{URL: fhirExt + "questionnaire-itemControl",
+		ValueCodeableConcept: &fhirCodeableConcept{[]fhirCoding{{System: fhirItemControl, Code: code}}}}
+}
+
+// translations returns the translations of text, as an element
+// with the translation extension, nil if it has no translations.
+func (e *fhirEncoder) translations(text string) *fhirElement {
+	var el fhirElement
+	for _, lang := range e.langs {
+		tr := e.ajf.Translations[lang][text]
+		if text == "" || tr == "" {
+			continue
+		}
+		el.Extension = append(el.Extension, fhirExtension{URL: fhirExt + "translation", Extension: []fhirExtension{
+			{URL: "lang", ValueCode: fhirLang(lang)},
+			{URL: "content", ValueString: tr},
+		}})
+	}
+	if el.Extension == nil {
+		return nil
+	}
+	return &el
+}
+
+var langCode = regexp.MustCompile(`\(([A-Za-z]{2,3}(-[A-Za-z0-9]+)*)\)\s*$`)
+
+// fhirLang returns the code of a language, like en for "English (en)".
+func fhirLang(lang string) string {
+	if m := langCode.FindStringSubmatch(lang); m != nil {
+		return m[1]
+	}
+	return lang
+}
+
+// expressionExt returns an SDC expression extension of a formula,
+// in FHIRPath if it can be translated, otherwise in javascript.
+func (e *fhirEncoder) expressionExt(name, js string) fhirExtension {
+	expr := &fhirExpression{Language: "text/javascript", Expression: js}
+	if parsed, err := ParseExpr(js); err == nil {
+		root := withoutPermissions(parsed.root)
+		if root == nil {
+			root = &litNode{true}
+		}
+		if path, ok := e.fhirPath(root); ok {
+			expr = &fhirExpression{Language: "text/fhirpath", Expression: path}
+		}
+	}
+	return fhirExtension{URL: sdcExt + name, ValueExpression: expr}
+}
+
+// withoutPermissions removes the checks of permissions from a condition,
+// as they are made by the ajf app; it returns nil if nothing is left.
+func withoutPermissions(n exprNode) exprNode {
+	b, ok := n.(*binaryNode)
+	if !ok {
+		return n
+	}
+	switch b.op {
+	case "||":
+		if id, ok := b.y.(*identNode); ok && id.name == "dino_permissions_end" {
+			return nil
+		}
+	case "&&":
+		x, y := withoutPermissions(b.x), withoutPermissions(b.y)
+		switch {
+		case x == nil:
+			return y
+		case y == nil:
+			return x
+		case x != b.x || y != b.y:
+			return &binaryNode{op: "&&", x: x, y: y}
+		}
+	}
+	return n
+}
+
+func (e *fhirEncoder) setEnableWhen(item *fhirItem, condition string) {
+	parsed, err := ParseExpr(condition)
+	if err == nil {
+		root := withoutPermissions(parsed.root)
+		if root == nil {
+			return
+		}
+		op := ""
+		if b, ok := root.(*binaryNode); ok && (b.op == "&&" || b.op == "||") {
+			op = b.op
+		}
+		var conds []fhirEnableWhen
+		ok := true
+		for _, operand := range flattenBinary(root, op) {
+			c, simple := e.simpleCondition(operand)
+			conds = append(conds, c)
+			ok = ok && simple
+		}
+		if ok {
+			item.EnableWhen = conds
+			if len(conds) > 1 {
+				item.EnableBehavior = map[string]string{"&&": "all", "||": "any"}[op]
+			}
+			return
+		}
+	}
+	item.Extension = append(item.Extension, e.expressionExt("enableWhenExpression", condition))
+}
+
+// flattenBinary lists the operands of a chain of binary operations op.
+func flattenBinary(n exprNode, op string) []exprNode {
+	if b, ok := n.(*binaryNode); ok && b.op == op {
+		return append(flattenBinary(b.x, op), flattenBinary(b.y, op)...)
+	}
+	return []exprNode{n}
+}
+
+var fhirOperators = map[string]string{
+	"===": "=", "==": "=", "!==": "!=", "!=": "!=", "<": "<", "<=": "<=", ">": ">", ">=": ">=",
+}
+
+var flippedOperators = map[string]string{"<": ">", "<=": ">=", ">": "<", ">=": "<="}
+
+// simpleCondition converts a condition to an enableWhen,
+// if it compares a field with a value.
+func (e *fhirEncoder) simpleCondition(n exprNode) (fhirEnableWhen, bool) {
+	negate := false
+	if u, ok := n.(*unaryNode); ok && u.op == "!" {
+		negate, n = true, u.x
+	}
+	switch n := n.(type) {
+	case *identNode:
+		// A boolean field.
+		f := e.fields[n.name]
+		if f == nil || f.FieldType == nil || *f.FieldType != FtBoolean {
+			return fhirEnableWhen{}, false
+		}
+		answer := !negate
+		return fhirEnableWhen{Question: n.name, Operator: "=", AnswerBoolean: &answer}, true
+	case *callNode:
+		id, ok := n.fn.(*identNode)
+		if !ok || len(n.args) == 0 {
+			return fhirEnableWhen{}, false
+		}
+		field, ok := n.args[0].(*identNode)
+		if !ok || e.fields[field.name] == nil {
+			return fhirEnableWhen{}, false
+		}
+		switch {
+		case id.name == "notEmpty" && len(n.args) == 1:
+			exists := !negate
+			return fhirEnableWhen{Question: field.name, Operator: "exists", AnswerBoolean: &exists}, true
+		case id.name == "valueInChoice" && len(n.args) == 2 && !negate:
+			if lit, ok := n.args[1].(*litNode); ok {
+				if code, ok := lit.v.(string); ok {
+					return fhirEnableWhen{Question: field.name, Operator: "=", AnswerCoding: &fhirCoding{Code: code}}, true
+				}
+			}
+		}
+	case *binaryNode:
+		op, ok := fhirOperators[n.op]
+		if !ok || negate {
+			break
+		}
+		field, ok := n.x.(*identNode)
+		lit, isLit := n.y.(*litNode)
+		if !ok || !isLit {
+			// Maybe value op field.
+			field, ok = n.y.(*identNode)
+			lit, isLit = n.x.(*litNode)
+			if !ok || !isLit {
+				break
+			}
+			if flipped, ok := flippedOperators[op]; ok {
+				op = flipped
+			}
+		}
+		f := e.fields[field.name]
+		if f == nil {
+			break
+		}
+		if lit.v == "" && (op == "=" || op == "!=") {
+			exists := op == "!="
+			return fhirEnableWhen{Question: field.name, Operator: "exists", AnswerBoolean: &exists}, true
+		}
+		cond := fhirEnableWhen{Question: field.name, Operator: op}
+		if e.setAnswer(&cond, f, lit.v) {
+			return cond, true
+		}
+	}
+	return fhirEnableWhen{}, false
+}
+
+// setAnswer sets the answer of an enableWhen, typed like the field.
+func (e *fhirEncoder) setAnswer(cond *fhirEnableWhen, f *Node, v interface{}) bool {
+	ft := FtString
+	if f.FieldType != nil {
+		ft = *f.FieldType
+	}
+	switch v := v.(type) {
+	case bool:
+		if ft == FtBoolean {
+			cond.AnswerBoolean = &v
+			return true
+		}
+	case float64:
+		switch {
+		case (ft == FtRange || ft == FtNumber && isIntegerField(f)) && v == math.Trunc(v):
+			i := int(v)
+			cond.AnswerInteger = &i
+			return true
+		case ft == FtNumber:
+			cond.AnswerDecimal = &v
+			return true
+		}
+	case string:
+		switch ft {
+		case FtSingleChoice:
+			if cond.Operator == "=" || cond.Operator == "!=" {
+				cond.AnswerCoding = &fhirCoding{Code: v}
+				return true
+			}
+		case FtDate:
+			cond.AnswerDate = v
+			return true
+		case FtTime:
+			cond.AnswerTime = v
+			return true
+		case FtString, FtText, FtBarcode:
+			cond.AnswerString = &v
+			return true
+		}
+	}
+	return false
+}
+
+var fhirPathOps = map[string]string{
+	"&&": "and", "||": "or", "===": "=", "==": "=", "!==": "!=", "!=": "!=",
+	"<": "<", "<=": "<=", ">": ">", ">=": ">=", "+": "+", "-": "-", "*": "*", "/": "/", "%": "mod",
+}
+
+// fhirPath translates a formula to FHIRPath, if possible;
+// fields are the answers in the QuestionnaireResponse (%resource).
+func (e *fhirEncoder) fhirPath(n exprNode) (string, bool) {
+	switch n := n.(type) {
+	case *litNode:
+		switch v := n.v.(type) {
+		case string:
+			return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(v) + "'", true
+		case float64:
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return "", false
+			}
+			return numberToString(v), true
+		case bool:
+			return fmt.Sprint(v), true
+		case nil:
+			return "{}", true
+		}
+	case *identNode:
+		f := e.fields[n.name]
+		if f == nil && !e.cells[n.name] {
+			return "", false
+		}
+		path := fmt.Sprintf("%%resource.repeat(item).where(linkId='%s').answer.value", n.name)
+		if f != nil && f.FieldType != nil && (*f.FieldType == FtSingleChoice || *f.FieldType == FtMultipleChoice) {
+			path += ".code"
+		}
+		return path, true
+	case *unaryNode:
+		x, ok := e.fhirPath(n.x)
+		switch {
+		case !ok:
+		case n.op == "!":
+			return "(" + x + ").not()", true
+		case n.op == "-":
+			return "-(" + x + ")", true
+		}
+	case *binaryNode:
+		x, okX := e.fhirPath(n.x)
+		y, okY := e.fhirPath(n.y)
+		if op, ok := fhirPathOps[n.op]; ok && okX && okY {
+			return "(" + x + " " + op + " " + y + ")", true
+		}
+	case *condNode:
+		c, okC := e.fhirPath(n.cond)
+		x, okX := e.fhirPath(n.then)
+		y, okY := e.fhirPath(n.els)
+		if okC && okX && okY {
+			return "iif(" + c + ", " + x + ", " + y + ")", true
+		}
+	case *memberNode:
+		lit, ok := n.prop.(*litNode)
+		if !ok || lit.v != "length" {
+			break
+		}
+		x, ok := e.fhirPath(n.x)
+		if !ok {
+			break
+		}
+		if id, isIdent := n.x.(*identNode); isIdent {
+			if f := e.fields[id.name]; f != nil && f.FieldType != nil && *f.FieldType == FtMultipleChoice {
+				return x + ".count()", true
+			}
+		}
+		return x + ".length()", true
+	case *callNode:
+		id, ok := n.fn.(*identNode)
+		if !ok {
+			break
+		}
+		var args []string
+		for _, a := range n.args {
+			s, ok := e.fhirPath(a)
+			if !ok {
+				return "", false
+			}
+			args = append(args, s)
+		}
+		switch {
+		case id.name == "notEmpty" && len(args) == 1:
+			return args[0] + ".exists()", true
+		case id.name == "valueInChoice" && len(args) == 2:
+			return "(" + args[0] + " contains " + args[1] + ")", true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,111 @@
+package formats
+
+import (
+	"sort"
+	"strings"
+)
+
+// Lint checks the form for problems that don't prevent its conversion,
+// but are likely to be mistakes or to confuse the users of the form.
+// Lint doesn't report the errors detected by Convert.
+func Lint(xls *XlsForm) []Diagnostic {
+	var warns []Diagnostic
+	warn := func(row Row, rule, column, format string, a ...interface{}) {
+		warns = append(warns, *row.diag(SevWarning, rule, column, format, a...))
+	}
+	langs := sortedLangs(xls.LangSet)
+
+	usedLists := make(map[string]bool)
+	for _, row := range xls.Survey {
+		switch {
+		case row.Type == endGroup || row.Type == endRepeat || isIgnoredField(row.Type):
+			continue
+		case isSelectOne(row.Type) || isSelectMultiple(row.Type):
+			usedLists[choiceName(row.Type)] = true
+		}
+		if row.Label("") == "" && row.Type != "calculate" {
+			warn(row.Row, "missing-label", "label", "%q has no label.", row.Name())
+		}
+		lintText(row.Row, translatedCols, warn)
+		if row.Constraint() != "" && row.ConstraintMsg("") == "" {
+			warn(row.Row, "missing-constraint-message", "constraint", "Constraint of %q has no constraint_message.", row.Name())
+		}
+		if row.RequiredMessage("") != "" && row.Required() != "yes" && row.Required() != "true" {
+			warn(row.Row, "useless-required-message", "required_message", "required_message of %q is set, but the field isn't required.", row.Name())
+		}
+		for _, lang := range langs {
+			if row.Label("") != "" && row.Label(lang) == "" {
+				warn(row.Row, "missing-translation", "label", "Label of %q has no %s translation.", row.Name(), lang)
+			}
+		}
+	}
+
+	listValues := make(map[string]map[string]bool)
+	for _, row := range xls.Choices {
+		list := row.ListName()
+		if !usedLists[list] {
+			continue
+		}
+		if listValues[list] == nil {
+			listValues[list] = make(map[string]bool)
+		}
+		if listValues[list][row.Name()] {
+			warn(row.Row, "duplicate-choice", "name", "Value %q appears twice in choice list %q.", row.Name(), list)
+		}
+		listValues[list][row.Name()] = true
+		lintText(row.Row, []string{"label"}, warn)
+		for _, lang := range langs {
+			if row.Label("") != "" && row.Label(lang) == "" {
+				warn(row.Row, "missing-translation", "label", "Label of choice %q has no %s translation.", row.Name(), lang)
+			}
+		}
+	}
+	for _, row := range xls.Choices {
+		list := row.ListName()
+		if !usedLists[list] && listValues[list] == nil {
+			listValues[list] = make(map[string]bool) // warn only once
+			warn(row.Row, "unused-choices", "list name", "Choice list %q is never used.", list)
+		}
+	}
+	return warns
+}
+
+// lintText checks the text columns of a row (including their translations).
+func lintText(row Row, cols []string, warn func(Row, string, string, string, ...interface{})) {
+	var names []string
+	for name := range row.cells {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := row.cells[name]
+		if c.IsFormula {
+			warn(row, "excel-formula", name, "Column %s is computed by an excel formula, its last computed value is used.", name)
+		}
+		col := name
+		if i := strings.Index(col, "::"); i != -1 {
+			col = col[:i]
+		}
+		if text := c.String(); contains(cols, col) && strings.TrimSpace(text) != text {
+			warn(row, "surrounding-spaces", name, "Column %s has leading or trailing spaces.", name)
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedLangs(langSet map[string]bool) []string {
+	langs := make([]string, 0, len(langSet))
+	for lang := range langSet {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
@@ -0,0 +1,268 @@
+package formats
+
+import (
+	"html/template"
+	"io"
+	"sort"
+)
+
+// EncPreview writes a static html page showing the form, for reviewing
+// its layout and wording without the ajf app. Fields aren't functional:
+// formulas, relevance and constraints are shown as code.
+// If the form has translations, a selector switches the language
+// of the labels (with javascript).
+func EncPreview(w io.Writer, ajf *AjfForm, title string) error {
+	origins := make(map[string][]Choice)
+	for _, o := range ajf.ChoicesOrigins {
+		origins[o.Name] = o.Choices
+	}
+	var langs []string
+	for lang := range ajf.Translations {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	funcs := template.FuncMap{
+		"choices":   func(ref string) []Choice { return origins[ref] },
+		"kind":      fieldKind,
+		"repeating": func(n Node) bool { return n.Type == NtRepeatingSlide },
+		"cellFormula": func(cell interface{}) *Formula {
+			if f, ok := cell.(Formula); ok {
+				return &f
+			}
+			return nil
+		},
+	}
+	tmpl, err := template.New("preview").Funcs(funcs).Parse(previewTemplate)
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(w, struct {
+		Title        string
+		Form         *AjfForm
+		Langs        []string
+		Translations map[string]Translation
+	}{title, ajf, langs, ajf.Translations})
+}
+
+// fieldKind names the kind of a node, as used by the preview template.
+func fieldKind(n Node) string {
+	switch n.Type {
+	case NtGroup:
+		return "group"
+	case NtSlide, NtRepeatingSlide:
+		return "slide"
+	}
+	if n.FieldType == nil {
+		return "string"
+	}
+	switch *n.FieldType {
+	case FtText:
+		return "text"
+	case FtNumber:
+		return "number"
+	case FtBoolean:
+		return "boolean"
+	case FtSingleChoice:
+		return "single"
+	case FtMultipleChoice:
+		return "multiple"
+	case FtFormula:
+		return "formula"
+	case FtNote:
+		return "note"
+	case FtDate:
+		return "date"
+	case FtTime:
+		return "time"
+	case FtTable:
+		return "table"
+	case FtGeolocation:
+		return "geolocation"
+	case FtBarcode:
+		return "barcode"
+	case FtFile:
+		return "file"
+	case FtImage:
+		return "image"
+	case FtVideoUrl:
+		return "video"
+	case FtRange:
+		return "range"
+	case FtSignature:
+		return "signature"
+	case FtAudio:
+		return "audio"
+	}
+	return "string"
+}
+
+const previewTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 1em auto; padding: 0 1em; color: #222; }
+header { display: flex; justify-content: space-between; align-items: center; }
+section.slide { border: 1px solid #ccc; border-radius: 4px; margin: 1em 0; padding: 0 1em 1em; }
+fieldset { border: 1px solid #ddd; margin: 1em 0; }
+.field { margin: 1em 0; }
+.label, .note { white-space: pre-line; }
+.label { font-weight: bold; display: block; margin-bottom: .3em; }
+.hint { color: #666; font-size: .9em; white-space: pre-line; }
+.required { color: #c00; }
+.logic { color: #555; font-size: .8em; margin-top: .3em; }
+.logic code, .formula code { background: #f4f4f4; padding: 0 .2em; }
+.name { color: #888; font-size: .8em; font-weight: normal; }
+.signature { border: 1px dashed #aaa; height: 6em; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: .2em .4em; }
+</style>
+</head>
+<body>
+<header>
+<h1>{{.Title}}</h1>
+{{- if .Langs}}
+<label>Language <select id="lang">
+<option value="">default</option>
+{{- range .Langs}}
+<option>{{.}}</option>
+{{- end}}
+</select></label>
+{{- end}}
+</header>
+{{- range .Form.Slides}}
+{{template "node" .}}
+{{- end}}
+{{- if .Langs}}
+<script>
+const translations = {{.Translations}};
+const texts = document.querySelectorAll("[data-t]");
+document.getElementById("lang").addEventListener("change", function (e) {
+	const tr = translations[e.target.value] || {};
+	for (const el of texts) {
+		el.textContent = tr[el.dataset.t] || el.dataset.t;
+	}
+});
+</script>
+{{- end}}
+</body>
+</html>
+
+{{define "text"}}<span data-t="{{.}}">{{.}}</span>{{end}}
+
+{{define "logic"}}
+{{- if or .Visibility .ChoicesFilter .Validation}}
+<div class="logic">
+{{- with .Visibility}}
+<div>Visible if <code>{{.Condition}}</code></div>
+{{- end}}
+{{- with .ChoicesFilter}}
+<div>Choices filtered by <code>{{.Formula}}</code></div>
+{{- end}}
+{{- with .Validation}}
+{{- range .Conditions}}
+<div>Valid if <code>{{.Condition}}</code>{{with .ErrorMessage}}, otherwise: {{template "text" .}}{{end}}</div>
+{{- end}}
+{{- end}}
+</div>
+{{- end}}
+{{- end}}
+
+{{define "node"}}
+{{- $kind := kind .}}
+{{- if eq $kind "slide"}}
+<section class="slide" id="{{.Name}}">
+<h2>{{template "text" .Label}}{{if .MaxReps}} <span class="name">(repeated at most {{.MaxReps}} times)</span>{{else if repeating .}} <span class="name">(repeated)</span>{{end}}</h2>
+{{- template "logic" .}}
+{{- range .Nodes}}
+{{template "node" .}}
+{{- end}}
+</section>
+{{- else if eq $kind "group"}}
+<fieldset id="{{.Name}}">
+<legend>{{template "text" .Label}}</legend>
+{{- template "logic" .}}
+{{- range .Nodes}}
+{{template "node" .}}
+{{- end}}
+</fieldset>
+{{- else if eq $kind "note"}}
+<div class="field note" id="{{.Name}}">{{template "text" .HTML}}{{template "logic" .}}</div>
+{{- else}}
+<div class="field" id="{{.Name}}">
+<label class="label" for="f-{{.Name}}">{{template "text" .Label}}
+{{- with .Validation}}{{if .NotEmpty}} <span class="required">*</span>{{end}}{{end}}
+ <span class="name">{{.Name}}</span></label>
+{{- if .Hint}}
+<div class="hint">{{template "text" .Hint}}</div>
+{{- end}}
+{{- if eq $kind "text"}}
+<textarea id="f-{{.Name}}" rows="3"></textarea>
+{{- else if eq $kind "number"}}
+<input id="f-{{.Name}}" type="number">
+{{- else if eq $kind "boolean"}}
+<input id="f-{{.Name}}" type="checkbox">
+{{- else if eq $kind "single"}}
+{{- $name := .Name}}
+{{- if .ForceNarrow}}
+<select id="f-{{.Name}}">
+<option></option>
+{{- range choices .ChoicesOriginRef}}
+<option value="{{.value}}" data-t="{{.label}}">{{.label}}</option>
+{{- end}}
+</select>
+{{- else}}
+{{- range choices .ChoicesOriginRef}}
+<div><label><input type="radio" name="{{$name}}" value="{{.value}}"> {{template "text" .label}}</label></div>
+{{- end}}
+{{- end}}
+{{- else if eq $kind "multiple"}}
+{{- $name := .Name}}
+{{- range choices .ChoicesOriginRef}}
+<div><label><input type="checkbox" name="{{$name}}" value="{{.value}}"> {{template "text" .label}}</label></div>
+{{- end}}
+{{- else if eq $kind "formula"}}
+<div class="formula">= <code>{{.Formula.Formula}}</code></div>
+{{- else if eq $kind "date"}}
+<input id="f-{{.Name}}" type="date">
+{{- else if eq $kind "time"}}
+<input id="f-{{.Name}}" type="time">
+{{- else if eq $kind "table"}}
+{{- $types := .ColumnTypes}}
+<table id="f-{{.Name}}">
+<tr><th></th>{{range .ColumnLabels}}<th>{{template "text" .}}</th>{{end}}</tr>
+{{- range $i, $row := .Rows}}
+<tr><th>{{template "text" (index $.RowLabels $i)}}</th>
+{{- range $j, $cell := $row}}
+{{- with cellFormula $cell}}<td class="formula"><code>{{.Formula}}</code></td>
+{{- else}}<td><input type="{{index $types $j}}" name="{{$cell}}"></td>{{end}}
+{{- end}}</tr>
+{{- end}}
+</table>
+{{- else if eq $kind "geolocation"}}
+<input id="f-{{.Name}}" type="text" placeholder="latitude, longitude">
+{{- else if eq $kind "file"}}
+<input id="f-{{.Name}}" type="file">
+{{- else if eq $kind "image"}}
+<input id="f-{{.Name}}" type="file" accept="image/*">
+{{- else if eq $kind "audio"}}
+<input id="f-{{.Name}}" type="file" accept="audio/*">
+{{- else if eq $kind "video"}}
+<input id="f-{{.Name}}" type="url" placeholder="https://">
+{{- else if eq $kind "range"}}
+<input id="f-{{.Name}}" type="range" min="{{.RangeStart}}" max="{{.RangeEnd}}" step="{{.RangeStep}}">
+{{- else if eq $kind "signature"}}
+<div id="f-{{.Name}}" class="signature"></div>
+{{- else}}
+<input id="f-{{.Name}}" type="text">
+{{- end}}
+{{- with .DefaultVal}}
+<div class="logic">Default <code>{{.Formula}}</code></div>
+{{- end}}
+{{- template "logic" .}}
+</div>
+{{- end}}
+{{- end}}
+`
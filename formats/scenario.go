@@ -0,0 +1,386 @@
+package formats
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A Scenario is a test of the logic of a form: given the answers,
+// it lists the expected visibility of nodes, values of fields
+// and validation failures. Fields not mentioned aren't checked.
+// Names are as in Simulate.
+type Scenario struct {
+	Name    string                 `json:"name"`
+	Answers map[string]interface{} `json:"answers,omitempty"`
+	Visible map[string]bool        `json:"visible,omitempty"`
+	Values  map[string]interface{} `json:"values,omitempty"`
+	// Failures tells whether the validation of a field must fail (true)
+	// or succeed (false); a string is the expected error message.
+	Failures map[string]interface{} `json:"failures,omitempty"`
+}
+
+// DecScenarios decodes a list of scenarios in json or, if isYaml is true, in YAML.
+func DecScenarios(data []byte, isYaml bool) ([]Scenario, error) {
+	if isYaml {
+		var v interface{}
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		var err error
+		if data, err = json.Marshal(jsonValue(v)); err != nil {
+			return nil, err
+		}
+	}
+	var scenarios []Scenario
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&scenarios); err != nil {
+		return nil, err
+	}
+	for i, sc := range scenarios {
+		if sc.Name == "" {
+			return nil, fmt.Errorf("Scenario %d has no name.", i+1)
+		}
+		for field, f := range sc.Failures {
+			switch f.(type) {
+			case bool, string:
+			default:
+				return nil, fmt.Errorf("Scenario %s: the failure of %s must be true, false or a message.", sc.Name, field)
+			}
+		}
+	}
+	return scenarios, nil
+}
+
+// jsonValue converts the mappings decoded from YAML with keys
+// that aren't strings (like numbers) to json objects.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = jsonValue(e)
+		}
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonValue(e)
+		}
+	}
+	return v
+}
+
+// Answer kinds, deciding how the text of cells is converted to values.
+const (
+	kindText     = "text"
+	kindNumber   = "number"
+	kindBoolean  = "boolean"
+	kindMultiple = "multiple"
+	kindFormula  = "formula" // calculations, compared loosely with the text
+	kindNode     = "node"    // slides and groups
+)
+
+// answerKinds maps the names of the nodes of a form, and of table cells,
+// to the kind of their values.
+func answerKinds(nodes []Node, kinds map[string]string) map[string]string {
+	if kinds == nil {
+		kinds = make(map[string]string)
+	}
+	for _, n := range nodes {
+		switch {
+		case n.Type == NtRepeatingSlide:
+			kinds[n.Name] = kindNumber // the number of repetitions
+		case n.Type != NtField:
+			kinds[n.Name] = kindNode
+		case n.FieldType == nil:
+			kinds[n.Name] = kindText
+		default:
+			switch *n.FieldType {
+			case FtNumber, FtRange:
+				kinds[n.Name] = kindNumber
+			case FtBoolean:
+				kinds[n.Name] = kindBoolean
+			case FtMultipleChoice:
+				kinds[n.Name] = kindMultiple
+			case FtFormula:
+				kinds[n.Name] = kindFormula
+			default:
+				kinds[n.Name] = kindText
+			}
+		}
+		for i, row := range n.Rows {
+			for j, cell := range row {
+				kind := kindText
+				if _, ok := cell.(Formula); ok {
+					kind = kindFormula
+				} else if j < len(n.ColumnTypes) && n.ColumnTypes[j] == "number" {
+					kind = kindNumber
+				}
+				kinds[fmt.Sprintf("%s__%d__%d", n.Name, i, j)] = kind
+			}
+		}
+		answerKinds(n.Nodes, kinds)
+	}
+	return kinds
+}
+
+var repetitionSuffix = regexp.MustCompile(`__\d+$`)
+
+// kindOf returns the kind of a name, which can have the suffix of a repetition.
+func kindOf(kinds map[string]string, name string) (string, bool) {
+	if kind, ok := kinds[name]; ok {
+		return kind, true
+	}
+	kind, ok := kinds[repetitionSuffix.ReplaceAllString(name, "")]
+	return kind, ok
+}
+
+// parseCellValue converts the text of a cell to a value of the given kind.
+func parseCellValue(kind, text string) (interface{}, error) {
+	switch kind {
+	case kindNumber:
+		n, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number.", text)
+		}
+		return n, nil
+	case kindBoolean:
+		b, ok := parseYesNo(text)
+		if !ok {
+			return nil, fmt.Errorf("%q is not yes or no.", text)
+		}
+		return b, nil
+	case kindMultiple:
+		var values []interface{}
+		for _, v := range strings.Fields(text) {
+			values = append(values, v)
+		}
+		return values, nil
+	}
+	return text, nil
+}
+
+func parseYesNo(text string) (value, ok bool) {
+	switch strings.ToLower(text) {
+	case "yes", "true", "1":
+		return true, true
+	case "no", "false", "0":
+		return false, true
+	}
+	return false, false
+}
+
+// ScenariosFromSheet reads the scenarios of the tests sheet of a form.
+// Each row refers to a field and has its answer or the expected visibility,
+// value (null for no value) or failure (yes, no or the error message);
+// rows without a scenario name continue the previous scenario.
+func ScenariosFromSheet(xls *XlsForm, ajf *AjfForm) ([]Scenario, error) {
+	kinds := answerKinds(ajf.Slides, nil)
+	var scenarios []Scenario
+	for _, row := range xls.Tests {
+		if name := row.Scenario(); name != "" && (len(scenarios) == 0 || scenarios[len(scenarios)-1].Name != name) {
+			scenarios = append(scenarios, Scenario{Name: name})
+		}
+		if len(scenarios) == 0 {
+			return nil, row.errorf("invalid-test", "scenario", "Missing scenario name.")
+		}
+		sc := &scenarios[len(scenarios)-1]
+		field := row.Field()
+		if field == "" {
+			return nil, row.errorf("invalid-test", "field", "Missing field name.")
+		}
+		kind, ok := kindOf(kinds, field)
+		if !ok {
+			return nil, row.errorf("invalid-test", "field", "Unknown field %q.", field)
+		}
+		if text := row.Answer(); text != "" {
+			v, err := parseCellValue(kind, text)
+			if err != nil {
+				return nil, row.errorf("invalid-test", "answer", "%s", err)
+			}
+			setKey(&sc.Answers, field, v)
+		}
+		if text := row.Visible(); text != "" {
+			v, ok := parseYesNo(text)
+			if !ok {
+				return nil, row.errorf("invalid-test", "visible", "%q is not yes or no.", text)
+			}
+			if sc.Visible == nil {
+				sc.Visible = make(map[string]bool)
+			}
+			sc.Visible[field] = v
+		}
+		if text := row.Value(); text != "" {
+			var v interface{}
+			if text != "null" {
+				var err error
+				if v, err = parseCellValue(kind, text); err != nil {
+					return nil, row.errorf("invalid-test", "value", "%s", err)
+				}
+			}
+			setKey(&sc.Values, field, v)
+		}
+		if text := row.Failure(); text != "" {
+			var v interface{} = text
+			if b, ok := parseYesNo(text); ok {
+				v = b
+			}
+			setKey(&sc.Failures, field, v)
+		}
+	}
+	return scenarios, nil
+}
+
+func setKey(m *map[string]interface{}, key string, v interface{}) {
+	if *m == nil {
+		*m = make(map[string]interface{})
+	}
+	(*m)[key] = v
+}
+
+// Check simulates the scenario, returning the expectations that aren't met
+// and the formulas that can't be evaluated; the scenario passes if there are none.
+func (sc *Scenario) Check(ajf *AjfForm) []string {
+	kinds := answerKinds(ajf.Slides, nil)
+	var problems []string
+	unknown := func(name string) bool {
+		if _, ok := kindOf(kinds, name); !ok {
+			problems = append(problems, fmt.Sprintf("Unknown field %q.", name))
+			return true
+		}
+		return false
+	}
+	for _, name := range sortedKeys(sc.Answers) {
+		unknown(name)
+	}
+
+	sim := Simulate(ajf, sc.Answers)
+	visibleNames := make([]string, 0, len(sc.Visible))
+	for name := range sc.Visible {
+		visibleNames = append(visibleNames, name)
+	}
+	sort.Strings(visibleNames)
+	for _, name := range visibleNames {
+		if unknown(name) {
+			continue
+		}
+		visible, ok := sim.Visible[name]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s doesn't exist (its repetition isn't there).", name))
+		case visible && !sc.Visible[name]:
+			problems = append(problems, fmt.Sprintf("%s is visible, expected hidden.", name))
+		case !visible && sc.Visible[name]:
+			problems = append(problems, fmt.Sprintf("%s is hidden, expected visible.", name))
+		}
+	}
+	for _, name := range sortedKeys(sc.Values) {
+		if unknown(name) {
+			continue
+		}
+		expected, actual := sc.Values[name], sim.Values[name]
+		if !valueMatches(expected, actual) {
+			problems = append(problems, fmt.Sprintf("%s is %s, expected %s.", name, jsonText(actual), jsonText(expected)))
+		}
+	}
+	for _, name := range sortedKeys(sc.Failures) {
+		if unknown(name) {
+			continue
+		}
+		var messages []string
+		for _, f := range sim.Failures {
+			if f.Field == name {
+				messages = append(messages, f.Message)
+			}
+		}
+		switch expected := sc.Failures[name].(type) {
+		case bool:
+			if expected && len(messages) == 0 {
+				problems = append(problems, fmt.Sprintf("%s is valid, expected a failure.", name))
+			} else if !expected && len(messages) > 0 {
+				problems = append(problems, fmt.Sprintf("%s fails: %s", name, strings.Join(messages, " ")))
+			}
+		case string:
+			if !contains(messages, expected) {
+				problems = append(problems, fmt.Sprintf("%s doesn't fail with %q.", name, expected))
+			}
+		}
+	}
+	for _, e := range sim.Errors {
+		problems = append(problems, fmt.Sprintf("Error in %s: %s", e.Field, e.Message))
+	}
+	return problems
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func jsonText(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+// valueMatches compares an expected value with the value of a simulation;
+// expected values written as text (like in the tests sheet) match
+// numbers, booleans and lists with the same text.
+func valueMatches(expected, actual interface{}) bool {
+	expected, actual = normalizeValue(expected), normalizeValue(actual)
+	if expected == nil || actual == nil {
+		return expected == nil && actual == nil
+	}
+	switch a := actual.(type) {
+	case float64:
+		e := toNumber(expected)
+		return e == a || math.Abs(e-a) <= 1e-9*math.Max(math.Abs(e), math.Abs(a))
+	case bool:
+		if s, ok := expected.(string); ok {
+			b, ok := parseYesNo(s)
+			return ok && b == a
+		}
+		return expected == a
+	case []interface{}:
+		var e []interface{}
+		switch exp := expected.(type) {
+		case []interface{}:
+			e = exp
+		case string:
+			for _, s := range strings.Fields(exp) {
+				e = append(e, s)
+			}
+		default:
+			return false
+		}
+		if len(e) != len(a) {
+			return false
+		}
+		as, es := make([]string, len(a)), make([]string, len(e))
+		for i := range a {
+			as[i], es[i] = toString(a[i]), toString(e[i])
+		}
+		sort.Strings(as)
+		sort.Strings(es)
+		return strings.Join(as, "\x00") == strings.Join(es, "\x00")
+	}
+	return toString(expected) == toString(actual)
+}
@@ -0,0 +1,183 @@
+package formats
+
+// A JsonSchema is a JSON Schema (draft 2020-12), limited to
+// the keywords needed to describe the submissions of forms.
+type JsonSchema struct {
+	Schema      string        `json:"$schema,omitempty"`
+	Title       string        `json:"title,omitempty"`
+	Description string        `json:"description,omitempty"`
+	Type        interface{}   `json:"type,omitempty"` // a type name or a list of them
+	Format      string        `json:"format,omitempty"`
+	Pattern     string        `json:"pattern,omitempty"`
+	Enum        []interface{} `json:"enum,omitempty"`
+	Minimum     *float64      `json:"minimum,omitempty"`
+	Maximum     *float64      `json:"maximum,omitempty"`
+	MultipleOf  *float64      `json:"multipleOf,omitempty"`
+	ReadOnly    bool          `json:"readOnly,omitempty"`
+
+	Properties           map[string]*JsonSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+
+	PrefixItems []*JsonSchema `json:"prefixItems,omitempty"`
+	Items       interface{}   `json:"items,omitempty"` // a *JsonSchema, or false
+	MinItems    *int          `json:"minItems,omitempty"`
+	MaxItems    *int          `json:"maxItems,omitempty"`
+	UniqueItems bool          `json:"uniqueItems,omitempty"`
+}
+
+const jsonSchemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// SubmissionSchema returns a JSON Schema of the submissions of ajf,
+// as objects with the values of the fields, keyed by name.
+// Repeating slides are arrays of objects with the values of their
+// fields, at most MaxReps; tables are arrays of rows, each an array
+// with the values of the cells. Unanswered fields are null or missing.
+//
+// A field is required only if it's always visible, since hidden fields
+// have no value; choice filters and constraints aren't checked.
+func SubmissionSchema(ajf *AjfForm, title string) *JsonSchema {
+	schema := objectSchema(ajf, ajf.Slides)
+	schema.Schema = jsonSchemaDraft
+	schema.Title = title
+	return schema
+}
+
+func objectSchema(ajf *AjfForm, nodes []Node) *JsonSchema {
+	schema := &JsonSchema{Type: "object", Properties: make(map[string]*JsonSchema), AdditionalProperties: new(bool)}
+	addProperties(ajf, schema, nodes, true)
+	return schema
+}
+
+// addProperties adds the fields in nodes to the properties of schema;
+// visible tells whether the container of nodes is always visible.
+func addProperties(ajf *AjfForm, schema *JsonSchema, nodes []Node, visible bool) {
+	for i := range nodes {
+		n := &nodes[i]
+		nodeVisible := visible && n.Visibility == nil
+		switch n.Type {
+		case NtRepeatingSlide:
+			items := objectSchema(ajf, n.Nodes)
+			array := &JsonSchema{Title: n.Label, Type: []string{"array", "null"}, Items: items}
+			if n.MaxReps != nil && *n.MaxReps > 0 {
+				array.MaxItems = n.MaxReps
+			}
+			// Fields hidden in some repetitions aren't required.
+			if !nodeVisible {
+				items.Required = nil
+			}
+			schema.Properties[n.Name] = array
+			continue
+		case NtSlide, NtGroup:
+			addProperties(ajf, schema, n.Nodes, nodeVisible)
+			continue
+		}
+		if n.FieldType != nil && *n.FieldType == FtNote {
+			continue
+		}
+		required := nodeVisible && n.Validation != nil && n.Validation.NotEmpty
+		schema.Properties[n.Name] = fieldSchema(ajf, n, required)
+		if required {
+			schema.Required = append(schema.Required, n.Name)
+		}
+	}
+}
+
+func fieldSchema(ajf *AjfForm, n *Node, required bool) *JsonSchema {
+	ft := FtString
+	if n.FieldType != nil {
+		ft = *n.FieldType
+	}
+	s := &JsonSchema{Title: n.Label, Description: n.Hint}
+	typ := "string"
+	switch ft {
+	case FtNumber:
+		typ = "number"
+		if isIntegerField(n) {
+			typ = "integer"
+		}
+	case FtRange:
+		typ = "number"
+		if n.RangeStart != nil && n.RangeEnd != nil && n.RangeStep != nil {
+			start, end, step := float64(*n.RangeStart), float64(*n.RangeEnd), float64(*n.RangeStep)
+			s.Minimum, s.Maximum = &start, &end
+			// multipleOf counts from 0, not from start.
+			if step > 0 && *n.RangeStart%*n.RangeStep == 0 {
+				s.MultipleOf = &step
+			}
+		}
+	case FtBoolean:
+		typ = "boolean"
+	case FtSingleChoice:
+		s.Enum = choiceValues(ajf, n)
+		if !required {
+			s.Enum = append(s.Enum, nil)
+		}
+	case FtMultipleChoice:
+		typ = "array"
+		s.Items = &JsonSchema{Type: "string", Enum: choiceValues(ajf, n)}
+		s.UniqueItems = true
+		if required {
+			s.MinItems = new(int)
+			*s.MinItems = 1
+		}
+	case FtDate:
+		s.Format = "date"
+	case FtTime:
+		s.Pattern = "^[0-2][0-9]:[0-5][0-9]"
+	case FtFormula:
+		// Calculations can have any type.
+		s.ReadOnly = true
+		return s
+	case FtTable:
+		return tableSchema(s, n, required)
+	}
+	s.Type = typ
+	if !required {
+		s.Type = []string{typ, "null"}
+	}
+	return s
+}
+
+func choiceValues(ajf *AjfForm, n *Node) []interface{} {
+	values := []interface{}{}
+	for _, o := range ajf.ChoicesOrigins {
+		if o.Name != n.ChoicesOriginRef {
+			continue
+		}
+		for _, c := range o.Choices {
+			values = append(values, c["value"])
+		}
+	}
+	return values
+}
+
+// tableSchema describes a table as an array of rows, each an array
+// of cells typed as their column; calculated cells can have any type.
+func tableSchema(s *JsonSchema, n *Node, required bool) *JsonSchema {
+	s.Type = "array"
+	if !required {
+		s.Type = []string{"array", "null"}
+	}
+	for i, row := range n.Rows {
+		rowSchema := &JsonSchema{Title: n.RowLabels[i], Type: "array", Items: false}
+		for j, cell := range row {
+			cellSchema := &JsonSchema{Title: n.ColumnLabels[j]}
+			switch _, calculated := cell.(Formula); {
+			case calculated:
+				cellSchema.ReadOnly = true
+			case n.ColumnTypes[j] == "number":
+				cellSchema.Type = []string{"number", "null"}
+			case n.ColumnTypes[j] == "date":
+				cellSchema.Type = []string{"string", "null"}
+				cellSchema.Format = "date"
+			default:
+				cellSchema.Type = []string{"string", "null"}
+			}
+			rowSchema.PrefixItems = append(rowSchema.PrefixItems, cellSchema)
+		}
+		s.PrefixItems = append(s.PrefixItems, rowSchema)
+	}
+	s.Items = false
+	return s
+}
@@ -0,0 +1,332 @@
+package formats
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// A Simulation is the state of a form filled in with a set of answers,
+// as computed by the ajf app: the values of calculations and defaults,
+// the visibility of nodes and the failed validations.
+//
+// Answers and values are keyed by field name; the fields of repeating
+// slides have a name suffixed by the instance, like name__0, and the
+// answer named like the slide is its number of instances.
+// In a repeating slide, formulas refer to the fields of the same instance
+// by their plain name; elsewhere, the plain name of a field in a repeating
+// slide is the array of its values in all the instances.
+// Cells of tables are named like table__row__column.
+type Simulation struct {
+	Values   map[string]interface{} `json:"values"`
+	Visible  map[string]bool        `json:"visible"`
+	Failures []SimFailure           `json:"failures,omitempty"`
+	Errors   []SimError             `json:"errors,omitempty"`
+}
+
+// A SimFailure is a validation that fails, or a required field without value.
+type SimFailure struct {
+	Field     string `json:"field"`
+	Message   string `json:"message"`
+	Condition string `json:"condition,omitempty"` // empty for required fields
+}
+
+// A SimError is a formula that can't be evaluated.
+type SimError struct {
+	Field   string `json:"field"`
+	Formula string `json:"formula"`
+	Message string `json:"message"`
+}
+
+type simulator struct {
+	sim     *Simulation
+	answers map[string]interface{}
+	exprs   map[string]*Expr
+	failed  map[[2]string]bool // errors already reported, by field and formula
+	changed bool
+}
+
+// Simulate computes the state of ajf for the given answers.
+// Hidden fields have no value, even if answered.
+// Formulas that can't be evaluated are reported in Errors:
+// their conditions are false and their values null.
+func Simulate(ajf *AjfForm, answers map[string]interface{}) *Simulation {
+	s := &simulator{
+		sim:     &Simulation{Values: make(map[string]interface{}), Visible: make(map[string]bool)},
+		answers: answers,
+		exprs:   make(map[string]*Expr),
+		failed:  make(map[[2]string]bool),
+	}
+	// Calculations can depend on later fields: repeat until nothing changes.
+	for pass := 0; pass < 100; pass++ {
+		s.changed = false
+		vars := s.globalVars(ajf.Slides)
+		for _, slide := range ajf.Slides {
+			s.walk(slide, true, "", vars)
+		}
+		if !s.changed {
+			break
+		}
+	}
+	vars := s.globalVars(ajf.Slides)
+	for _, slide := range ajf.Slides {
+		s.validate(slide, "", vars)
+	}
+	return s.sim
+}
+
+// Reps returns the number of instances of a repeating slide, given its answer.
+func Reps(slide *Node, answer interface{}) int {
+	n := toNumber(normalizeValue(answer))
+	if math.IsNaN(n) || n < 0 {
+		return 0
+	}
+	if slide.MaxReps != nil && *slide.MaxReps > 0 && n > float64(*slide.MaxReps) {
+		return *slide.MaxReps
+	}
+	return int(n)
+}
+
+// globalVars returns the values visible outside of repeating slides.
+func (s *simulator) globalVars(slides []Node) Vars {
+	vars := make(Vars, len(s.sim.Values))
+	for _, name := range fieldNames(slides) {
+		vars[name] = nil // fields without value are null
+	}
+	for name, v := range s.sim.Values {
+		vars[name] = v
+	}
+	for i := range slides {
+		slide := &slides[i]
+		if slide.Type != NtRepeatingSlide {
+			continue
+		}
+		reps := Reps(slide, s.answers[slide.Name])
+		vars[slide.Name] = float64(reps)
+		for _, name := range fieldNames(slide.Nodes) {
+			values := make([]interface{}, reps)
+			for r := range values {
+				values[r] = s.sim.Values[name+repSuffix(r)]
+			}
+			vars[name] = values
+		}
+	}
+	return vars
+}
+
+// instanceVars returns the values visible in an instance of a repeating slide.
+func (s *simulator) instanceVars(slide *Node, suffix string, global Vars) Vars {
+	vars := make(Vars, len(global))
+	for name, v := range global {
+		vars[name] = v
+	}
+	for _, name := range fieldNames(slide.Nodes) {
+		vars[name] = s.sim.Values[name+suffix]
+	}
+	return vars
+}
+
+// fieldNames lists the names of the fields in nodes, including table cells.
+func fieldNames(nodes []Node) []string {
+	var names []string
+	for i := range nodes {
+		n := &nodes[i]
+		if n.Type != NtField {
+			names = append(names, fieldNames(n.Nodes)...)
+			continue
+		}
+		names = append(names, n.Name)
+		for i, row := range n.Rows {
+			for j := range row {
+				names = append(names, cellName(n.Name, i, j))
+			}
+		}
+	}
+	return names
+}
+
+// repSuffix returns the suffix of the names of the fields in repetition r.
+func repSuffix(r int) string { return fmt.Sprintf("__%d", r) }
+
+// cellName returns the name of a cell of a table.
+func cellName(table string, row, col int) string {
+	return fmt.Sprintf("%s__%d__%d", table, row, col)
+}
+
+func (s *simulator) walk(n Node, parentVisible bool, suffix string, vars Vars) {
+	name := n.Name + suffix
+	visible := parentVisible
+	if visible && n.Visibility != nil {
+		visible = toBool(s.eval(name, n.Visibility.Condition, vars))
+	}
+	s.setVisible(name, visible)
+
+	switch n.Type {
+	case NtRepeatingSlide:
+		for r := 0; r < Reps(&n, s.answers[n.Name]); r++ {
+			suffix := repSuffix(r)
+			instVars := s.instanceVars(&n, suffix, vars)
+			for _, child := range n.Nodes {
+				s.walk(child, visible, suffix, instVars)
+			}
+		}
+		return
+	case NtSlide, NtGroup:
+		for _, child := range n.Nodes {
+			s.walk(child, visible, suffix, vars)
+		}
+		return
+	}
+
+	s.setValue(name, s.fieldValue(&n, name, visible, vars))
+	for i, row := range n.Rows {
+		for j, cell := range row {
+			cellName := fmt.Sprintf("%s__%d__%d", n.Name, i, j) + suffix
+			var v interface{}
+			if f, ok := cell.(Formula); ok && visible {
+				v = s.eval(cellName, f.Formula, vars)
+			} else if visible {
+				v = normalizeValue(s.answers[cellName])
+			}
+			s.setValue(cellName, v)
+		}
+	}
+}
+
+func (s *simulator) fieldValue(n *Node, name string, visible bool, vars Vars) interface{} {
+	if !visible {
+		return nil
+	}
+	if n.FieldType != nil && *n.FieldType == FtFormula && n.Formula != nil {
+		return s.eval(name, n.Formula.Formula, vars)
+	}
+	if answer, ok := s.answers[name]; ok {
+		return normalizeValue(answer)
+	}
+	if n.DefaultVal != nil {
+		return s.eval(name, n.DefaultVal.Formula, vars)
+	}
+	return nil
+}
+
+func (s *simulator) validate(n Node, suffix string, vars Vars) {
+	name := n.Name + suffix
+	if !s.sim.Visible[name] {
+		return
+	}
+	switch n.Type {
+	case NtRepeatingSlide:
+		for r := 0; r < Reps(&n, s.answers[n.Name]); r++ {
+			suffix := repSuffix(r)
+			instVars := s.instanceVars(&n, suffix, vars)
+			for _, child := range n.Nodes {
+				s.validate(child, suffix, instVars)
+			}
+		}
+		return
+	case NtSlide, NtGroup:
+		for _, child := range n.Nodes {
+			s.validate(child, suffix, vars)
+		}
+		return
+	}
+	if n.Validation == nil {
+		return
+	}
+	if n.Validation.NotEmpty && !toBool(builtins["notEmpty"].(jsFunc)(nil, []interface{}{s.sim.Values[name]})) {
+		msg := n.Validation.NotEmptyMsg
+		if msg == "" {
+			msg = "Value required."
+		}
+		s.sim.Failures = append(s.sim.Failures, SimFailure{Field: name, Message: msg})
+	}
+	for _, c := range n.Validation.Conditions {
+		if !toBool(s.eval(name, c.Condition, vars)) {
+			msg := c.ErrorMessage
+			if msg == "" {
+				msg = "Invalid value."
+			}
+			s.sim.Failures = append(s.sim.Failures, SimFailure{Field: name, Message: msg, Condition: c.Condition})
+		}
+	}
+}
+
+// eval evaluates a formula of field, reporting errors and returning nil for them.
+func (s *simulator) eval(field, formula string, vars Vars) interface{} {
+	e, ok := s.exprs[formula]
+	var err error
+	if !ok {
+		e, err = ParseExpr(formula)
+		s.exprs[formula] = e
+	}
+	var v interface{}
+	if e != nil {
+		v, err = e.Eval(vars)
+	} else if err == nil {
+		err = fmt.Errorf("formula %q can't be parsed.", formula)
+	}
+	if err != nil && !s.failed[[2]string{field, formula}] {
+		s.failed[[2]string{field, formula}] = true
+		s.sim.Errors = append(s.sim.Errors, SimError{field, formula, err.Error()})
+	}
+	return v
+}
+
+func (s *simulator) setVisible(name string, visible bool) {
+	if old, ok := s.sim.Visible[name]; !ok || old != visible {
+		s.sim.Visible[name] = visible
+		s.changed = true
+	}
+}
+
+func (s *simulator) setValue(name string, v interface{}) {
+	if f, ok := v.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		v = nil // like the ajf app, as json has no NaN or Infinity
+	}
+	old, ok := s.sim.Values[name]
+	if v == nil {
+		if ok {
+			delete(s.sim.Values, name)
+			s.changed = true
+		}
+		return
+	}
+	if !ok || !reflect.DeepEqual(old, v) {
+		s.sim.Values[name] = v
+		s.changed = true
+	}
+}
+
+// FilterChoices returns the choices of a choice field that satisfy its
+// choice filter, given the values of a simulation.
+func (sim *Simulation) FilterChoices(ajf *AjfForm, field *Node) []Choice {
+	var choices []Choice
+	for _, o := range ajf.ChoicesOrigins {
+		if o.Name == field.ChoicesOriginRef {
+			choices = o.Choices
+		}
+	}
+	if field.ChoicesFilter == nil {
+		return choices
+	}
+	e, err := ParseExpr(field.ChoicesFilter.Formula)
+	if err != nil {
+		return choices
+	}
+	vars := make(Vars, len(sim.Values)+1)
+	for name, v := range sim.Values {
+		vars[name] = v
+	}
+	var filtered []Choice
+	for _, c := range choices {
+		choice := make(map[string]interface{}, len(c))
+		for k, v := range c {
+			choice[k] = v
+		}
+		vars["$choice"] = choice
+		if ok, err := e.EvalBool(vars); err == nil && ok {
+			filtered = append(filtered, c)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,252 @@
+package formats
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// A SqlDialect is a dialect of SQL for the statements of EncSql.
+type SqlDialect int
+
+const (
+	Postgres SqlDialect = iota
+	SQLite
+)
+
+// EncSql writes the SQL statements creating tables for the submissions of ajf:
+//   - a table with the given name for the submissions, with an id and a column
+//     for each field (and table cell), named like the field;
+//   - a table for each repeat, named table_repeat, with a row for each
+//     repetition, linked to its submission by submission_id and ordered by rep;
+//   - a lookup table for each choice list, named table_choices_list,
+//     filled with the choices, referenced by single choice fields;
+//   - a link table for each multiple choice field, named table_field
+//     (or table_repeat_field), with a row for each selected choice.
+//
+// Labels are written as comments. Calculations are stored as text.
+func EncSql(w io.Writer, ajf *AjfForm, table string, dialect SqlDialect) error {
+	e := sqlEncoder{ajf: ajf, dialect: dialect, prefix: table}
+	for _, o := range ajf.ChoicesOrigins {
+		e.lookupTable(o)
+	}
+	main := e.newTable(table, "", nil)
+	e.addColumns(main, ajf.Slides)
+	for i := range ajf.Slides {
+		if slide := &ajf.Slides[i]; slide.Type == NtRepeatingSlide {
+			rep := e.newTable(table+"_"+slide.Name, slide.Label, main)
+			e.addColumns(rep, slide.Nodes)
+		}
+	}
+	if e.err != nil {
+		return e.err
+	}
+	for _, t := range e.tables {
+		e.createTable(t)
+	}
+	_, err := io.WriteString(w, strings.TrimSuffix(e.b.String(), "\n"))
+	return err
+}
+
+type sqlEncoder struct {
+	ajf     *AjfForm
+	dialect SqlDialect
+	prefix  string
+	b       strings.Builder
+	tables  []*sqlTable
+	err     error
+}
+
+type sqlTable struct {
+	name    string
+	comment string
+	columns []sqlColumn
+	keys    []string // table constraints
+}
+
+type sqlColumn struct {
+	name, typ, comment string
+}
+
+// Columns added to the tables of submissions and repeats.
+var sqlKeyColumns = map[string]bool{"id": true, "submission_id": true, "rep": true}
+
+// newTable adds a table with an id; tables of repeats
+// reference the submission with their parent.
+func (e *sqlEncoder) newTable(name, comment string, parent *sqlTable) *sqlTable {
+	t := &sqlTable{name: name, comment: comment}
+	t.columns = append(t.columns, sqlColumn{"id", e.idType(), ""})
+	if parent != nil {
+		t.columns = append(t.columns,
+			sqlColumn{"submission_id", e.foreignKey("bigint", parent.name, "id") + " ON DELETE CASCADE", ""},
+			sqlColumn{"rep", "integer NOT NULL", "index of the repetition, from 0"})
+		t.keys = append(t.keys, "UNIQUE (submission_id, rep)")
+	}
+	e.tables = append(e.tables, t)
+	return t
+}
+
+func (e *sqlEncoder) idType() string {
+	if e.dialect == SQLite {
+		return "INTEGER PRIMARY KEY" // alias of the rowid
+	}
+	return "bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY"
+}
+
+func (e *sqlEncoder) foreignKey(typ, table, column string) string {
+	return fmt.Sprintf("%s NOT NULL REFERENCES %s (%s)", typ, sqlIdent(table), sqlIdent(column))
+}
+
+func (e *sqlEncoder) lookupName(list string) string {
+	return e.prefix + "_choices_" + list
+}
+
+func (e *sqlEncoder) lookupTable(o ChoicesOrigin) {
+	name := e.lookupName(o.Name)
+	fmt.Fprintf(&e.b, "CREATE TABLE %s (\n\tvalue text PRIMARY KEY,\n\tlabel text NOT NULL\n);\n", sqlIdent(name))
+	if len(o.Choices) > 0 {
+		fmt.Fprintf(&e.b, "INSERT INTO %s (value, label) VALUES", sqlIdent(name))
+		for i, c := range o.Choices {
+			if i > 0 {
+				e.b.WriteString(",")
+			}
+			fmt.Fprintf(&e.b, "\n\t(%s, %s)", sqlString(c["value"]), sqlString(c["label"]))
+		}
+		e.b.WriteString(";\n")
+	}
+	e.b.WriteString("\n")
+}
+
+// addColumns adds the fields in nodes to t, except those of repeats.
+func (e *sqlEncoder) addColumns(t *sqlTable, nodes []Node) {
+	for i := range nodes {
+		n := &nodes[i]
+		switch n.Type {
+		case NtRepeatingSlide:
+			continue
+		case NtSlide, NtGroup:
+			e.addColumns(t, n.Nodes)
+			continue
+		}
+		if sqlKeyColumns[n.Name] && e.err == nil {
+			e.err = fmt.Errorf("Field name %q is used by a column of table %s.", n.Name, t.name)
+		}
+		ft := FtString
+		if n.FieldType != nil {
+			ft = *n.FieldType
+		}
+		switch ft {
+		case FtNote:
+		case FtMultipleChoice:
+			link := &sqlTable{name: t.name + "_" + n.Name, comment: n.Label}
+			link.columns = []sqlColumn{
+				{t.name + "_id", e.foreignKey("bigint", t.name, "id") + " ON DELETE CASCADE", ""},
+				{"value", e.foreignKey("text", e.lookupName(n.ChoicesOriginRef), "value"), ""},
+			}
+			link.keys = []string{fmt.Sprintf("PRIMARY KEY (%s, value)", sqlIdent(t.name+"_id"))}
+			e.tables = append(e.tables, link)
+		case FtSingleChoice:
+			typ := fmt.Sprintf("text REFERENCES %s (value)", sqlIdent(e.lookupName(n.ChoicesOriginRef)))
+			t.columns = append(t.columns, sqlColumn{n.Name, typ, n.Label})
+		case FtTable:
+			for i, row := range n.Rows {
+				for j := range row {
+					typ := map[string]FieldType{"number": FtNumber, "date": FtDate}[n.ColumnTypes[j]]
+					if _, ok := row[j].(Formula); ok {
+						typ = FtFormula
+					}
+					t.columns = append(t.columns, sqlColumn{cellName(n.Name, i, j), e.columnType(typ, false),
+						n.Label + ": " + n.RowLabels[i] + ", " + n.ColumnLabels[j]})
+				}
+			}
+		default:
+			t.columns = append(t.columns, sqlColumn{n.Name, e.columnType(ft, isIntegerField(n)), n.Label})
+		}
+	}
+}
+
+func (e *sqlEncoder) columnType(ft FieldType, integer bool) string {
+	switch ft {
+	case FtNumber:
+		if integer {
+			return "integer"
+		}
+		if e.dialect == SQLite {
+			return "real"
+		}
+		return "double precision"
+	case FtRange:
+		return "integer"
+	case FtBoolean:
+		if e.dialect == SQLite {
+			return "integer" // 0 or 1
+		}
+		return "boolean"
+	case FtDate:
+		if e.dialect == SQLite {
+			return "text" // yyyy-mm-dd
+		}
+		return "date"
+	case FtTime:
+		if e.dialect == SQLite {
+			return "text" // hh:mm
+		}
+		return "time"
+	}
+	return "text"
+}
+
+func (e *sqlEncoder) createTable(t *sqlTable) {
+	if t.comment != "" {
+		fmt.Fprintf(&e.b, "-- %s\n", sqlComment(t.comment))
+	}
+	fmt.Fprintf(&e.b, "CREATE TABLE %s (", sqlIdent(t.name))
+	n := len(t.columns) + len(t.keys)
+	for i, c := range t.columns {
+		fmt.Fprintf(&e.b, "\n\t%s %s", sqlIdent(c.name), c.typ)
+		if i < n-1 {
+			e.b.WriteString(",")
+		}
+		if c.comment != "" {
+			fmt.Fprintf(&e.b, " -- %s", sqlComment(c.comment))
+		}
+	}
+	for i, k := range t.keys {
+		e.b.WriteString("\n\t" + k)
+		if len(t.columns)+i < n-1 {
+			e.b.WriteString(",")
+		}
+	}
+	e.b.WriteString("\n);\n\n")
+}
+
+var plainIdent = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// sqlReserved are the reserved words of PostgreSQL and SQLite
+// that are likely names of fields.
+var sqlReserved = map[string]bool{
+	"all": true, "and": true, "as": true, "by": true, "case": true, "check": true, "column": true,
+	"constraint": true, "create": true, "default": true, "desc": true, "distinct": true,
+	"else": true, "end": true, "from": true, "group": true, "having": true, "in": true,
+	"index": true, "is": true, "key": true, "limit": true, "not": true, "null": true,
+	"offset": true, "on": true, "or": true, "order": true, "primary": true, "references": true,
+	"select": true, "table": true, "then": true, "to": true, "union": true, "unique": true,
+	"user": true, "values": true, "when": true, "where": true, "with": true,
+}
+
+// sqlIdent quotes an identifier, if needed.
+func sqlIdent(name string) string {
+	if plainIdent.MatchString(name) && !sqlReserved[name] {
+		return name
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func sqlString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func sqlComment(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
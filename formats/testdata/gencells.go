@@ -0,0 +1,302 @@
+//go:build ignore
+
+// gencells writes cells.xls, a BIFF8 workbook exercising the records
+// read by the xls reader that Excel writes only for larger workbooks:
+// shared strings spanning CONTINUE records, MULRK rows, dates with built-in
+// and custom formats, and cached values of formulas.
+// Run it from this directory with: go run gencells.go
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"unicode/utf16"
+)
+
+type buf struct{ bytes.Buffer }
+
+func (b *buf) u8(v byte)    { b.WriteByte(v) }
+func (b *buf) u16(v uint16) { binary.Write(b, binary.LittleEndian, v) }
+func (b *buf) u32(v uint32) { binary.Write(b, binary.LittleEndian, v) }
+func (b *buf) f64(v float64) {
+	b.u32(uint32(math.Float64bits(v)))
+	b.u32(uint32(math.Float64bits(v) >> 32))
+}
+
+// str writes an XLUnicodeString with 8-bit characters.
+func (b *buf) str(s string) {
+	b.u16(uint16(len(s)))
+	b.u8(0)
+	b.WriteString(s)
+}
+
+func (b *buf) utf16(s string) {
+	for _, c := range utf16.Encode([]rune(s)) {
+		b.u16(c)
+	}
+}
+
+func record(out *buf, id uint16, data []byte) {
+	out.u16(id)
+	out.u16(uint16(len(data)))
+	out.Write(data)
+}
+
+func bof(dt uint16) []byte {
+	var b buf
+	b.u16(0x0600)
+	b.u16(dt)
+	b.u16(0x0DBB)
+	b.u16(0x07CC)
+	b.u32(0)
+	b.u32(6)
+	return b.Bytes()
+}
+
+func cellHead(b *buf, row, col, ixfe uint16) {
+	b.u16(row)
+	b.u16(col)
+	b.u16(ixfe)
+}
+
+// XF indexes.
+const (
+	xfGeneral = iota
+	xfDate    // built-in format 14, m/d/yy
+	xfCustom  // custom format 164, yyyy-mm-dd hh:mm
+	xfTime    // built-in format 20, h:mm
+)
+
+func globals(sheetOffset uint32) []byte {
+	var out buf
+	record(&out, 0x0809, bof(0x0005))
+	record(&out, 0x0022, []byte{0, 0}) // DATEMODE, 1900
+
+	var format buf
+	format.u16(164)
+	format.str("yyyy-mm-dd hh:mm")
+	record(&out, 0x041E, format.Bytes())
+
+	for _, ifmt := range []uint16{0, 14, 164, 20} {
+		var xf buf
+		xf.u16(0)
+		xf.u16(ifmt)
+		xf.Write(make([]byte, 16))
+		record(&out, 0x00E0, xf.Bytes())
+	}
+
+	var sheet buf
+	sheet.u32(sheetOffset)
+	sheet.u8(0) // visible
+	sheet.u8(0) // worksheet
+	sheet.u8(uint8(len("survey")))
+	sheet.u8(0)
+	sheet.WriteString("survey")
+	record(&out, 0x0085, sheet.Bytes())
+
+	// The SST is split in three records: the label of age continues
+	// in the first CONTINUE record with 16-bit characters, the second
+	// CONTINUE record starts at the boundary of a string.
+	var sst, cont1, cont2 buf
+	sst.u32(10)
+	sst.u32(9)
+	for _, s := range []string{"type", "name", "label", "default", "integer", "age"} {
+		sst.str(s)
+	}
+	sst.u16(uint16(len([]rune("Età del bambino"))))
+	sst.u8(0)
+	sst.WriteString("Et")
+	cont1.u8(1) // 16-bit characters
+	cont1.utf16("à del bambino")
+	cont1.u16(4) // rich text with one formatting run
+	cont1.u8(0x08)
+	cont1.u16(1)
+	cont1.WriteString("rich")
+	cont1.u16(0)
+	cont1.u16(0)
+	cont2.str("tail")
+	record(&out, 0x00FC, sst.Bytes())
+	record(&out, 0x003C, cont1.Bytes())
+	record(&out, 0x003C, cont2.Bytes())
+
+	record(&out, 0x000A, nil)
+	return out.Bytes()
+}
+
+func worksheet() []byte {
+	var out buf
+	record(&out, 0x0809, bof(0x0010))
+
+	labelSst := func(row, col uint16, isst uint32) {
+		var b buf
+		cellHead(&b, row, col, xfGeneral)
+		b.u32(isst)
+		record(&out, 0x00FD, b.Bytes())
+	}
+	for col := uint16(0); col < 4; col++ {
+		labelSst(0, col, uint32(col))
+	}
+	labelSst(1, 0, 4)
+	labelSst(1, 1, 5)
+	labelSst(1, 2, 6)
+	var number buf
+	cellHead(&number, 1, 3, xfGeneral)
+	number.f64(12.5)
+	record(&out, 0x0203, number.Bytes())
+
+	// MULRK: the integer 7, the float 1.5, 314 / 100 and a date.
+	var mulrk buf
+	mulrk.u16(2)
+	mulrk.u16(0)
+	for _, rk := range []struct {
+		ixfe uint16
+		rk   uint32
+	}{
+		{xfGeneral, 7<<2 | 0x02},
+		{xfGeneral, uint32(math.Float64bits(1.5) >> 32)},
+		{xfGeneral, 314<<2 | 0x03},
+		{xfDate, 43831<<2 | 0x02},
+	} {
+		mulrk.u16(rk.ixfe)
+		mulrk.u32(rk.rk)
+	}
+	mulrk.u16(3)
+	record(&out, 0x00BD, mulrk.Bytes())
+
+	formula := func(col, ixfe uint16, val []byte) {
+		var b buf
+		cellHead(&b, 3, col, ixfe)
+		b.Write(val)
+		b.u16(0) // grbit
+		b.u32(0) // chn
+		b.u16(3) // cce
+		b.u8(0x1E)
+		b.u16(1) // PtgInt 1, the cached value is what matters
+		record(&out, 0x0006, b.Bytes())
+	}
+	var num buf
+	num.f64(42)
+	formula(0, xfGeneral, num.Bytes())
+	formula(1, xfGeneral, []byte{0, 0, 0, 0, 0, 0, 0xFF, 0xFF})
+	var str buf
+	str.str("computed")
+	record(&out, 0x0207, str.Bytes())
+	formula(2, xfGeneral, []byte{1, 0, 1, 0, 0, 0, 0xFF, 0xFF})
+	var date buf
+	date.f64(43831.75)
+	formula(3, xfCustom, date.Bytes())
+	formula(4, xfGeneral, []byte{2, 0, 0x07, 0, 0, 0, 0xFF, 0xFF}) // #DIV/0!
+
+	var rk buf
+	cellHead(&rk, 4, 0, xfTime)
+	rk.u32(uint32(math.Float64bits(0.5) >> 32))
+	record(&out, 0x027E, rk.Bytes())
+	var boolCell, errCell buf
+	cellHead(&boolCell, 4, 1, xfGeneral)
+	boolCell.Write([]byte{1, 0})
+	record(&out, 0x0205, boolCell.Bytes())
+	cellHead(&errCell, 4, 2, xfGeneral)
+	errCell.Write([]byte{0x2A, 1}) // #N/A
+	record(&out, 0x0205, errCell.Bytes())
+	var label buf
+	cellHead(&label, 4, 3, xfGeneral)
+	label.str("inline")
+	record(&out, 0x0204, label.Bytes())
+	labelSst(4, 4, 7)
+	labelSst(4, 5, 8)
+
+	record(&out, 0x000A, nil)
+	return out.Bytes()
+}
+
+const (
+	endOfChain = 0xFFFFFFFE
+	freeSect   = 0xFFFFFFFF
+	fatSect    = 0xFFFFFFFD
+	noStream   = 0xFFFFFFFF
+	sectorSize = 512
+)
+
+func dirEntry(b *buf, name string, typ byte, child, start, size uint32) {
+	var n [64]byte
+	for i, c := range utf16.Encode([]rune(name)) {
+		binary.LittleEndian.PutUint16(n[2*i:], c)
+	}
+	b.Write(n[:])
+	b.u16(uint16(2 * (len(name) + 1)))
+	b.u8(typ)
+	b.u8(1) // black
+	b.u32(noStream)
+	b.u32(noStream)
+	b.u32(child)
+	b.Write(make([]byte, 16+4+16)) // clsid, state bits, times
+	b.u32(start)
+	b.u32(size)
+	b.u32(0)
+}
+
+// compoundFile stores stream as the Workbook stream of a compound file,
+// with one FAT sector (sector 0) and one directory sector (sector 1).
+func compoundFile(stream []byte) []byte {
+	nsect := (len(stream) + sectorSize - 1) / sectorSize
+	var out buf
+	out.Write([]byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1})
+	out.Write(make([]byte, 16))
+	out.u16(0x003E)
+	out.u16(0x0003)
+	out.u16(0xFFFE)
+	out.u16(9) // 512-byte sectors
+	out.u16(6) // 64-byte mini sectors
+	out.Write(make([]byte, 6+4))
+	out.u32(1) // FAT sectors
+	out.u32(1) // first directory sector
+	out.u32(0)
+	out.u32(4096) // mini stream cutoff
+	out.u32(endOfChain)
+	out.u32(0)
+	out.u32(endOfChain)
+	out.u32(0)
+	out.u32(0) // the FAT is in sector 0
+	for i := 1; i < 109; i++ {
+		out.u32(freeSect)
+	}
+
+	var fat buf
+	fat.u32(fatSect)
+	fat.u32(endOfChain)
+	for i := 0; i < nsect; i++ {
+		next := uint32(i + 3)
+		if i == nsect-1 {
+			next = endOfChain
+		}
+		fat.u32(next)
+	}
+	for fat.Len() < sectorSize {
+		fat.u32(freeSect)
+	}
+	out.Write(fat.Bytes())
+
+	var dir buf
+	dirEntry(&dir, "Root Entry", 5, 1, endOfChain, 0)
+	dirEntry(&dir, "Workbook", 2, noStream, 2, uint32(len(stream)))
+	dir.Write(make([]byte, sectorSize-dir.Len()))
+	out.Write(dir.Bytes())
+
+	out.Write(stream)
+	out.Write(make([]byte, nsect*sectorSize-len(stream)))
+	return out.Bytes()
+}
+
+func main() {
+	offset := uint32(len(globals(0)))
+	stream := append(globals(offset), worksheet()...)
+	// Streams shorter than the mini stream cutoff would be stored in the mini stream.
+	if len(stream) < 4096 {
+		stream = append(stream, make([]byte, 4096-len(stream))...)
+	}
+	if err := os.WriteFile("cells.xls", compoundFile(stream), 0666); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,396 @@
+package formats
+
+import (
+	"fmt"
+	"go/format"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// Types of submissions in TypeScript and Go.
+//
+// Both describe the submissions as sent by the ajf app: objects with the
+// values of the fields keyed by name, where the fields of repeats are
+// suffixed by the index of the repetition, like name__0, and the name
+// of a repeat gives the number of repetitions.
+// Single choice fields are typed with the union of their choices.
+
+// typedField is a field of a submission, with the types of its value.
+type typedField struct {
+	name, label string
+	tsType      string
+	goType      string
+}
+
+// typedRepeat is a repeat, with the fields of a repetition.
+type typedRepeat struct {
+	name, label string
+	fields      []typedField
+}
+
+type typesBuilder struct {
+	ajf     *AjfForm
+	fields  []typedField
+	repeats []typedRepeat
+	choices []string // the choice lists used by single and multiple choice fields
+}
+
+func buildTypes(ajf *AjfForm) *typesBuilder {
+	b := &typesBuilder{ajf: ajf}
+	b.fields = b.addFields(nil, ajf.Slides)
+	return b
+}
+
+func (b *typesBuilder) addFields(fields []typedField, nodes []Node) []typedField {
+	for i := range nodes {
+		n := &nodes[i]
+		switch n.Type {
+		case NtRepeatingSlide:
+			b.repeats = append(b.repeats, typedRepeat{n.Name, n.Label, b.addFields(nil, n.Nodes)})
+			continue
+		case NtSlide, NtGroup:
+			fields = b.addFields(fields, n.Nodes)
+			continue
+		}
+		ft := FtString
+		if n.FieldType != nil {
+			ft = *n.FieldType
+		}
+		f := typedField{name: n.Name, label: n.Label, tsType: "string", goType: "*string"}
+		switch ft {
+		case FtNote:
+			continue
+		case FtNumber, FtRange:
+			f.tsType, f.goType = "number", "*float64"
+			if ft == FtRange || isIntegerField(n) {
+				f.goType = "*int"
+			}
+		case FtBoolean:
+			f.tsType, f.goType = "boolean", "*bool"
+		case FtSingleChoice, FtMultipleChoice:
+			if !contains(b.choices, n.ChoicesOriginRef) {
+				b.choices = append(b.choices, n.ChoicesOriginRef)
+			}
+			choice := exportedName(n.ChoicesOriginRef) + "Choice"
+			f.tsType, f.goType = choice, "*"+choice
+			if ft == FtMultipleChoice {
+				f.tsType, f.goType = choice+"[]", "[]"+choice
+			}
+		case FtFormula:
+			f.tsType, f.goType = "unknown", "interface{}" // calculations can have any type
+		case FtTable:
+			for i, row := range n.Rows {
+				for j, cell := range row {
+					c := typedField{name: cellName(n.Name, i, j), label: n.RowLabels[i] + ", " + n.ColumnLabels[j],
+						tsType: "string", goType: "*string"}
+					if _, ok := cell.(Formula); ok {
+						c.tsType, c.goType = "unknown", "interface{}"
+					} else if n.ColumnTypes[j] == "number" {
+						c.tsType, c.goType = "number", "*float64"
+					}
+					fields = append(fields, c)
+				}
+			}
+			continue
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func (b *typesBuilder) choiceValues(list string) []string {
+	var values []string
+	for _, o := range b.ajf.ChoicesOrigins {
+		if o.Name == list {
+			for _, c := range o.Choices {
+				values = append(values, c["value"])
+			}
+		}
+	}
+	return values
+}
+
+// exportedName makes an exported Go (or TypeScript) identifier
+// in camel case from a name, like PetSize from pet_size.
+func exportedName(name string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if b.Len() == 0 && unicode.IsDigit(r) {
+			b.WriteString("X")
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	if b.Len() == 0 {
+		return "X"
+	}
+	return b.String()
+}
+
+// uniqueNames returns exported names for a list of names, distinct
+// from each other and from the reserved ones.
+func uniqueNames(names []string, reserved ...string) []string {
+	used := make(map[string]bool)
+	for _, r := range reserved {
+		used[r] = true
+	}
+	unique := make([]string, len(names))
+	for i, name := range names {
+		n := exportedName(name)
+		for k := 2; used[n]; k++ {
+			n = fmt.Sprintf("%s%d", exportedName(name), k)
+		}
+		used[n] = true
+		unique[i] = n
+	}
+	return unique
+}
+
+func comment(label string) string {
+	return strings.Join(strings.Fields(label), " ")
+}
+
+func jsString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`, "\n", `\n`, "\r", `\r`).Replace(s) + "'"
+}
+
+// EncTypeScript writes TypeScript types of the submissions of ajf:
+// an interface named like name followed by Submission, and a union
+// of the choices of each choice list, named like the list followed by Choice.
+func EncTypeScript(w io.Writer, ajf *AjfForm, name string) error {
+	b := buildTypes(ajf)
+	var s strings.Builder
+	s.WriteString("// Code generated by formconv. DO NOT EDIT.\n")
+	for _, list := range b.choices {
+		fmt.Fprintf(&s, "\nexport type %sChoice =", exportedName(list))
+		values := b.choiceValues(list)
+		if len(values) == 0 {
+			s.WriteString(" never")
+		}
+		for _, v := range values {
+			fmt.Fprintf(&s, "\n\t| %s", jsString(v))
+		}
+		s.WriteString(";\n")
+	}
+	fmt.Fprintf(&s, "\nexport interface %sSubmission {\n", exportedName(name))
+	for _, f := range b.fields {
+		if f.label != "" {
+			fmt.Fprintf(&s, "\t/** %s */\n", comment(f.label))
+		}
+		fmt.Fprintf(&s, "\t%s?: %s | null;\n", f.name, f.tsType)
+	}
+	for _, r := range b.repeats {
+		fmt.Fprintf(&s, "\t/** Number of repetitions of %s */\n", comment(r.label))
+		fmt.Fprintf(&s, "\t%s?: number | null;\n", r.name)
+		for _, f := range r.fields {
+			if f.label != "" {
+				fmt.Fprintf(&s, "\t/** %s, in each repetition */\n", comment(f.label))
+			}
+			fmt.Fprintf(&s, "\t[%s: `%s__${number}`]: %s | null | undefined;\n", f.name, f.name, f.tsType)
+		}
+	}
+	s.WriteString("}\n")
+	_, err := io.WriteString(w, s.String())
+	return err
+}
+
+// EncGoTypes writes Go types of the submissions of ajf, in package pkg:
+// a struct named like name followed by Submission, with a field
+// for each field of ajf and a slice of structs for each repeat,
+// and a string type for each choice list, named like the list
+// followed by Choice, with a constant for each choice.
+// The repetitions are decoded and encoded by the methods
+// UnmarshalJSON and MarshalJSON of the submission.
+func EncGoTypes(w io.Writer, ajf *AjfForm, name, pkg string) error {
+	b := buildTypes(ajf)
+	typeName := exportedName(name) + "Submission"
+	var s strings.Builder
+	s.WriteString("// Code generated by formconv. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&s, "package %s\n\n", pkg)
+	if len(b.repeats) > 0 {
+		s.WriteString("import (\n\"encoding/json\"\n\"strconv\"\n)\n\n")
+	}
+
+	for _, list := range b.choices {
+		choice := exportedName(list) + "Choice"
+		fmt.Fprintf(&s, "type %s string\n\n", choice)
+		values := b.choiceValues(list)
+		if len(values) == 0 {
+			continue
+		}
+		s.WriteString("const (\n")
+		for i, c := range uniqueNames(values) {
+			fmt.Fprintf(&s, "%s%s %s = %q\n", exportedName(list), c, choice, values[i])
+		}
+		s.WriteString(")\n\n")
+	}
+
+	repTypes := make([]string, len(b.repeats))
+	var repNames []string
+	for i, r := range b.repeats {
+		repTypes[i] = exportedName(name) + exportedName(r.name)
+		repNames = append(repNames, r.name)
+	}
+	var fieldNames []string
+	for _, f := range b.fields {
+		fieldNames = append(fieldNames, f.name)
+	}
+	// Repeats have the names after fields, unlike in the form.
+	goNames := uniqueNames(append(fieldNames, repNames...), "MarshalJSON", "UnmarshalJSON")
+
+	fmt.Fprintf(&s, "// %s is a submission of %s.\n", typeName, name)
+	fmt.Fprintf(&s, "type %s struct {\n", typeName)
+	writeGoFields(&s, b.fields, goNames)
+	for i, r := range b.repeats {
+		fmt.Fprintf(&s, "%s []%s `json:\"-\"` // %s\n", goNames[len(b.fields)+i], repTypes[i], comment(r.label))
+	}
+	s.WriteString("}\n")
+
+	for i, r := range b.repeats {
+		fmt.Fprintf(&s, "\n// %s is a repetition of %s.\n", repTypes[i], r.name)
+		fmt.Fprintf(&s, "type %s struct {\n", repTypes[i])
+		var names []string
+		for _, f := range r.fields {
+			names = append(names, f.name)
+		}
+		writeGoFields(&s, r.fields, uniqueNames(names))
+		s.WriteString("}\n")
+	}
+	if len(b.repeats) > 0 {
+		writeGoRepeatMethods(&s, typeName, b.repeats, repTypes, goNames[len(b.fields):])
+	}
+
+	src, err := format.Source([]byte(s.String()))
+	if err != nil {
+		panic(fmt.Sprintf("generated invalid go code: %s\n%s", err, s.String()))
+	}
+	_, err = w.Write(src)
+	return err
+}
+
+func writeGoFields(s *strings.Builder, fields []typedField, goNames []string) {
+	for i, f := range fields {
+		fmt.Fprintf(s, "%s %s `json:\"%s,omitempty\"`", goNames[i], f.goType, f.name)
+		if f.label != "" {
+			fmt.Fprintf(s, " // %s", comment(f.label))
+		}
+		s.WriteString("\n")
+	}
+}
+
+const goUnmarshalTmpl = `
+// UnmarshalJSON decodes a submission, with the fields
+// of repetitions suffixed by their index, like name__0.
+func (s *%[1]s) UnmarshalJSON(data []byte) error {
+	type fields %[1]s
+	if err := json.Unmarshal(data, (*fields)(s)); err != nil {
+		return err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	// unmarshalReps decodes the repetitions of a repeat as maps of their fields.
+	unmarshalReps := func(name string, fieldNames []string) ([]map[string]json.RawMessage, error) {
+		var n *float64
+		if data, ok := raw[name]; ok {
+			if err := json.Unmarshal(data, &n); err != nil {
+				return nil, err
+			}
+		}
+		if n == nil || *n < 0 {
+			return nil, nil
+		}
+		reps := make([]map[string]json.RawMessage, int(*n))
+		for r := range reps {
+			reps[r] = make(map[string]json.RawMessage)
+			for _, f := range fieldNames {
+				if data, ok := raw[f+"__"+strconv.Itoa(r)]; ok {
+					reps[r][f] = data
+				}
+			}
+		}
+		return reps, nil
+	}
+	var reps []map[string]json.RawMessage
+	var err error
+`
+
+const goUnmarshalRepTmpl = `
+	reps, err = unmarshalReps(%[2]q, %[3]s)
+	if err != nil {
+		return err
+	}
+	s.%[1]s = make([]%[4]s, len(reps))
+	for r, rep := range reps {
+		data, _ := json.Marshal(rep)
+		if err := json.Unmarshal(data, &s.%[1]s[r]); err != nil {
+			return err
+		}
+	}
+`
+
+const goMarshalTmpl = `
+// MarshalJSON encodes a submission, with the fields
+// of repetitions suffixed by their index, like name__0.
+func (s %[1]s) MarshalJSON() ([]byte, error) {
+	type fields %[1]s
+	data, err := json.Marshal(fields(s))
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	// addRep adds the fields of a repetition to raw.
+	addRep := func(rep interface{}, r int) error {
+		data, err := json.Marshal(rep)
+		if err != nil {
+			return err
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return err
+		}
+		for f, v := range fields {
+			raw[f+"__"+strconv.Itoa(r)] = v
+		}
+		return nil
+	}
+`
+
+const goMarshalRepTmpl = `
+	raw[%[2]q] = json.RawMessage(strconv.Itoa(len(s.%[1]s)))
+	for r := range s.%[1]s {
+		if err := addRep(&s.%[1]s[r], r); err != nil {
+			return nil, err
+		}
+	}
+`
+
+func writeGoRepeatMethods(s *strings.Builder, typeName string, repeats []typedRepeat, repTypes, goNames []string) {
+	fmt.Fprintf(s, goUnmarshalTmpl, typeName)
+	for i, r := range repeats {
+		var names []string
+		for _, f := range r.fields {
+			names = append(names, fmt.Sprintf("%q", f.name))
+		}
+		fmt.Fprintf(s, goUnmarshalRepTmpl, goNames[i], r.name, "[]string{"+strings.Join(names, ", ")+"}", repTypes[i])
+	}
+	s.WriteString("\treturn nil\n}\n")
+	fmt.Fprintf(s, goMarshalTmpl, typeName)
+	for i, r := range repeats {
+		fmt.Fprintf(s, goMarshalRepTmpl, goNames[i], r.name)
+	}
+	s.WriteString("\treturn json.Marshal(raw)\n}\n")
+}
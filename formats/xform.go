@@ -0,0 +1,624 @@
+package formats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// EncXForm writes the form in the XForm format used by ODK and Enketo.
+// Title is the title of the form and id its identifier.
+// The form is checked like in Convert, features that XForm lacks
+// (tables and formulas written in JavaScript) result in an error.
+func EncXForm(w io.Writer, xls *XlsForm, title, id string) error {
+	err := checkTypes(xls.Survey)
+	if err != nil {
+		return err
+	}
+	err = checkNames(xls.Survey)
+	if err != nil {
+		return err
+	}
+	_, err = preprocessGroups(xls.Survey)
+	if err != nil {
+		return err
+	}
+
+	b := xformBuilder{
+		xls:     xls,
+		langs:   sortedLangs(xls.LangSet),
+		paths:   make(map[string]string),
+		choices: make(map[string][]ChoicesRow),
+		itext:   make(map[string][]*xmlElem),
+	}
+	for _, row := range xls.Choices {
+		b.choices[row.ListName()] = append(b.choices[row.ListName()], row)
+	}
+	err = b.findPaths()
+	if err != nil {
+		return err
+	}
+	doc, err := b.build(title, id)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	bw.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	doc.write(bw, 0)
+	return bw.Flush()
+}
+
+const xformRoot = "/data"
+
+type xformBuilder struct {
+	xls     *XlsForm
+	langs   []string
+	paths   map[string]string // instance paths of the fields
+	choices map[string][]ChoicesRow
+	binds   []*xmlElem
+	// model elements other than the main instance and the binds
+	setvalues, instances []*xmlElem
+	itext                map[string][]*xmlElem // translations by language, "default" has no language
+}
+
+func xformErr(row Row, column, format string, a ...interface{}) error {
+	return row.errorf("unsupported-xform", column, format, a...)
+}
+
+func (b *xformBuilder) findPaths() error {
+	stack := []string{xformRoot}
+	for _, row := range b.xls.Survey {
+		parent := stack[len(stack)-1]
+		switch {
+		case row.Type == endGroup || row.Type == endRepeat:
+			stack = stack[:len(stack)-1]
+			continue
+		case row.Type == "table":
+			return xformErr(row.Row, "type", "Tables can't be converted to XForm.")
+		case row.Name() == "": // note
+			continue
+		}
+		path := parent + "/" + row.Name()
+		if _, ok := b.paths[row.Name()]; ok {
+			return xformErr(row.Row, "name", "Field name %q is used twice, XForm requires unique names.", row.Name())
+		}
+		b.paths[row.Name()] = path
+		if row.Type == beginGroup || row.Type == beginRepeat {
+			stack = append(stack, path)
+		}
+	}
+	return nil
+}
+
+func (b *xformBuilder) build(title, id string) (*xmlElem, error) {
+	data := elem("data", "id", id)
+	body := elem("h:body")
+	err := b.buildGroup(b.xls.Survey, xformRoot, data, body)
+	if err != nil {
+		return nil, err
+	}
+	data.add(elem("meta").add(elem("instanceID")))
+	b.binds = append(b.binds, elem("bind", "nodeset", xformRoot+"/meta/instanceID",
+		"type", "string", "readonly", "true()", "jr:preload", "uid"))
+
+	model := elem("model")
+	if len(b.langs) > 0 {
+		itext := elem("itext")
+		for _, lang := range append([]string{"default"}, b.langs...) {
+			tr := elem("translation", "lang", lang)
+			if lang == "default" {
+				tr.attr("default", "true()")
+			}
+			tr.children = b.itext[lang]
+			itext.add(tr)
+		}
+		model.add(itext)
+	}
+	model.add(elem("instance").add(data))
+	for _, inst := range b.instances {
+		model.add(inst)
+	}
+	for _, bind := range b.binds {
+		if len(bind.attrs) > 1 { // more than the nodeset
+			model.add(bind)
+		}
+	}
+	model.children = append(model.children, b.setvalues...)
+
+	html := elem("h:html",
+		"xmlns", "http://www.w3.org/2002/xforms",
+		"xmlns:h", "http://www.w3.org/1999/xhtml",
+		"xmlns:jr", "http://openrosa.org/javarosa",
+		"xmlns:odk", "http://www.opendatakit.org/xforms",
+	)
+	head := elem("h:head").add(elem("h:title").setText(title), model)
+	return html.add(head, body), nil
+}
+
+// buildGroup adds the rows of a group (without begin and end rows)
+// to the instance and body elements of the group.
+func (b *xformBuilder) buildGroup(survey []SurveyRow, path string, inst, body *xmlElem) error {
+	for i := 0; i < len(survey); i++ {
+		row := survey[i]
+		switch {
+		case row.Type == beginGroup || row.Type == beginRepeat:
+			end := groupEnd(survey, i)
+			err := b.buildNested(row, survey[i+1:end], inst, body)
+			if err != nil {
+				return err
+			}
+			i = end
+		case isIgnoredField(row.Type):
+			b.buildMetadata(row, inst)
+		default:
+			err := b.buildField(row, path, inst, body)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *xformBuilder) buildNested(row SurveyRow, survey []SurveyRow, inst, body *xmlElem) error {
+	path := b.paths[row.Name()]
+	groupInst := elem(row.Name())
+	inst.add(groupInst)
+	group := elem("group", "ref", path)
+	if row.Label("") != "" {
+		group.add(b.label("label", path+":label", row.Row, "label"))
+	}
+	if a := row.Appearance(); a != "" {
+		group.attr("appearance", a)
+	}
+	body.add(group)
+	bind, err := b.bind(row, path)
+	if err != nil {
+		return err
+	}
+	if row.ReadOnly() != "" && row.ReadOnly() != "no" && row.ReadOnly() != "false" {
+		ro := row.ReadOnly()
+		if ro == "yes" || ro == "true" {
+			ro = "true()"
+		} else if ro, err = b.xpath(row.Row, "readonly", ro); err != nil {
+			return err
+		}
+		bind.attr("readonly", ro)
+	}
+	groupBody := group
+	if row.Type == beginRepeat {
+		groupInst.attr("jr:template", "")
+		groupBody = elem("repeat", "nodeset", path)
+		if rc := row.RepeatCount(); rc != "" {
+			if _, ok := parseExcelUint(rc); !ok {
+				return row.errorf("invalid-repeat-count", "repeat_count", "repeat_count is not an unsigned integer.")
+			}
+			groupBody.attr("jr:count", rc)
+		}
+		group.add(groupBody)
+	}
+	return b.buildGroup(survey, path, groupInst, groupBody)
+}
+
+// xformPreloads are the metadata fields filled by the client.
+var xformPreloads = map[string][3]string{ // type, preload, preloadParams
+	"start":        {"dateTime", "timestamp", "start"},
+	"end":          {"dateTime", "timestamp", "end"},
+	"today":        {"date", "date", "today"},
+	"deviceid":     {"string", "property", "deviceid"},
+	"subscriberid": {"string", "property", "subscriberid"},
+	"simserial":    {"string", "property", "simserial"},
+	"phonenumber":  {"string", "property", "phonenumber"},
+	"username":     {"string", "property", "username"},
+	"email":        {"string", "property", "email"},
+}
+
+func (b *xformBuilder) buildMetadata(row SurveyRow, inst *xmlElem) {
+	p := xformPreloads[row.Type]
+	inst.add(elem(row.Name()))
+	b.binds = append(b.binds, elem("bind", "nodeset", b.paths[row.Name()],
+		"type", p[0], "jr:preload", p[1], "jr:preloadParams", p[2]))
+}
+
+var xformTypes = map[string]string{
+	"decimal": "decimal", "integer": "int", "text": "string", "boolean": "string",
+	"note": "string", "date": "date", "time": "time", "calculate": "string", "range": "int",
+	"barcode": "barcode", "geopoint": "geopoint", "file": "binary", "image": "binary",
+	"video": "binary", "audio": "binary",
+}
+
+var xformMediaTypes = map[string]string{
+	"file": "application/*", "image": "image/*", "video": "video/*", "audio": "audio/*",
+}
+
+func (b *xformBuilder) buildField(row SurveyRow, parent string, inst, body *xmlElem) error {
+	name := row.Name()
+	path := b.paths[name]
+	if name == "" { // note without name
+		name = fmt.Sprintf("note_line%d", row.LineNum)
+		path = parent + "/" + name
+	}
+	fieldInst := elem(name)
+	inst.add(fieldInst)
+
+	bind, err := b.bind(row, path)
+	if err != nil {
+		return err
+	}
+	typ := xformTypes[row.Type]
+	if isSelectOne(row.Type) || isSelectMultiple(row.Type) {
+		typ = "string"
+	}
+	bind.attr("type", typ)
+	if ro := row.ReadOnly(); ro == "yes" || ro == "true" || row.Type == "note" {
+		bind.attr("readonly", "true()")
+	}
+	if req := row.Required(); req == "yes" || req == "true" {
+		bind.attr("required", "true()")
+		if row.RequiredMessage("") != "" {
+			bind.attr("jr:requiredMsg", b.message(path+":jr:requiredMsg", row.Row, "required_message"))
+		}
+	} else if !requiredVals[req] {
+		return row.errorf("invalid-required", "required", `Invalid value %q in "required" column.`, req)
+	}
+	if con := row.Constraint(); con != "" {
+		xp, err := b.xpath(row.Row, "constraint", con)
+		if err != nil {
+			return err
+		}
+		bind.attr("constraint", xp)
+		if row.ConstraintMsg("") != "" {
+			bind.attr("jr:constraintMsg", b.message(path+":jr:constraintMsg", row.Row, "constraint_message"))
+		}
+	}
+	if def := row.Default(); def != "" {
+		err := b.defaultValue(row, path, def, fieldInst)
+		if err != nil {
+			return err
+		}
+	}
+	if row.Type == "calculate" {
+		xp, err := b.xpath(row.Row, "calculation", row.Calculation())
+		if err != nil {
+			return err
+		}
+		bind.attr("calculate", xp)
+		return nil // no control in the body
+	}
+
+	var ctl *xmlElem
+	switch {
+	case isSelectOne(row.Type) || row.Type == "boolean":
+		ctl = elem("select1", "ref", path)
+	case isSelectMultiple(row.Type):
+		ctl = elem("select", "ref", path)
+	case row.Type == "range":
+		start, end, step, err := parseRangeParams(row.Parameters())
+		if err != nil {
+			return row.errorf("invalid-parameters", "parameters", "%s", err)
+		}
+		ctl = elem("range", "ref", path, "start", strconv.Itoa(start),
+			"end", strconv.Itoa(end), "step", strconv.Itoa(step))
+	case xformMediaTypes[row.Type] != "":
+		ctl = elem("upload", "ref", path, "mediatype", xformMediaTypes[row.Type])
+	default:
+		ctl = elem("input", "ref", path)
+	}
+	if a := row.Appearance(); a != "" {
+		ctl.attr("appearance", a)
+	}
+	ctl.add(b.label("label", path+":label", row.Row, "label"))
+	if row.Hint("") != "" {
+		ctl.add(b.label("hint", path+":hint", row.Row, "hint"))
+	}
+	switch {
+	case row.Type == "boolean":
+		ctl.add(
+			elem("item").add(elem("label").setText("Yes"), elem("value").setText("true")),
+			elem("item").add(elem("label").setText("No"), elem("value").setText("false")),
+		)
+	case isSelectOne(row.Type) || isSelectMultiple(row.Type):
+		err := b.buildChoices(row, ctl)
+		if err != nil {
+			return err
+		}
+	}
+	body.add(ctl)
+	return nil
+}
+
+// bind creates the bind element of a row, with its relevance.
+func (b *xformBuilder) bind(row SurveyRow, path string) (*xmlElem, error) {
+	bind := elem("bind", "nodeset", path)
+	b.binds = append(b.binds, bind)
+	if rel := row.Relevant(); rel != "" {
+		xp, err := b.xpath(row.Row, "relevant", rel)
+		if err != nil {
+			return nil, err
+		}
+		bind.attr("relevant", xp)
+	}
+	return bind, nil
+}
+
+// defaultValue puts constant defaults in the instance,
+// and computes the others when the form is opened.
+func (b *xformBuilder) defaultValue(row SurveyRow, path, def string, inst *xmlElem) error {
+	if _, err := strconv.ParseFloat(def, 64); err == nil {
+		inst.setText(def)
+		return nil
+	}
+	if s, err := strconv.Unquote(def); err == nil && def[0] == '"' {
+		inst.setText(s)
+		return nil
+	}
+	xp, err := b.xpath(row.Row, "default", def)
+	if err != nil {
+		return err
+	}
+	b.setvalues = append(b.setvalues, elem("setvalue",
+		"event", "odk-instance-first-load", "ref", path, "value", xp))
+	return nil
+}
+
+func (b *xformBuilder) buildChoices(row SurveyRow, ctl *xmlElem) error {
+	list := choiceName(row.Type)
+	choices := b.choices[list]
+	filter := row.ChoiceFilter()
+	if filter == "" {
+		for i, c := range choices {
+			item := elem("item").add(
+				b.label("label", fmt.Sprintf("%s-%d", list, i), c.Row, "label"),
+				elem("value").setText(c.Name()),
+			)
+			ctl.add(item)
+		}
+		return nil
+	}
+
+	// With a choice filter, the choices go in a secondary instance
+	// and the filter is applied to them as predicate.
+	if !b.hasInstance(list) {
+		root := elem("root")
+		for i, c := range choices {
+			item := elem("item").add(
+				elem("itextId").setText(fmt.Sprintf("%s-%d", list, i)),
+				elem("name").setText(c.Name()),
+				elem("label").setText(c.Label("")),
+			)
+			for col, val := range c.UserDefCells() {
+				if isIdentifier(col) && col != "name" && col != "label" && col != "itextId" {
+					item.add(elem(col).setText(val))
+				}
+			}
+			sortChildren(item, 3)
+			root.add(item)
+			b.addItext(fmt.Sprintf("%s-%d", list, i), c.Row, "label")
+		}
+		b.instances = append(b.instances, elem("instance", "id", list).add(root))
+	}
+	xp, err := b.xpath(row.Row, "choice_filter", filter)
+	if err != nil {
+		return err
+	}
+	label := elem("label", "ref", "label")
+	if len(b.langs) > 0 {
+		label = elem("label", "ref", "jr:itext(itextId)")
+	}
+	ctl.add(elem("itemset", "nodeset", "instance('"+list+"')/root/item["+xp+"]").add(
+		elem("value", "ref", "name"), label,
+	))
+	return nil
+}
+
+func (b *xformBuilder) hasInstance(id string) bool {
+	for _, inst := range b.instances {
+		if inst.attrs[0].val == id {
+			return true
+		}
+	}
+	return false
+}
+
+// label creates the label or hint of a control from a column of row.
+// With translations, the text goes in itext under the given id.
+func (b *xformBuilder) label(name, id string, row Row, column string) *xmlElem {
+	if len(b.langs) == 0 {
+		return elem(name).setInner(b.labelXML(row.text(column)))
+	}
+	b.addItext(id, row, column)
+	return elem(name, "ref", "jr:itext('"+id+"')")
+}
+
+// addItext adds the translations of a column of row, if the form has languages.
+func (b *xformBuilder) addItext(id string, row Row, column string) {
+	if len(b.langs) == 0 {
+		return
+	}
+	def := row.text(column)
+	b.itext["default"] = append(b.itext["default"], elem("text", "id", id).add(
+		elem("value").setInner(b.labelXML(def))))
+	for _, lang := range b.langs {
+		text := row.langCell(column, lang)
+		if text == "" {
+			text = def
+		}
+		b.itext[lang] = append(b.itext[lang], elem("text", "id", id).add(
+			elem("value").setInner(b.labelXML(text))))
+	}
+}
+
+// message returns the value of the attributes jr:constraintMsg and jr:requiredMsg.
+func (b *xformBuilder) message(id string, row Row, column string) string {
+	if len(b.langs) == 0 {
+		return row.text(column)
+	}
+	b.addItext(id, row, column)
+	return "jr:itext('" + id + "')"
+}
+
+// labelXML escapes a label, replacing the references ${name} with output elements.
+func (b *xformBuilder) labelXML(s string) string {
+	var sb strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		j := -1
+		if i != -1 {
+			j = strings.IndexByte(s[i:], '}')
+		}
+		if j == -1 {
+			xmlEscape(&sb, s)
+			return sb.String()
+		}
+		j += i
+		path, ok := b.paths[strings.TrimSpace(s[i+2:j])]
+		if !ok || path == "" {
+			xmlEscape(&sb, s[:j+1])
+		} else {
+			xmlEscape(&sb, s[:i])
+			sb.WriteString(`<output value="`)
+			xmlEscape(&sb, path)
+			sb.WriteString(`"/>`)
+		}
+		s = s[j+1:]
+	}
+}
+
+// xpath converts an xlsform formula to XPath, replacing
+// the references ${name} with the path of the field in the instance.
+func (b *xformBuilder) xpath(row Row, column, formula string) (string, error) {
+	if strings.HasPrefix(formula, "js:") {
+		return "", xformErr(row, column, "Formulas written in JavaScript can't be converted to XForm.")
+	}
+	var sb strings.Builder
+	rs := []rune(formula)
+	for i := 0; i < len(rs); i++ {
+		switch r := rs[i]; {
+		case r == '"' || r == '\'':
+			j := i + 1
+			for j < len(rs) && rs[j] != r {
+				j++
+			}
+			if j == len(rs) {
+				return "", row.errorf("invalid-formula", column, "Unterminated string in formula.")
+			}
+			sb.WriteString(string(rs[i : j+1]))
+			i = j
+		case r == '$' && i+1 < len(rs) && rs[i+1] == '{':
+			j := i + 2
+			for j < len(rs) && rs[j] != '}' {
+				j++
+			}
+			if j == len(rs) {
+				return "", row.errorf("invalid-formula", column, "Unterminated reference in formula.")
+			}
+			name := strings.TrimSpace(string(rs[i+2 : j]))
+			path, ok := b.paths[name]
+			if !ok || path == "" {
+				return "", row.errorf("invalid-formula", column, "Reference to unknown field %q.", name)
+			}
+			sb.WriteString(path)
+			i = j
+		case unicode.IsLetter(r) || r == '_':
+			j := i
+			for j < len(rs) && (unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j]) || strings.ContainsRune("_-.:", rs[j])) {
+				j++
+			}
+			word := string(rs[i:j])
+			if word == "True" || word == "False" {
+				word = strings.ToLower(word) + "()"
+			}
+			sb.WriteString(word)
+			i = j - 1
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String(), nil
+}
+
+// xmlElem is a minimal representation of XML elements,
+// allowing namespace prefixes as they are written.
+type xmlElem struct {
+	name     string
+	attrs    []xmlAttr
+	text     string // escaped when written
+	inner    string // raw xml
+	children []*xmlElem
+}
+
+type xmlAttr struct{ name, val string }
+
+// elem creates an element with the given attribute names and values.
+func elem(name string, attrs ...string) *xmlElem {
+	e := &xmlElem{name: name}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		e.attr(attrs[i], attrs[i+1])
+	}
+	return e
+}
+
+func (e *xmlElem) attr(name, val string) *xmlElem {
+	e.attrs = append(e.attrs, xmlAttr{name, val})
+	return e
+}
+
+func (e *xmlElem) add(children ...*xmlElem) *xmlElem {
+	e.children = append(e.children, children...)
+	return e
+}
+
+func (e *xmlElem) setText(text string) *xmlElem {
+	e.text = text
+	return e
+}
+
+func (e *xmlElem) setInner(inner string) *xmlElem {
+	e.inner = inner
+	return e
+}
+
+// sortChildren sorts the children of e by name, starting from index from.
+func sortChildren(e *xmlElem, from int) {
+	c := e.children[from:]
+	for i := 1; i < len(c); i++ {
+		for j := i; j > 0 && c[j].name < c[j-1].name; j-- {
+			c[j], c[j-1] = c[j-1], c[j]
+		}
+	}
+}
+
+func (e *xmlElem) write(w *bufio.Writer, depth int) {
+	indent := strings.Repeat("\t", depth)
+	w.WriteString(indent)
+	w.WriteByte('<')
+	w.WriteString(e.name)
+	for _, a := range e.attrs {
+		w.WriteString(" " + a.name + `="`)
+		xmlEscape(w, a.val)
+		w.WriteByte('"')
+	}
+	switch {
+	case len(e.children) > 0:
+		w.WriteString(">\n")
+		for _, c := range e.children {
+			c.write(w, depth+1)
+		}
+		w.WriteString(indent)
+	case e.text != "" || e.inner != "":
+		w.WriteByte('>')
+		xmlEscape(w, e.text)
+		w.WriteString(e.inner)
+	default:
+		w.WriteString("/>\n")
+		return
+	}
+	w.WriteString("</" + e.name + ">\n")
+}
+
+var xmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "\n", "&#10;")
+
+func xmlEscape(w io.Writer, s string) { xmlEscaper.WriteString(w, s) }
@@ -3,45 +3,53 @@ package formats
 import (
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
-
-	"github.com/extrame/xls"
-	"github.com/tealeg/xlsx"
+	"time"
 )
 
 type XlsForm struct {
 	Survey   []SurveyRow
 	Choices  []ChoicesRow
 	Settings []SettingsRow
-	Tables   map[string][][]string
+	Tests    []TestsRow
+	Tables   map[string][][]Cell
 	LangSet  map[string]bool
+	Warnings []Diagnostic
 }
 
 type Row struct {
-	cells   map[string]string
+	cells   map[string]Cell
 	LineNum int
+	sheet   string
+	head    []string // column names of the sheet, to locate diagnostics
 }
 
-func makeRow(keyIsValid func(string) bool, keyVals ...string) Row {
+func makeRow(sheet string, keyIsValid func(string) bool, keyVals ...string) Row {
 	var row Row
-	row.cells = make(map[string]string)
+	row.sheet = sheet
+	row.cells = make(map[string]Cell)
 	for k, v := 0, 1; v < len(keyVals); k, v = k+2, v+2 {
 		key := keyVals[k]
 		if !keyIsValid(key) {
 			panic(fmt.Sprintf("Invalid column %q in row", key))
 		}
-		row.cells[key] = keyVals[v]
+		row.cells[key] = stringCell(keyVals[v])
 	}
 	return row
 }
 
+func (r Row) text(name string) string    { return r.cells[name].String() }
+func (r Row) formula(name string) string { return r.cells[name].formulaText() }
+
 func (r Row) langCell(name, lang string) string {
 	if lang == "" {
-		return r.cells[name]
+		return r.text(name)
 	}
-	return r.cells[name+"::"+lang]
+	return r.text(name + "::" + lang)
 }
 
 type SurveyRow struct {
@@ -52,8 +60,8 @@ type SurveyRow struct {
 }
 
 func MakeSurveyRow(keyVals ...string) SurveyRow {
-	row := makeRow(isSurveyCol, keyVals...)
-	return SurveyRow{row, row.cells["type"]}
+	row := makeRow("survey", isSurveyCol, keyVals...)
+	return SurveyRow{row, row.text("type")}
 }
 
 var surveyCols = map[string]bool{
@@ -69,41 +77,41 @@ func isSurveyCol(name string) bool {
 		strings.HasPrefix(name, "hint") || strings.HasPrefix(name, "constraint_message")
 }
 
-func (r SurveyRow) Name() string                       { return r.cells["name"] }
+func (r SurveyRow) Name() string                       { return r.text("name") }
 func (r SurveyRow) Label(lang string) string           { return r.langCell("label", lang) }
 func (r SurveyRow) Hint(lang string) string            { return r.langCell("hint", lang) }
-func (r SurveyRow) Relevant() string                   { return r.cells["relevant"] }
-func (r SurveyRow) PermissionsRelevant() string        { return r.cells["permissions_relevant"] }
-func (r SurveyRow) Default() string                    { return r.cells["default"] }
-func (r SurveyRow) ReadOnly() string                   { return r.cells["readonly"] }
-func (r SurveyRow) Constraint() string                 { return r.cells["constraint"] }
+func (r SurveyRow) Relevant() string                   { return r.formula("relevant") }
+func (r SurveyRow) PermissionsRelevant() string        { return r.formula("permissions_relevant") }
+func (r SurveyRow) Default() string                    { return r.formula("default") }
+func (r SurveyRow) ReadOnly() string                   { return r.text("readonly") }
+func (r SurveyRow) Constraint() string                 { return r.formula("constraint") }
 func (r SurveyRow) ConstraintMsg(lang string) string   { return r.langCell("constraint_message", lang) }
-func (r SurveyRow) Calculation() string                { return r.cells["calculation"] }
-func (r SurveyRow) Required() string                   { return r.cells["required"] }
+func (r SurveyRow) Calculation() string                { return r.formula("calculation") }
+func (r SurveyRow) Required() string                   { return r.text("required") }
 func (r SurveyRow) RequiredMessage(lang string) string { return r.langCell("required_message", lang) }
-func (r SurveyRow) RepeatCount() string                { return r.cells["repeat_count"] }
-func (r SurveyRow) ChoiceFilter() string               { return r.cells["choice_filter"] }
-func (r SurveyRow) Parameters() string                 { return r.cells["parameters"] }
-func (r SurveyRow) Appearance() string                 { return r.cells["appearance"] }
+func (r SurveyRow) RepeatCount() string                { return r.text("repeat_count") }
+func (r SurveyRow) ChoiceFilter() string               { return r.formula("choice_filter") }
+func (r SurveyRow) Parameters() string                 { return r.text("parameters") }
+func (r SurveyRow) Appearance() string                 { return r.text("appearance") }
 
 type ChoicesRow struct{ Row }
 
 func MakeChoicesRow(keyVals ...string) ChoicesRow {
-	return ChoicesRow{makeRow(isChoicesCol, keyVals...)}
+	return ChoicesRow{makeRow("choices", isChoicesCol, keyVals...)}
 }
 
 func isChoicesCol(name string) bool {
 	return name == "list name" || name == "name" || strings.HasPrefix(name, "label")
 }
 
-func (r ChoicesRow) ListName() string         { return r.cells["list name"] }
-func (r ChoicesRow) Name() string             { return r.cells["name"] }
+func (r ChoicesRow) ListName() string         { return r.text("list name") }
+func (r ChoicesRow) Name() string             { return r.text("name") }
 func (r ChoicesRow) Label(lang string) string { return r.langCell("label", lang) }
 func (r ChoicesRow) UserDefCells() map[string]string {
 	ud := make(map[string]string)
 	for k, v := range r.cells {
 		if !isChoicesCol(k) {
-			ud[k] = v
+			ud[k] = v.String()
 		}
 	}
 	return ud
@@ -112,15 +120,36 @@ func (r ChoicesRow) UserDefCells() map[string]string {
 type SettingsRow struct{ Row }
 
 func MakeSettingsRow(keyVals ...string) SettingsRow {
-	return SettingsRow{makeRow(isSettingsCol, keyVals...)}
+	return SettingsRow{makeRow("settings", isSettingsCol, keyVals...)}
 }
 
 func isSettingsCol(name string) bool {
 	return name == "tag label" || name == "tag value"
 }
 
-func (r SettingsRow) TagLabel() string { return r.cells["tag label"] }
-func (r SettingsRow) TagValue() string { return r.cells["tag value"] }
+func (r SettingsRow) TagLabel() string { return r.text("tag label") }
+func (r SettingsRow) TagValue() string { return r.text("tag value") }
+
+// TestsRow is a row of the optional tests sheet, where each row
+// gives an answer or an expectation about a field in a scenario.
+type TestsRow struct{ Row }
+
+func MakeTestsRow(keyVals ...string) TestsRow {
+	return TestsRow{makeRow("tests", isTestsCol, keyVals...)}
+}
+
+var testsCols = map[string]bool{
+	"scenario": true, "field": true, "answer": true, "visible": true, "value": true, "failure": true,
+}
+
+func isTestsCol(name string) bool { return testsCols[name] }
+
+func (r TestsRow) Scenario() string { return r.text("scenario") }
+func (r TestsRow) Field() string    { return r.text("field") }
+func (r TestsRow) Answer() string   { return r.text("answer") }
+func (r TestsRow) Visible() string  { return r.text("visible") }
+func (r TestsRow) Value() string    { return r.text("value") }
+func (r TestsRow) Failure() string  { return r.text("failure") }
 
 type File interface {
 	io.Reader
@@ -130,17 +159,18 @@ type File interface {
 
 func DecXlsform(wb WorkBook) (*XlsForm, error) {
 	var form XlsForm
-	for _, sheetName := range []string{"survey", "choices", "settings"} {
-		rows := wb.Rows(sheetName)
+	for _, sheetName := range []string{"survey", "choices", "settings", "tests"} {
+		rows := wb.Cells(sheetName)
 		canonicalize(rows)
 		headIndex := firstNonempty(rows)
-		if headIndex == -1 && sheetName == "settings" {
-			continue // ok, settings sheet is optional
+		if headIndex == -1 && (sheetName == "settings" || sheetName == "tests") {
+			continue // ok, settings and tests sheets are optional
 		}
 		if headIndex == -1 {
-			return nil, fmt.Errorf("Mandatory sheet %q missing or empty.", sheetName)
+			return nil, &Diagnostic{Rule: "missing-sheet", Severity: SevError, Sheet: sheetName,
+				Message: fmt.Sprintf("Mandatory sheet %q missing or empty.", sheetName)}
 		}
-		head := rows[headIndex]
+		head := rowText(rows[headIndex])
 		if sheetName == "survey" || sheetName == "choices" {
 			form.LangSet = mergeSets(form.LangSet, langSet(head))
 		}
@@ -149,58 +179,74 @@ func DecXlsform(wb WorkBook) (*XlsForm, error) {
 				continue
 			}
 			var destRow Row
-			destRow.cells = make(map[string]string)
+			destRow.cells = make(map[string]Cell)
 			destRow.LineNum = i + 1
+			destRow.sheet = sheetName
+			destRow.head = head
 			for j, cell := range rows[i] {
+				if j >= len(head) {
+					break
+				}
 				colName := head[j]
-				if colName != "" && cell != "" {
+				if colName != "" && cell.Type != CellEmpty {
 					destRow.cells[colName] = cell
 				}
 			}
 			switch sheetName {
 			case "survey":
-				form.Survey = append(form.Survey, SurveyRow{destRow, destRow.cells["type"]})
+				form.Survey = append(form.Survey, SurveyRow{destRow, destRow.text("type")})
 			case "choices":
 				form.Choices = append(form.Choices, ChoicesRow{destRow})
 			case "settings":
 				form.Settings = append(form.Settings, SettingsRow{destRow})
+			case "tests":
+				form.Tests = append(form.Tests, TestsRow{destRow})
 			}
 		}
 	}
-	form.Tables = make(map[string][][]string)
+	form.Tables = make(map[string][][]Cell)
 	for _, row := range form.Survey {
 		if row.Type == "table" {
 			name := row.Name()
-			tab := wb.Rows(name)
+			tab := wb.Cells(name)
 			if tab == nil {
-				return nil, fmt.Errorf("No sheet for table %q.", name)
+				return nil, row.errorf("missing-sheet", "name", "No sheet for table %q.", name)
 			}
 			form.Tables[name] = tab
 		}
 	}
+	form.Warnings = wb.Warnings()
 	return &form, nil
 }
 
-func canonicalize(rows [][]string) {
+func canonicalize(rows [][]Cell) {
 	for _, row := range rows {
-		for i, cell := range row {
+		for i := range row {
+			if row[i].Type != CellString {
+				continue
+			}
+			cell := &row[i].Str
 			switch {
-			case cell == "list_name":
-				row[i] = "list name"
-			case cell == "begin_group":
-				row[i] = "begin group"
-			case cell == "end_group":
-				row[i] = "end group"
-			case strings.HasPrefix(cell, "select one"):
-				row[i] = strings.Replace(cell, "select one", "select_one", 1)
-			case strings.HasPrefix(cell, "select multiple"):
-				row[i] = strings.Replace(cell, "select multiple", "select_multiple", 1)
+			case *cell == "list_name":
+				*cell = "list name"
+			case *cell == "begin_group":
+				*cell = "begin group"
+			case *cell == "end_group":
+				*cell = "end group"
+			case strings.HasPrefix(*cell, "select one"):
+				*cell = strings.Replace(*cell, "select one", "select_one", 1)
+			case strings.HasPrefix(*cell, "select multiple"):
+				*cell = strings.Replace(*cell, "select multiple", "select_multiple", 1)
 			}
 		}
 	}
 }
 
 func DecXlsFromFile(fileName string) (*XlsForm, error) {
+	return DecXlsFromFileOptions(fileName, WorkBookOptions{})
+}
+
+func DecXlsFromFileOptions(fileName string, opts WorkBookOptions) (*XlsForm, error) {
 	f, err := os.Open(fileName)
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't open file: %s", err)
@@ -211,7 +257,7 @@ func DecXlsFromFile(fileName string) (*XlsForm, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't get file stat: %s", err)
 	}
-	wb, err := NewWorkBook(f, filepath.Ext(fileName), stat.Size())
+	wb, err := NewWorkBookOptions(f, filepath.Ext(fileName), stat.Size(), opts)
 	if err != nil {
 		return nil, err
 	}
@@ -219,115 +265,352 @@ func DecXlsFromFile(fileName string) (*XlsForm, error) {
 }
 
 type WorkBook interface {
-	Rows(sheetName string) [][]string
+	// Cells returns the content of a sheet, nil if the sheet doesn't exist.
+	// Rows end with their last non-empty cell, empty rows may be nil.
+	Cells(sheetName string) [][]Cell
+	// Warnings returns the problems found reading the sheets so far.
+	Warnings() []Diagnostic
 }
 
-type xlsxWorkBook struct {
-	xlsx.File
+type WorkBookOptions struct {
+	// ExpandMerged copies the value of merged cells
+	// to all the cells of the merged range.
+	ExpandMerged bool
+	Hidden       HiddenPolicy
 }
 
-// When we find more than 50 consecutive empty rows in a sheet,
-// we assume the rest of the sheet is empty and truncate it.
-const maxConsecEmptyRows = 50
+// HiddenPolicy specifies how hidden sheets, rows and columns are read.
+type HiddenPolicy int
 
-func (wb *xlsxWorkBook) Rows(sheetName string) [][]string {
-	sheet, ok := wb.Sheet[sheetName]
-	if !ok {
-		return nil
+const (
+	HiddenKeep HiddenPolicy = iota // read as if they were visible
+	HiddenSkip                     // hidden sheets are missing, hidden rows and columns are empty
+	HiddenWarn                     // read as visible, with a warning if they aren't empty
+)
+
+// sheetLayout describes the sheet properties that are relevant to WorkBookOptions.
+type sheetLayout struct {
+	hidden     bool
+	hiddenRows map[int]bool
+	hiddenCols map[int]bool
+	merged     []cellRange
+}
+
+// cellRange is an inclusive range of cells.
+type cellRange struct {
+	firstRow, lastRow, firstCol, lastCol int
+}
+
+// workBookBase implements the options and the warnings common to all workbooks.
+type workBookBase struct {
+	opts     WorkBookOptions
+	warnings []Diagnostic
+}
+
+// sparseSheet collects the non-empty cells of a sheet.
+type sparseSheet map[[2]int]Cell
+
+func (s *sparseSheet) set(row, col int, c Cell) {
+	if *s == nil {
+		*s = make(sparseSheet)
 	}
-	rows := make([][]string, sheet.MaxRow+1)
-	numCols := sheet.MaxCol + 1
-	consecEmptyRows := 0
-	for i := range rows {
-		rows[i] = make([]string, numCols)
-		for j := range rows[i] {
-			rows[i][j] = sheet.Cell(i, j).Value
+	(*s)[[2]int{row, col}] = c
+}
+
+// rows returns the cells of the sheet, the length of each row
+// is given by its last non-empty cell.
+func (s sparseSheet) rows() [][]Cell {
+	numCols := make(map[int]int)
+	numRows := 0
+	for pos, c := range s {
+		if c.Type == CellEmpty {
+			continue
 		}
-		if isEmpty(rows[i]) {
-			consecEmptyRows++
-		} else {
-			consecEmptyRows = 0
+		if pos[0] >= numRows {
+			numRows = pos[0] + 1
 		}
-		if consecEmptyRows > maxConsecEmptyRows {
-			return rows[0 : i+1]
+		if pos[1] >= numCols[pos[0]] {
+			numCols[pos[0]] = pos[1] + 1
+		}
+	}
+	rows := make([][]Cell, numRows)
+	for i, n := range numCols {
+		rows[i] = make([]Cell, n)
+	}
+	for pos, c := range s {
+		if c.Type != CellEmpty {
+			rows[pos[0]][pos[1]] = c
 		}
 	}
 	return rows
 }
 
-type xlsWorkBook struct {
-	xls.WorkBook
+func (wb *workBookBase) Warnings() []Diagnostic { return wb.warnings }
+
+// warn adds a warning about a sheet; row and col are 0-based, -1 if unknown.
+func (wb *workBookBase) warn(rule, sheetName string, row, col int, format string, a ...interface{}) {
+	wb.warnings = append(wb.warnings, Diagnostic{
+		Rule:     rule,
+		Severity: SevWarning,
+		Sheet:    sheetName,
+		Row:      row + 1,
+		Col:      col + 1,
+		Message:  fmt.Sprintf(format, a...),
+	})
 }
 
-func (wb *xlsWorkBook) Rows(sheetName string) [][]string {
-	var sheet *xls.WorkSheet
-	for i := 0; i < wb.NumSheets(); i++ {
-		if s := wb.GetSheet(i); s.Name == sheetName {
-			sheet = s
-			break
+// sheetVisible reports whether a sheet must be read.
+func (wb *workBookBase) sheetVisible(sheetName string, l *sheetLayout) bool {
+	if !l.hidden {
+		return true
+	}
+	switch wb.opts.Hidden {
+	case HiddenSkip:
+		return false
+	case HiddenWarn:
+		wb.warn("hidden-content", sheetName, -1, -1, "Sheet %q is hidden.", sheetName)
+	}
+	return true
+}
+
+// applyOptions modifies rows, as read from a sheet, according to the workbook options.
+func (wb *workBookBase) applyOptions(sheetName string, rows [][]Cell, l *sheetLayout) [][]Cell {
+	if wb.opts.ExpandMerged {
+		rows = expandMerged(rows, l.merged)
+	}
+	if wb.opts.Hidden == HiddenKeep {
+		return rows
+	}
+	for i := range rows {
+		if !l.hiddenRows[i] || isEmpty(rows[i]) {
+			continue
+		}
+		if wb.opts.Hidden == HiddenWarn {
+			wb.warn("hidden-content", sheetName, i, -1, "Row is hidden.")
+			continue
+		}
+		for j := range rows[i] {
+			rows[i][j] = Cell{}
 		}
 	}
-	if sheet == nil {
-		return nil
+	numCols := 0
+	for _, row := range rows {
+		if len(row) > numCols {
+			numCols = len(row)
+		}
+	}
+	for j := 0; j < numCols; j++ {
+		if !l.hiddenCols[j] {
+			continue
+		}
+		empty := true
+		for i := range rows {
+			if j < len(rows[i]) && rows[i][j].Type != CellEmpty {
+				empty = false
+				if wb.opts.Hidden == HiddenSkip {
+					rows[i][j] = Cell{}
+				}
+			}
+		}
+		if !empty && wb.opts.Hidden == HiddenWarn {
+			wb.warn("hidden-content", sheetName, -1, j, "Column %s is hidden.", ColumnName(j))
+		}
 	}
-	rows := make([][]string, sheet.MaxRow+1)
+	return rows
+}
+
+// expandMerged copies the value of merged ranges to their cells. Ranges are
+// clamped to the rows and columns containing data, so that a merge over
+// whole rows or columns doesn't allocate millions of cells.
+func expandMerged(rows [][]Cell, merged []cellRange) [][]Cell {
 	numCols := 0
-	for i := range rows {
-		if row := sheet.Row(i); row != nil && row.LastCol()+1 > numCols {
-			numCols = row.LastCol() + 1
+	for _, row := range rows {
+		if len(row) > numCols {
+			numCols = len(row)
 		}
 	}
-	consecEmptyRows := 0
-	for i := range rows {
-		rows[i] = make([]string, numCols)
-		row := sheet.Row(i)
-		if row == nil {
+	for _, r := range merged {
+		if r.firstRow >= len(rows) || r.firstCol >= len(rows[r.firstRow]) {
 			continue
 		}
-		for j := range rows[i] {
-			rows[i][j] = row.Col(j)
+		val := rows[r.firstRow][r.firstCol]
+		if val.Type == CellEmpty {
+			continue
+		}
+		lastRow, lastCol := r.lastRow, r.lastCol
+		if lastRow >= len(rows) {
+			lastRow = len(rows) - 1
 		}
-		if isEmpty(rows[i]) {
-			consecEmptyRows++
-		} else {
-			consecEmptyRows = 0
+		if lastCol >= numCols {
+			lastCol = numCols - 1
 		}
-		if consecEmptyRows > maxConsecEmptyRows {
-			return rows[0 : i+1]
+		for i := r.firstRow; i <= lastRow; i++ {
+			if n := lastCol + 1 - len(rows[i]); n > 0 {
+				rows[i] = append(rows[i], make([]Cell, n)...)
+			}
+			for j := r.firstCol; j <= lastCol; j++ {
+				rows[i][j] = val
+			}
 		}
 	}
 	return rows
 }
 
+// ColumnName returns the excel name of the column with index j (0 is "A").
+func ColumnName(j int) string {
+	name := ""
+	for j++; j > 0; j = (j - 1) / 26 {
+		name = string(rune('A'+(j-1)%26)) + name
+	}
+	return name
+}
+
+type CellType int
+
+const (
+	CellEmpty CellType = iota
+	CellString
+	CellNumber
+	CellBool
+	CellDate
+)
+
+// Cell is the typed value of a workbook cell.
+// Cells containing an excel formula hold its cached value.
+type Cell struct {
+	Type CellType
+	Str  string
+	Num  float64
+	Bool bool
+	Time time.Time
+
+	IsFormula bool
+}
+
+func stringCell(s string) Cell {
+	if s == "" {
+		return Cell{}
+	}
+	return Cell{Type: CellString, Str: s}
+}
+
+// String returns a representation of the cell value
+// which doesn't depend on the locale of the workbook.
+func (c Cell) String() string {
+	switch c.Type {
+	case CellString:
+		return c.Str
+	case CellNumber:
+		return strconv.FormatFloat(c.Num, 'f', -1, 64)
+	case CellBool:
+		return strconv.FormatBool(c.Bool)
+	case CellDate:
+		switch {
+		case c.Time.Year() < 1900: // time of day only
+			return c.Time.Format("15:04:05")
+		case c.Time.Hour() == 0 && c.Time.Minute() == 0 && c.Time.Second() == 0:
+			return c.Time.Format("2006-01-02")
+		default:
+			return c.Time.Format("2006-01-02T15:04:05")
+		}
+	}
+	return ""
+}
+
+// formulaText returns the cell value as an xlsform formula.
+func (c Cell) formulaText() string {
+	switch c.Type {
+	case CellBool:
+		if c.Bool {
+			return "True"
+		}
+		return "False"
+	case CellDate:
+		return strconv.Quote(c.String())
+	}
+	return c.String()
+}
+
+func rowText(row []Cell) []string {
+	text := make([]string, len(row))
+	for i, cell := range row {
+		text[i] = cell.String()
+	}
+	return text
+}
+
+// excelTime converts an excel serial date to time.
+func excelTime(serial float64, date1904 bool) time.Time {
+	// Dates in the 1900 system start from 1899-12-30
+	// because of excel considering 1900 as a leap year.
+	epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	if date1904 {
+		epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	if serial < 1 { // time of day only
+		epoch = time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	days := math.Floor(serial)
+	ms := math.Round((serial - days) * 24 * 60 * 60 * 1000)
+	return epoch.AddDate(0, 0, int(days)).Add(time.Duration(ms) * time.Millisecond)
+}
+
+// isDateFormat reports whether an excel number format code displays a date or time.
+func isDateFormat(code string) bool {
+	if i := strings.IndexByte(code, ';'); i != -1 {
+		code = code[:i]
+	}
+	inQuotes, inBrackets := false, false
+	for i := 0; i < len(code); i++ {
+		ch := code[i]
+		switch {
+		case inQuotes:
+			inQuotes = ch != '"'
+		case inBrackets:
+			inBrackets = ch != ']'
+		case ch == '"':
+			inQuotes = true
+		case ch == '[':
+			// [h], [mm] and [ss] are elapsed times, other brackets are colors or locales.
+			if j := strings.IndexByte(code[i:], ']'); j != -1 &&
+				strings.Trim(strings.ToLower(code[i+1:i+j]), "hms") == "" && j > 1 {
+				return true
+			}
+			inBrackets = true
+		case ch == '\\' || ch == '_' || ch == '*':
+			i++ // skip the next character
+		case strings.IndexByte("ymdhsYMDHS", ch) != -1:
+			return true
+		}
+	}
+	return false
+}
+
 func NewWorkBook(f File, ext string, size int64) (WorkBook, error) {
+	return NewWorkBookOptions(f, ext, size, WorkBookOptions{})
+}
+
+func NewWorkBookOptions(f File, ext string, size int64, opts WorkBookOptions) (WorkBook, error) {
 	switch ext {
 	case ".xls":
-		wb, err := xls.OpenReader(f, "utf-8")
-		if err != nil {
-			return nil, err
-		}
-		return &xlsWorkBook{*wb}, nil
+		return openXls(f, opts)
 	case ".xlsx":
-		wb, err := xlsx.OpenReaderAt(f, size)
-		if err != nil {
-			return nil, err
-		}
-		return &xlsxWorkBook{*wb}, nil
+		return openXlsx(f, size, opts)
 	default:
 		return nil, fmt.Errorf("Unsupported excel file type %s.", ext)
 	}
 }
 
-func isEmpty(row []string) bool {
+func isEmpty(row []Cell) bool {
 	for _, cell := range row {
-		if cell != "" {
+		if cell.Type != CellEmpty {
 			return false
 		}
 	}
 	return true
 }
 
-func firstNonempty(rows [][]string) int {
+func firstNonempty(rows [][]Cell) int {
 	for i, row := range rows {
 		if !isEmpty(row) {
 			return i
@@ -0,0 +1,421 @@
+package formats
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The xlsx reader decodes the sheet xml as a stream,
+// keeping only the non-empty cells in memory.
+// Sheets are read only when requested.
+// Specification: ECMA-376 Office Open XML, SpreadsheetML.
+
+type xlsxSheet struct {
+	name   string
+	file   *zip.File
+	hidden bool
+}
+
+type xlsxWorkBook struct {
+	workBookBase
+	zip      *zip.Reader
+	date1904 bool
+	sheets   []xlsxSheet
+
+	// Shared strings and styles are loaded with the first sheet.
+	loaded      bool
+	sstFile     *zip.File
+	stylesFile  *zip.File
+	sst         []string
+	xfFormat    []int          // number format of each cell style
+	formatCodes map[int]string // user-defined number formats
+}
+
+const (
+	relSharedStrings = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/sharedStrings"
+	relStyles        = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles"
+)
+
+func openXlsx(f io.ReaderAt, size int64, opts WorkBookOptions) (*xlsxWorkBook, error) {
+	z, err := zip.NewReader(f, size)
+	if err != nil {
+		return nil, err
+	}
+	wb := &xlsxWorkBook{workBookBase: workBookBase{opts: opts}, zip: z}
+	files := make(map[string]*zip.File)
+	for _, f := range z.File {
+		files[f.Name] = f
+	}
+
+	var workbook struct {
+		Pr struct {
+			Date1904 string `xml:"date1904,attr"`
+		} `xml:"workbookPr"`
+		Sheets []struct {
+			Name  string `xml:"name,attr"`
+			State string `xml:"state,attr"`
+			Id    string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	err = decodeZipXml(files["xl/workbook.xml"], &workbook)
+	if err != nil {
+		return nil, err
+	}
+	wb.date1904 = workbook.Pr.Date1904 == "1" || workbook.Pr.Date1904 == "true"
+
+	var rels struct {
+		Rels []struct {
+			Id     string `xml:",attr"`
+			Type   string `xml:",attr"`
+			Target string `xml:",attr"`
+		} `xml:"Relationship"`
+	}
+	err = decodeZipXml(files["xl/_rels/workbook.xml.rels"], &rels)
+	if err != nil {
+		return nil, err
+	}
+	targets := make(map[string]*zip.File)
+	for _, rel := range rels.Rels {
+		target := path.Join("xl", rel.Target)
+		if strings.HasPrefix(rel.Target, "/") {
+			target = rel.Target[1:]
+		}
+		targets[rel.Id] = files[target]
+		switch rel.Type {
+		case relSharedStrings:
+			wb.sstFile = files[target]
+		case relStyles:
+			wb.stylesFile = files[target]
+		}
+	}
+	for _, s := range workbook.Sheets {
+		if targets[s.Id] == nil {
+			continue // chartsheet or missing part
+		}
+		wb.sheets = append(wb.sheets, xlsxSheet{
+			name:   s.Name,
+			file:   targets[s.Id],
+			hidden: s.State == "hidden" || s.State == "veryHidden",
+		})
+	}
+	return wb, nil
+}
+
+func decodeZipXml(f *zip.File, v interface{}) error {
+	if f == nil {
+		return errors.New("Invalid xlsx file: missing workbook part.")
+	}
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return xml.NewDecoder(r).Decode(v)
+}
+
+// forEachElem streams the xml file f, calling fn for each start element.
+func forEachElem(f *zip.File, fn func(d *xml.Decoder, se *xml.StartElement) error) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if se, ok := tok.(xml.StartElement); ok {
+			err = fn(d, &se)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func attr(se *xml.StartElement, name string) string {
+	for _, a := range se.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// richText reads the text of a <si> or <is> element, ignoring phonetic runs.
+func richText(d *xml.Decoder) (string, error) {
+	var b strings.Builder
+	depth, phonetic := 1, 0
+	for depth > 0 {
+		tok, err := d.Token()
+		if err != nil {
+			return "", err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			depth++
+			switch tok.Name.Local {
+			case "rPh":
+				phonetic++
+			case "t":
+				var t string
+				err = d.DecodeElement(&t, &tok)
+				if err != nil {
+					return "", err
+				}
+				depth--
+				if phonetic == 0 {
+					b.WriteString(t)
+				}
+			}
+		case xml.EndElement:
+			depth--
+			if tok.Name.Local == "rPh" {
+				phonetic--
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+func (wb *xlsxWorkBook) load() error {
+	if wb.loaded {
+		return nil
+	}
+	wb.loaded = true
+	wb.formatCodes = make(map[int]string)
+	if wb.sstFile != nil {
+		err := forEachElem(wb.sstFile, func(d *xml.Decoder, se *xml.StartElement) error {
+			if se.Name.Local != "si" {
+				return nil
+			}
+			s, err := richText(d)
+			wb.sst = append(wb.sst, s)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if wb.stylesFile != nil {
+		inCellXfs := false
+		err := forEachElem(wb.stylesFile, func(d *xml.Decoder, se *xml.StartElement) error {
+			switch se.Name.Local {
+			case "numFmt":
+				id, _ := strconv.Atoi(attr(se, "numFmtId"))
+				wb.formatCodes[id] = attr(se, "formatCode")
+			case "cellStyleXfs", "dxfs", "cellStyles":
+				inCellXfs = false
+			case "cellXfs":
+				inCellXfs = true
+			case "xf":
+				if inCellXfs {
+					id, _ := strconv.Atoi(attr(se, "numFmtId"))
+					wb.xfFormat = append(wb.xfFormat, id)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (wb *xlsxWorkBook) Cells(sheetName string) [][]Cell {
+	var sheet *xlsxSheet
+	for i := range wb.sheets {
+		if wb.sheets[i].name == sheetName {
+			sheet = &wb.sheets[i]
+			break
+		}
+	}
+	if sheet == nil {
+		return nil
+	}
+	l := sheetLayout{
+		hidden:     sheet.hidden,
+		hiddenRows: make(map[int]bool),
+		hiddenCols: make(map[int]bool),
+	}
+	if !wb.sheetVisible(sheetName, &l) {
+		return nil
+	}
+	err := wb.load()
+	if err != nil {
+		wb.warn("read-error", sheetName, -1, -1, "Error reading workbook: %s", err)
+		return nil
+	}
+
+	var s sparseSheet
+	row, col := -1, -1
+	err = forEachElem(sheet.file, func(d *xml.Decoder, se *xml.StartElement) error {
+		switch se.Name.Local {
+		case "col":
+			if attr(se, "hidden") == "1" || attr(se, "hidden") == "true" {
+				min, _ := strconv.Atoi(attr(se, "min"))
+				max, _ := strconv.Atoi(attr(se, "max"))
+				for j := min - 1; j < max && j < maxXlsxCols; j++ {
+					l.hiddenCols[j] = true
+				}
+			}
+		case "row":
+			if r, err := strconv.Atoi(attr(se, "r")); err == nil {
+				row = r - 1
+			} else {
+				row++
+			}
+			col = -1
+			if attr(se, "hidden") == "1" || attr(se, "hidden") == "true" {
+				l.hiddenRows[row] = true
+			}
+		case "c":
+			if r, c, ok := parseCellRef(attr(se, "r")); ok {
+				row, col = r, c
+			} else {
+				col++
+			}
+			c, err := wb.readCell(d, se)
+			if err != nil {
+				return err
+			}
+			if c.Type != CellEmpty {
+				s.set(row, col, c)
+			}
+		case "mergeCell":
+			if r, ok := parseRangeRef(attr(se, "ref")); ok {
+				l.merged = append(l.merged, r)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		wb.warn("read-error", sheetName, -1, -1, "Error reading sheet %q: %s", sheetName, err)
+	}
+	return wb.applyOptions(sheetName, s.rows(), &l)
+}
+
+// maxXlsxCols is the number of columns of an excel sheet.
+const maxXlsxCols = 16384
+
+// readCell reads the content of a <c> element.
+func (wb *xlsxWorkBook) readCell(d *xml.Decoder, se *xml.StartElement) (Cell, error) {
+	var value, inline string
+	hasFormula := false
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return Cell{}, err
+		}
+		if _, ok := tok.(xml.EndElement); ok {
+			break // </c>
+		}
+		child, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch child.Name.Local {
+		case "v":
+			err = d.DecodeElement(&value, &child)
+		case "f":
+			hasFormula = true
+			err = d.Skip()
+		case "is":
+			inline, err = richText(d)
+		default:
+			err = d.Skip()
+		}
+		if err != nil {
+			return Cell{}, err
+		}
+	}
+
+	var c Cell
+	switch attr(se, "t") {
+	case "s":
+		if i, err := strconv.Atoi(value); err == nil && i >= 0 && i < len(wb.sst) {
+			c = stringCell(wb.sst[i])
+		}
+	case "inlineStr":
+		c = stringCell(inline)
+	case "b":
+		if value != "" {
+			c = Cell{Type: CellBool, Bool: value == "1" || value == "true"}
+		}
+	case "d":
+		c = stringCell(value)
+		for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"} {
+			if t, err := time.Parse(layout, value); err == nil {
+				c = Cell{Type: CellDate, Time: t}
+				break
+			}
+		}
+	case "str", "e":
+		c = stringCell(value)
+	default: // number
+		if value == "" {
+			break
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			c = stringCell(value)
+		} else if wb.isDateStyle(attr(se, "s")) {
+			c = Cell{Type: CellDate, Time: excelTime(f, wb.date1904)}
+		} else {
+			c = Cell{Type: CellNumber, Num: f}
+		}
+	}
+	if hasFormula && c.Type != CellEmpty {
+		c.IsFormula = true
+	}
+	return c, nil
+}
+
+func (wb *xlsxWorkBook) isDateStyle(style string) bool {
+	s, err := strconv.Atoi(style)
+	if err != nil || s < 0 || s >= len(wb.xfFormat) {
+		return false
+	}
+	id := wb.xfFormat[s]
+	if code, ok := wb.formatCodes[id]; ok {
+		return isDateFormat(code)
+	}
+	return isBuiltinDateFormat(uint16(id))
+}
+
+// parseCellRef parses a reference like "B12" to 0-based indexes.
+func parseCellRef(ref string) (row, col int, ok bool) {
+	i := 0
+	for i < len(ref) && 'A' <= ref[i] && ref[i] <= 'Z' {
+		col = col*26 + int(ref[i]-'A') + 1
+		i++
+	}
+	r, err := strconv.Atoi(ref[i:])
+	if i == 0 || err != nil || r < 1 || col > maxXlsxCols {
+		return 0, 0, false
+	}
+	return r - 1, col - 1, true
+}
+
+// parseRangeRef parses a range like "A1:C2".
+func parseRangeRef(ref string) (cellRange, bool) {
+	parts := strings.Split(ref, ":")
+	if len(parts) != 2 {
+		return cellRange{}, false
+	}
+	r1, c1, ok1 := parseCellRef(parts[0])
+	r2, c2, ok2 := parseCellRef(parts[1])
+	return cellRange{r1, r2, c1, c2}, ok1 && ok2
+}
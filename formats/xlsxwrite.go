@@ -0,0 +1,183 @@
+package formats
+
+import (
+	"archive/zip"
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A Sheet is a worksheet to be written by EncXlsx.
+// Cells are strings, float64, bool or nil (empty);
+// the first row is a header, shown in bold and frozen.
+type Sheet struct {
+	Name string
+	Rows [][]interface{}
+}
+
+// EncXlsx writes a minimal xlsx workbook with the given sheets.
+func EncXlsx(w io.Writer, sheets []Sheet) error {
+	z := zip.NewWriter(w)
+	files := []struct {
+		name  string
+		write func(w io.Writer) error
+	}{
+		{"[Content_Types].xml", func(w io.Writer) error { return xlsxContentTypes(w, len(sheets)) }},
+		{"_rels/.rels", func(w io.Writer) error { return writeString(w, xlsxRootRels) }},
+		{"xl/workbook.xml", func(w io.Writer) error { return xlsxWorkbook(w, sheets) }},
+		{"xl/_rels/workbook.xml.rels", func(w io.Writer) error { return xlsxWorkbookRels(w, len(sheets)) }},
+		{"xl/styles.xml", func(w io.Writer) error { return writeString(w, xlsxStyles) }},
+	}
+	for i := range sheets {
+		sheet := &sheets[i]
+		files = append(files, struct {
+			name  string
+			write func(w io.Writer) error
+		}{fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1), func(w io.Writer) error { return encXlsxSheet(w, sheet) }})
+	}
+	for _, f := range files {
+		fw, err := z.Create(f.name)
+		if err != nil {
+			return err
+		}
+		bw := bufio.NewWriter(fw)
+		if err := f.write(bw); err != nil {
+			return err
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
+
+func writeString(w io.Writer, s string) error {
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+const xmlHeader = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n"
+
+const (
+	nsMain = "http://schemas.openxmlformats.org/spreadsheetml/2006/main"
+	nsRels = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+)
+
+const xlsxRootRels = xmlHeader + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="` + nsRels + `/officeDocument" Target="xl/workbook.xml"/></Relationships>`
+
+// xlsxStyles has the default style (0) and a bold one (1), for headers.
+const xlsxStyles = xmlHeader + `<styleSheet xmlns="` + nsMain + `">` +
+	`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+	`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+	`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+	`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+	`<cellXfs count="2"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+	`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs>` +
+	`</styleSheet>`
+
+func xlsxContentTypes(w io.Writer, numSheets int) error {
+	s := xmlHeader + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>`
+	for i := 1; i <= numSheets; i++ {
+		s += fmt.Sprintf(`<Override PartName="/xl/worksheets/sheet%d.xml" `+
+			`ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, i)
+	}
+	return writeString(w, s+`</Types>`)
+}
+
+func xlsxWorkbook(w io.Writer, sheets []Sheet) error {
+	var b strings.Builder
+	b.WriteString(xmlHeader + `<workbook xmlns="` + nsMain + `" xmlns:r="` + nsRels + `"><sheets>`)
+	for i, name := range sheetNames(sheets) {
+		b.WriteString(`<sheet name="`)
+		xmlEscape(&b, name)
+		fmt.Fprintf(&b, `" sheetId="%d" r:id="rId%d"/>`, i+1, i+1)
+	}
+	return writeString(w, b.String()+`</sheets></workbook>`)
+}
+
+// sheetNames makes valid sheet names: at most 31 characters, without []:*?/\,
+// and unique ignoring case, adding a numeric suffix to names already used.
+func sheetNames(sheets []Sheet) []string {
+	names := make([]string, len(sheets))
+	used := make(map[string]bool)
+	for i, sheet := range sheets {
+		r := []rune(sheet.Name)
+		for j, c := range r {
+			switch c {
+			case '[', ']', ':', '*', '?', '/', '\\':
+				r[j] = '_'
+			}
+		}
+		name := truncateRunes(r, 31)
+		for n := 2; used[strings.ToLower(name)]; n++ {
+			suffix := fmt.Sprintf("_%d", n)
+			name = truncateRunes(r, 31-len(suffix)) + suffix
+		}
+		used[strings.ToLower(name)] = true
+		names[i] = name
+	}
+	return names
+}
+
+func truncateRunes(r []rune, n int) string {
+	if len(r) > n {
+		r = r[:n]
+	}
+	return string(r)
+}
+
+func xlsxWorkbookRels(w io.Writer, numSheets int) error {
+	s := xmlHeader + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`
+	for i := 1; i <= numSheets; i++ {
+		s += fmt.Sprintf(`<Relationship Id="rId%d" Type="`+nsRels+`/worksheet" Target="worksheets/sheet%d.xml"/>`, i, i)
+	}
+	s += fmt.Sprintf(`<Relationship Id="rId%d" Type="`+nsRels+`/styles" Target="styles.xml"/>`, numSheets+1)
+	return writeString(w, s+`</Relationships>`)
+}
+
+func encXlsxSheet(w io.Writer, sheet *Sheet) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(xmlHeader + `<worksheet xmlns="` + nsMain + `">`)
+	bw.WriteString(`<sheetViews><sheetView workbookViewId="0">` +
+		`<pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>`)
+	bw.WriteString(`<sheetData>`)
+	for i, row := range sheet.Rows {
+		fmt.Fprintf(bw, `<row r="%d">`, i+1)
+		style := ""
+		if i == 0 {
+			style = ` s="1"`
+		}
+		for j, cell := range row {
+			ref := ColumnName(j) + strconv.Itoa(i+1)
+			switch v := cell.(type) {
+			case nil:
+			case float64:
+				if math.IsNaN(v) || math.IsInf(v, 0) {
+					continue
+				}
+				fmt.Fprintf(bw, `<c r="%s"%s><v>%s</v></c>`, ref, style, strconv.FormatFloat(v, 'g', -1, 64))
+			case bool:
+				b := 0
+				if v {
+					b = 1
+				}
+				fmt.Fprintf(bw, `<c r="%s"%s t="b"><v>%d</v></c>`, ref, style, b)
+			default:
+				fmt.Fprintf(bw, `<c r="%s"%s t="inlineStr"><is><t xml:space="preserve">`, ref, style)
+				xmlEscape(bw, fmt.Sprint(v))
+				bw.WriteString(`</t></is></c>`)
+			}
+		}
+		bw.WriteString(`</row>`)
+	}
+	bw.WriteString(`</sheetData></worksheet>`)
+	return bw.Flush()
+}
@@ -5,15 +5,9 @@ go 1.17
 // +heroku goVersion go1.17
 
 require (
-	github.com/extrame/goyymmdd v0.0.0-20181026012948-914eb450555b // indirect
-	github.com/extrame/ole2 v0.0.0-20160812065207-d69429661ad7 // indirect
-	github.com/extrame/xls v0.0.2-0.20180905092746-539786826ced
+	github.com/extrame/ole2 v0.0.0-20160812065207-d69429661ad7
 	github.com/kr/pretty v0.2.1
-	github.com/tealeg/xlsx v1.0.4-0.20190403190220-b7005b5d48cb
-	golang.org/x/text v0.3.2 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require (
-	github.com/kr/text v0.1.0 // indirect
-	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
-)
+require github.com/kr/text v0.1.0 // indirect
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+var infoCmd = newCommand("info", "print the fields, languages and choice lists of xlsforms")
+
+func init() {
+	opts := inputFlags(infoCmd.flags)
+	infoCmd.run = func(files []string) bool {
+		return forEachFile(files, func(fileName string) error {
+			return info(fileName, opts)
+		})
+	}
+}
+
+func info(xlsName string, opts *inputOptions) error {
+	xls, err := decodeFile(xlsName, opts)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "%s\n\n", xlsName)
+
+	var langs []string
+	for lang := range xls.LangSet {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	if len(langs) == 0 {
+		langs = []string{"-"}
+	}
+	fmt.Fprintf(w, "Languages:\t%s\n", strings.Join(langs, ", "))
+
+	typeCount := make(map[string]int)
+	var types []string
+	var fields [][3]string
+	for _, row := range xls.Survey {
+		typ := row.Type
+		if f := strings.Fields(typ); len(f) > 0 && f[0] != "begin" {
+			typ = f[0] // select_one list -> select_one
+		}
+		if typ == "" || strings.HasPrefix(typ, "end") {
+			continue
+		}
+		if typeCount[typ] == 0 {
+			types = append(types, typ)
+		}
+		typeCount[typ]++
+		fields = append(fields, [3]string{row.Name(), row.Type, row.Label("")})
+	}
+	sort.Strings(types)
+	fmt.Fprintf(w, "Survey rows:\t%d\n", len(fields))
+	for _, typ := range types {
+		fmt.Fprintf(w, "  %s\t%d\n", typ, typeCount[typ])
+	}
+
+	listCount := make(map[string]int)
+	var lists []string
+	for _, row := range xls.Choices {
+		if listCount[row.ListName()] == 0 {
+			lists = append(lists, row.ListName())
+		}
+		listCount[row.ListName()]++
+	}
+	fmt.Fprintf(w, "Choice lists:\t%d\n", len(lists))
+	for _, list := range lists {
+		fmt.Fprintf(w, "  %s\t%d choices\n", list, listCount[list])
+	}
+
+	fmt.Fprintf(w, "\nName\tType\tLabel\n")
+	for _, f := range fields {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", f[0], f[1], strings.Join(strings.Fields(f[2]), " "))
+	}
+	fmt.Fprintln(w)
+	return w.Flush()
+}
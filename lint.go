@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+var lintCmd = newCommand("lint", "report likely mistakes in xlsforms; exits with status 1 if any is found")
+
+func init() {
+	opts := inputFlags(lintCmd.flags)
+	diagFlags(lintCmd.flags)
+	lintCmd.run = func(files []string) bool {
+		return forEachFile(files, func(fileName string) error {
+			return lint(fileName, opts)
+		})
+	}
+}
+
+func lint(xlsName string, opts *inputOptions) error {
+	xls, err := decodeFile(xlsName, opts)
+	if err != nil {
+		return err
+	}
+	warns := formats.Lint(xls)
+	for _, w := range warns {
+		report.warning(xlsName, w)
+	}
+	if n := len(warns) + len(xls.Warnings); n > 0 {
+		if report.format == "text" {
+			fmt.Fprintf(os.Stderr, "%s: %d problems found.\n", xlsName, n)
+		}
+		return errReported
+	}
+	return nil
+}
@@ -1,58 +1,186 @@
 package main
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/gnucoop/formconv/formats"
 )
 
+type command struct {
+	name  string
+	short string // one-line description
+	args  string // description of the arguments
+	flags *flag.FlagSet
+	// run processes the files given as arguments,
+	// it returns false if any of them failed.
+	run func(files []string) bool
+}
+
+var commands []*command
+
+func newCommand(name, short string) *command {
+	cmd := &command{name: name, short: short, args: "form1.xlsx form2.xls...",
+		flags: flag.NewFlagSet(name, flag.ExitOnError)}
+	cmd.flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s\n\nUsage: formconv %s [flags] %s\n", short, name, cmd.args)
+		cmd.flags.PrintDefaults()
+	}
+	commands = append(commands, cmd)
+	return cmd
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `formconv converts xlsform files to ajf. Usage:
+
+	formconv <command> [flags] form1.xlsx form2.xls...
+
+The commands are:`)
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "\t%-10s %s\n", cmd.name, cmd.short)
+	}
+	fmt.Fprintln(os.Stderr, `
+If the command is omitted, the files are converted.
+Use "formconv <command> -h" for the flags of a command.`)
+}
+
 func main() {
-	if len(os.Args) <= 1 {
-		fmt.Fprintln(os.Stderr, `No input files provided.
-formconv converts xlsform files to ajf. Usage:
-formconv form1.xlsx form2.xls`)
+	args := os.Args[1:]
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "-help" {
+		usage()
+		if len(args) == 0 {
+			os.Exit(2)
+		}
 		return
 	}
+	cmd := convertCmd
+	for _, c := range commands {
+		if c.name == args[0] {
+			cmd = c
+			args = args[1:]
+			break
+		}
+	}
+	cmd.flags.Parse(args)
+	if cmd.flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "No arguments provided.")
+		cmd.flags.Usage()
+		os.Exit(2)
+	}
+	if err := report.check(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	ok := cmd.run(cmd.flags.Args())
+	if err := report.flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing diagnostics: %s\n", err)
+		ok = false
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
 
-	for _, fileName := range os.Args[1:] {
-		err := decXlsEncAjf(fileName)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
+// hiddenFlag is a flag.Value for formats.HiddenPolicy.
+type hiddenFlag struct{ p *formats.HiddenPolicy }
+
+var hiddenPolicies = []string{"keep", "skip", "warn"}
+
+func (h hiddenFlag) String() string {
+	if h.p == nil {
+		return hiddenPolicies[0]
+	}
+	return hiddenPolicies[*h.p]
+}
+
+func (h hiddenFlag) Set(s string) error {
+	for i, name := range hiddenPolicies {
+		if s == name {
+			*h.p = formats.HiddenPolicy(i)
+			return nil
 		}
 	}
+	return fmt.Errorf("must be one of %s", strings.Join(hiddenPolicies, ", "))
+}
+
+// inputOptions control how input files are read.
+type inputOptions struct {
+	wb     formats.WorkBookOptions
+	format string // file extension to use for stdin
+}
+
+// inputFlags defines the flags controlling how input files are read.
+func inputFlags(fs *flag.FlagSet) *inputOptions {
+	opts := new(inputOptions)
+	fs.BoolVar(&opts.wb.ExpandMerged, "merged", false, "copy the value of merged cells to the whole merged range")
+	fs.Var(hiddenFlag{&opts.wb.Hidden}, "hidden", "how to read hidden sheets, rows and columns: keep, skip or warn")
+	fs.StringVar(&opts.format, "stdin-format", "xlsx", "format of the form read from stdin (file name -): xls or xlsx")
+	return opts
 }
 
-func decXlsEncAjf(xlsName string) error {
-	f, err := os.Open(xlsName)
+// decodeFile reads an xlsform file, printing the workbook warnings.
+func decodeFile(fileName string, opts *inputOptions) (*formats.XlsForm, error) {
+	xls, err := decode(fileName, opts)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer f.Close()
+	for _, w := range xls.Warnings {
+		report.warning(fileName, w)
+	}
+	return xls, nil
+}
 
-	stat, err := f.Stat()
-	if err != nil {
-		return err
+// decode reads an xlsform file, if fileName is "-" the form is read from stdin.
+func decode(fileName string, opts *inputOptions) (*formats.XlsForm, error) {
+	var xls *formats.XlsForm
+	var err error
+	if fileName == "-" {
+		xls, err = decodeStdin(opts)
+	} else {
+		xls, err = formats.DecXlsFromFileOptions(fileName, opts.wb)
 	}
-	wb, err := formats.NewWorkBook(f, filepath.Ext(xlsName), stat.Size())
 	if err != nil {
-		return fmt.Errorf("Error opening workbook: %s", err)
+		return nil, fmt.Errorf("Error decoding file %s: %w", fileName, err)
 	}
-	xls, err := formats.DecXlsform(wb)
+	return xls, nil
+}
+
+func decodeStdin(opts *inputOptions) (*formats.XlsForm, error) {
+	// Workbooks need random access, stdin must be read in memory.
+	data, err := io.ReadAll(os.Stdin)
 	if err != nil {
-		return fmt.Errorf("Error decoding file %s: %s", xlsName, err)
+		return nil, fmt.Errorf("Couldn't read stdin: %s", err)
 	}
-	ajf, err := formats.Convert(xls)
+	ext := "." + strings.TrimPrefix(opts.format, ".")
+	wb, err := formats.NewWorkBookOptions(bytes.NewReader(data), ext, int64(len(data)), opts.wb)
 	if err != nil {
-		return fmt.Errorf("%s, %s", xlsName, err)
+		return nil, err
 	}
-	ext := filepath.Ext(xlsName)
-	name := xlsName[0 : len(xlsName)-len(ext)]
-	ajfName := name + ".json"
-	err = formats.EncJsonToFile(ajfName, ajf)
-	if err != nil {
-		return fmt.Errorf("Error encoding file %s: %s", ajfName, err)
+	return formats.DecXlsform(wb)
+}
+
+// isFormFile tells if a file name looks like an xlsform.
+func isFormFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	// Excel creates lock files starting with ~$ next to open workbooks.
+	return (ext == ".xls" || ext == ".xlsx") && !strings.HasPrefix(filepath.Base(name), "~$")
+}
+
+// forEachFile calls fn for each file, reporting the errors.
+// It returns false if fn failed for any file.
+func forEachFile(files []string, fn func(fileName string) error) bool {
+	ok := true
+	for _, fileName := range files {
+		err := fn(fileName)
+		if err != nil {
+			report.error(fileName, err)
+			ok = false
+		}
 	}
-	return nil
+	return ok
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+var previewCmd = newCommand("preview", "write html previews of xlsforms, to check their layout and wording")
+
+func init() {
+	in := inputFlags(previewCmd.flags)
+	out := outputPathFlag(previewCmd.flags)
+	previewCmd.flags.Lookup("o").Usage = outputFileUsage
+	previewCmd.run = func(files []string) bool {
+		if err := out.init(len(files)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return false
+		}
+		return forEachFile(files, func(fileName string) error {
+			return preview(fileName, in, out)
+		})
+	}
+}
+
+func preview(xlsName string, in *inputOptions, out *outputOptions) error {
+	htmlName, err := out.fileName(xlsName, ".html")
+	if err != nil {
+		return err
+	}
+	xls, err := decodeFile(xlsName, in)
+	if err != nil {
+		return err
+	}
+	ajf, err := formats.Convert(xls)
+	if err != nil {
+		return fmt.Errorf("%s, %w", xlsName, err)
+	}
+	title := strings.TrimSuffix(filepath.Base(xlsName), filepath.Ext(xlsName))
+	if xlsName == "-" {
+		title = "Form"
+	}
+	err = out.write(htmlName, func(w io.Writer) error { return formats.EncPreview(w, ajf, title) })
+	if err != nil {
+		return fmt.Errorf("Error writing file %s: %s", htmlName, err)
+	}
+	return nil
+}
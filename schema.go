@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+var schemaCmd = newCommand("schema", "write json schemas of the submissions of xlsforms, to validate collected data")
+
+func init() {
+	in := inputFlags(schemaCmd.flags)
+	out := outputFlags(schemaCmd.flags)
+	schemaCmd.flags.Lookup("o").Usage = outputFileUsage
+	schemaCmd.run = func(files []string) bool {
+		if err := out.init(len(files)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return false
+		}
+		return forEachFile(files, func(fileName string) error {
+			return schema(fileName, in, out)
+		})
+	}
+}
+
+func schema(xlsName string, in *inputOptions, out *outputOptions) error {
+	schemaName, err := out.fileName(xlsName, ".schema.json")
+	if err != nil {
+		return err
+	}
+	xls, err := decodeFile(xlsName, in)
+	if err != nil {
+		return err
+	}
+	ajf, err := formats.Convert(xls)
+	if err != nil {
+		return fmt.Errorf("%s, %w", xlsName, err)
+	}
+	title := strings.TrimSuffix(filepath.Base(xlsName), filepath.Ext(xlsName))
+	if xlsName == "-" {
+		title = "Form"
+	}
+	err = out.encJson(schemaName, formats.SubmissionSchema(ajf, title))
+	if err != nil {
+		return fmt.Errorf("Error writing file %s: %s", schemaName, err)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// protect wraps the handlers of the endpoints that use the converter,
+// answering CORS preflight requests, checking the API key, if required,
+// and limiting the rate of requests of each key (or client address,
+// without authentication) and of wrong keys of each client address.
+func protect(h http.HandlerFunc) http.HandlerFunc { return guard(h, true) }
+
+// protectUnlimited is like protect, without the rate limit,
+// for endpoints polled by monitoring.
+func protectUnlimited(h http.HandlerFunc) http.HandlerFunc { return guard(h, false) }
+
+func guard(h http.HandlerFunc, limited bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !setCorsHeaders(w, r) {
+			writeProblem(w, http.StatusForbidden, fmt.Sprintf("Origin %s not allowed.", r.Header.Get("Origin")), nil)
+			return
+		}
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		// Wrong API keys are limited by client address, checked before
+		// the key so that a correct key can't be told apart once limited.
+		addr := clientAddr(r)
+		if authFailures != nil {
+			if wait := authFailures.wait(addr); wait > 0 {
+				tooManyRequests(w, wait)
+				return
+			}
+		}
+		client, ok := authenticate(r)
+		if !ok {
+			if authFailures != nil {
+				authFailures.take(addr)
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="formconv"`)
+			writeProblem(w, http.StatusUnauthorized, "A valid API key is required, as a bearer token "+
+				"in the Authorization header or in the X-API-Key header.", nil)
+			return
+		}
+		logField(w, "client", client)
+		if limited && limiter != nil {
+			if wait := limiter.take(client); wait > 0 {
+				tooManyRequests(w, wait)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+	writeProblem(w, http.StatusTooManyRequests, "Too many requests, retry later.", nil)
+}
+
+// setCorsHeaders sets the CORS headers of the response
+// and reports whether the origin of the request is allowed.
+// Requests from the host of the server are always allowed.
+func setCorsHeaders(w http.ResponseWriter, r *http.Request) bool {
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	allowed := false
+	for _, o := range conf.allowedOrigins {
+		if o == "*" || o == origin {
+			allowed = true
+			break
+		}
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		allowed = true
+	}
+	if !allowed {
+		return false
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Set("Access-Control-Expose-Headers", "ETag, Location, Retry-After, Content-Disposition, X-Request-Id")
+	if r.Method == http.MethodOptions {
+		h.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		h.Set("Access-Control-Allow-Headers", "Authorization, X-API-Key, If-None-Match, X-Request-Id")
+		h.Set("Access-Control-Max-Age", "3600")
+	}
+	return true
+}
+
+// authenticate returns the identifier of the client of the request:
+// a hash of its API key or, if authentication is disabled, its address.
+func authenticate(r *http.Request) (client string, ok bool) {
+	if len(conf.apiKeys) == 0 {
+		return clientAddr(r), true
+	}
+	key := r.Header.Get("X-API-Key")
+	if auth := r.Header.Get("Authorization"); key == "" && len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		key = strings.TrimSpace(auth[7:])
+	}
+	if key == "" {
+		return "", false
+	}
+	found := 0
+	for _, k := range conf.apiKeys {
+		found |= subtle.ConstantTimeCompare([]byte(k), []byte(key))
+	}
+	if found == 0 {
+		return "", false
+	}
+	return keyId(key), true
+}
+
+// clientAddr returns the address of the client of a request. Behind
+// trustedProxies reverse proxies, each appending the address it received
+// the request from to X-Forwarded-For, it's the address appended by the first
+// proxy: the earlier ones can be set by the client.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if conf.trustedProxies == 0 {
+		return host
+	}
+	var forwarded []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(h, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				forwarded = append(forwarded, addr)
+			}
+		}
+	}
+	if len(forwarded) < conf.trustedProxies {
+		return host // not from the proxies
+	}
+	return forwarded[len(forwarded)-conf.trustedProxies]
+}
+
+// keyId identifies an API key in logs without revealing it.
+func keyId(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "key-" + hex.EncodeToString(sum[:])[:12]
+}
+
+// A rateLimiter keeps a token bucket for each client:
+// buckets hold up to burst tokens and refill at rate tokens per second,
+// each request takes a token.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var limiter *rateLimiter
+
+// authFailures limits the requests with a wrong API key of each client address,
+// so that keys can't be guessed by trying many of them.
+var authFailures *rateLimiter
+
+func newRateLimiter(perMinute float64, burst int) *rateLimiter {
+	l := &rateLimiter{rate: perMinute / 60, burst: float64(burst), buckets: make(map[string]*bucket)}
+	go l.cleanup()
+	return l
+}
+
+// take takes a token from the bucket of client, returning 0
+// or, if the bucket is empty, how long to wait for the next token.
+func (l *rateLimiter) take(client string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.refill(client)
+	if b.tokens < 1 {
+		return l.waitFor(b)
+	}
+	b.tokens--
+	return 0
+}
+
+// wait is like take, without taking the token.
+func (l *rateLimiter) wait(client string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b := l.refill(client); b.tokens < 1 {
+		return l.waitFor(b)
+	}
+	return 0
+}
+
+// refill returns the bucket of client with the tokens added since its last use.
+func (l *rateLimiter) refill(client string) *bucket {
+	now := time.Now()
+	b := l.buckets[client]
+	if b == nil {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	return b
+}
+
+func (l *rateLimiter) waitFor(b *bucket) time.Duration {
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// cleanup periodically removes the buckets that are full again.
+func (l *rateLimiter) cleanup() {
+	for range time.Tick(time.Minute) {
+		l.mu.Lock()
+		now := time.Now()
+		for client, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, client)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGuardLimitsWrongKeys(t *testing.T) {
+	defer func(keys []string) { conf.apiKeys = keys; authFailures = nil }(conf.apiKeys)
+	conf.apiKeys = []string{"secret"}
+	authFailures = newRateLimiter(60, 2)
+	h := protect(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	request := func(addr, key string) int {
+		r := httptest.NewRequest(http.MethodGet, "/jobs/1", nil)
+		r.RemoteAddr = addr + ":1234"
+		r.Header.Set("X-API-Key", key)
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := request("10.0.0.1", "guess"); code != http.StatusUnauthorized {
+			t.Fatalf("Wrong key %d: expected status 401, found %d.", i, code)
+		}
+	}
+	if code := request("10.0.0.1", "guess"); code != http.StatusTooManyRequests {
+		t.Fatalf("Wrong key over the limit: expected status 429, found %d.", code)
+	}
+	if code := request("10.0.0.1", "secret"); code != http.StatusTooManyRequests {
+		t.Fatalf("Valid key from a limited address: expected status 429, found %d.", code)
+	}
+	if code := request("10.0.0.2", "secret"); code != http.StatusOK {
+		t.Fatalf("Valid key from another address: expected status 200, found %d.", code)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Conversions are cached by a hash of the uploaded workbook,
+// the version of the converter and the options of the request.
+// Only the responses with status 200 or 422 are cached:
+// the others depend on the limits of the server, not on the form.
+
+// A response is a response that can be stored and replayed.
+type response struct {
+	Status int
+	Header http.Header // only the headers in cachedHeaders
+	Body   []byte
+}
+
+var cachedHeaders = []string{"Content-Type", "Content-Disposition", "Content-Security-Policy"}
+
+// lruCache is an in-memory cache of responses, which evicts
+// the least recently used ones when their size exceeds maxSize.
+// If dir is not empty, responses are also stored there as files,
+// whose total size is periodically brought back under maxDirSize.
+type lruCache struct {
+	mu         sync.Mutex
+	maxSize    int64
+	size       int64
+	order      *list.List // of *lruEntry, the most recently used first
+	entries    map[string]*list.Element
+	dir        string
+	maxDirSize int64
+}
+
+type lruEntry struct {
+	key  string
+	resp *response
+}
+
+var cache *lruCache
+
+func newLruCache(maxSize int64, dir string, maxDirSize int64) *lruCache {
+	c := &lruCache{
+		maxSize:    maxSize,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+		dir:        dir,
+		maxDirSize: maxDirSize,
+	}
+	if dir != "" {
+		go c.cleanDir()
+	}
+	return c
+}
+
+func (c *lruCache) get(key string) *response {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.order.MoveToFront(el)
+		c.mu.Unlock()
+		return el.Value.(*lruEntry).resp
+	}
+	c.mu.Unlock()
+	if c.dir == "" {
+		return nil
+	}
+	resp, err := c.readFile(key)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logJSON("error", "Error reading cache file.", "key", key, "error", err)
+		}
+		return nil
+	}
+	c.addMem(key, resp)
+	return resp
+}
+
+func (c *lruCache) put(key string, resp *response) {
+	c.addMem(key, resp)
+	if c.dir == "" {
+		return
+	}
+	if err := c.writeFile(key, resp); err != nil {
+		logJSON("error", "Error writing cache file.", "key", key, "error", err)
+	}
+}
+
+func (c *lruCache) addMem(key string, resp *response) {
+	size := int64(len(resp.Body))
+	if size > c.maxSize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key, resp})
+	c.size += size
+	for c.size > c.maxSize {
+		el := c.order.Back()
+		e := el.Value.(*lruEntry)
+		c.order.Remove(el)
+		delete(c.entries, e.key)
+		c.size -= int64(len(e.resp.Body))
+	}
+}
+
+func (c *lruCache) fileName(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+func (c *lruCache) readFile(key string) (*response, error) {
+	f, err := os.Open(c.fileName(key))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	resp := new(response)
+	if err := gob.NewDecoder(f).Decode(resp); err != nil {
+		return nil, err
+	}
+	// The modification time records the last use, for cleanDir.
+	now := time.Now()
+	os.Chtimes(f.Name(), now, now)
+	return resp, nil
+}
+
+// writeFile writes the file of an entry atomically,
+// so that concurrent readers never see it incomplete.
+func (c *lruCache) writeFile(key string, resp *response) error {
+	name := c.fileName(key)
+	if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(resp)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// cleanDir periodically removes the least recently used files of the cache directory
+// while their size exceeds maxDirSize, and the temporary files left by interrupted writes.
+// Instances sharing the directory clean it independently.
+func (c *lruCache) cleanDir() {
+	for ; ; time.Sleep(10 * time.Minute) {
+		type cacheFile struct {
+			name string
+			size int64
+			used time.Time
+		}
+		var files []cacheFile
+		var size int64
+		err := filepath.WalkDir(c.dir, func(name string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil // removed meanwhile
+			}
+			if strings.HasSuffix(name, ".tmp") {
+				if time.Since(info.ModTime()) > time.Hour {
+					os.Remove(name)
+				}
+				return nil
+			}
+			files = append(files, cacheFile{name, info.Size(), info.ModTime()})
+			size += info.Size()
+			return nil
+		})
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logJSON("error", "Error reading cache directory.", "error", err)
+			}
+			continue
+		}
+		if size <= c.maxDirSize {
+			continue
+		}
+		sort.Slice(files, func(i, j int) bool { return files[i].used.Before(files[j].used) })
+		removed := 0
+		for _, f := range files {
+			if size <= c.maxDirSize {
+				break
+			}
+			if err := os.Remove(f.name); err != nil && !os.IsNotExist(err) {
+				logJSON("error", "Error removing cache file.", "file", f.name, "error", err)
+				continue
+			}
+			size -= f.size
+			removed++
+		}
+		logJSON("info", "Cache directory cleaned.", "removed", removed, "size", size)
+	}
+}
+
+var converterVersion = buildVersion()
+
+// buildVersion identifies the build of the server, from the vcs
+// information stamped in the binary or, if missing, from its content.
+func buildVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version := info.Main.Version
+		if version == "(devel)" {
+			version = ""
+		}
+		modified := false
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				version += "-" + s.Value
+			case "vcs.modified":
+				modified = s.Value == "true"
+			}
+		}
+		if version != "" && !modified {
+			return strings.TrimPrefix(version, "-")
+		}
+	}
+	// Unknown or modified sources.
+	exe, err := os.Executable()
+	if err == nil {
+		var f *os.File
+		if f, err = os.Open(exe); err == nil {
+			defer f.Close()
+			h := sha256.New()
+			if _, err = io.Copy(h, f); err == nil {
+				return "exe-" + hex.EncodeToString(h.Sum(nil))[:16]
+			}
+		}
+	}
+	logJSON("warn", "Unknown converter version, cached conversions won't survive restarts.", "error", err)
+	return "run-" + randomId()
+}
+
+// cacheKey hashes the uploaded file with what else determines the response.
+func cacheKey(r *http.Request, f multipart.File, head *multipart.FileHeader) (string, error) {
+	format, _ := negotiateFormat(r)
+	h := sha256.New()
+	for _, s := range []string{converterVersion, r.URL.Path, format, head.Filename} {
+		io.WriteString(h, s)
+		h.Write([]byte{0})
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cached serves the conversions of h from the cache, if enabled.
+// The key of the conversion is returned as the ETag of the response;
+// if it matches If-None-Match the response is 412 (Precondition Failed),
+// the status for unsafe methods (RFC 9110, section 13.1.2).
+func cached(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, head := uploadedFile(w, r)
+		if f == nil {
+			return
+		}
+		key, err := cacheKey(r, f, head)
+		f.Close()
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, fmt.Sprintf("Error reading POST file: %s", err), nil)
+			return
+		}
+		etag := `"` + key + `"`
+		w.Header().Set("ETag", etag)
+		if matchEtag(r.Header.Get("If-None-Match"), etag) {
+			logField(w, "cache", "not-modified")
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if cache == nil {
+			h(&teeWriter{ResponseWriter: w, discard: true}, r)
+			return
+		}
+		if resp := cache.get(key); resp != nil {
+			metrics.countCache("hit")
+			logField(w, "cache", "hit")
+			writeResponse(w, resp)
+			return
+		}
+		metrics.countCache("miss")
+		logField(w, "cache", "miss")
+		tee := &teeWriter{ResponseWriter: w}
+		h(tee, r)
+		if cacheable(tee.status) && tee.err == nil {
+			resp := &response{Status: tee.status, Header: make(http.Header), Body: tee.body.Bytes()}
+			for _, k := range cachedHeaders {
+				if v := w.Header().Get(k); v != "" {
+					resp.Header.Set(k, v)
+				}
+			}
+			cache.put(key, resp)
+		}
+	}
+}
+
+func cacheable(status int) bool {
+	return status == http.StatusOK || status == http.StatusUnprocessableEntity
+}
+
+// matchEtag reports whether the If-None-Match header matches etag.
+func matchEtag(ifNoneMatch, etag string) bool {
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// A teeWriter copies the response to a buffer;
+// the ETag header is removed if the response can't be cached.
+type teeWriter struct {
+	http.ResponseWriter
+	status  int
+	body    bytes.Buffer
+	discard bool // don't copy the body
+	err     error
+}
+
+func (t *teeWriter) Unwrap() http.ResponseWriter { return t.ResponseWriter }
+
+func (t *teeWriter) WriteHeader(status int) {
+	if t.status == 0 {
+		t.status = status
+		if !cacheable(status) {
+			t.Header().Del("ETag")
+		}
+	}
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *teeWriter) Write(b []byte) (int, error) {
+	if t.status == 0 {
+		t.WriteHeader(http.StatusOK)
+	}
+	if !t.discard {
+		t.body.Write(b)
+	}
+	n, err := t.ResponseWriter.Write(b)
+	if err != nil && t.err == nil {
+		t.err = err
+	}
+	return n, err
+}
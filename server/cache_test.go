@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func uploadRequest(t *testing.T, path string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("excelFile", "form.xlsx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("workbook"))
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, path, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestCachedIfNoneMatch(t *testing.T) {
+	metrics = newServerMetrics()
+	convert := cached(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("converted")) })
+	mux := http.NewServeMux()
+	mux.HandleFunc("/convert", postHandler(convert))
+	h := logRequests(mux, map[string]bool{"/convert": true})
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, uploadRequest(t, "/convert"))
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("Unexpected first response: status %d, ETag %q.", w.Code, etag)
+	}
+
+	r := uploadRequest(t, "/convert")
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusPreconditionFailed || w.Body.Len() != 0 {
+		t.Errorf("Matching If-None-Match: status %d with body %q, expected 412 without body.", w.Code, w.Body)
+	}
+	for outcome, n := range map[string]uint64{"success": 1, "unchanged": 1, "bad_request": 0} {
+		if got := metrics.conversions[[2]string{"convert", outcome}]; got != n {
+			t.Errorf("Outcome %s counted %d times, expected %d.", outcome, got, n)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config holds the settings of the server, read from environment variables.
+type config struct {
+	port            string
+	maxUploadSize   int64         // MAX_UPLOAD_SIZE, in bytes
+	readTimeout     time.Duration // READ_TIMEOUT, for reading the whole request
+	writeTimeout    time.Duration // WRITE_TIMEOUT, from the end of the request to the end of the response
+	convertTimeout  time.Duration // CONVERT_TIMEOUT, for decoding and converting a form
+	maxConversions  int           // MAX_CONVERSIONS, conversion steps running at once, including the timed out ones
+	shutdownTimeout time.Duration // SHUTDOWN_TIMEOUT, to wait for requests in progress on shutdown
+	cacheSize       int64         // CACHE_SIZE, in bytes, 0 disables the cache, in memory and in cacheDir
+	cacheDir        string        // CACHE_DIR, optional
+	cacheDirSize    int64         // CACHE_DIR_SIZE, in bytes, for the files in cacheDir
+	jobWorkers      int           // JOB_WORKERS, conversions run in parallel by jobs
+	jobQueueSize    int           // JOB_QUEUE_SIZE, jobs waiting for a worker
+	jobTimeout      time.Duration // JOB_TIMEOUT, for decoding, converting and encoding a form in a job
+	jobTTL          time.Duration // JOB_TTL, how long jobs are kept after they end
+	jobStoreSize    int64         // JOB_STORE_SIZE, in bytes, for the uploads and results kept by jobs
+	allowedOrigins  []string      // ALLOWED_ORIGINS, for CORS, "*" allows any
+	apiKeys         []string      // API_KEYS, authentication is disabled if empty
+	rateLimit       float64       // RATE_LIMIT, requests per minute for each client, 0 for no limit
+	rateBurst       int           // RATE_BURST, requests allowed at once
+	authFailures    int           // AUTH_FAILURE_LIMIT, requests with a wrong API key per minute for each client address
+	trustedProxies  int           // TRUSTED_PROXIES, reverse proxies adding the client address to X-Forwarded-For
+}
+
+var conf = config{
+	maxUploadSize:   10 << 20,
+	readTimeout:     30 * time.Second,
+	writeTimeout:    60 * time.Second,
+	convertTimeout:  30 * time.Second,
+	maxConversions:  2 * runtime.NumCPU(),
+	shutdownTimeout: 20 * time.Second,
+	cacheSize:       64 << 20,
+	cacheDirSize:    1 << 30,
+	jobWorkers:      runtime.NumCPU(),
+	jobQueueSize:    100,
+	jobTimeout:      10 * time.Minute,
+	jobTTL:          time.Hour,
+	jobStoreSize:    256 << 20,
+	allowedOrigins:  []string{"*"},
+	rateBurst:       10,
+	authFailures:    10,
+}
+
+func loadConfig() error {
+	conf.port = os.Getenv("PORT")
+	if conf.port == "" {
+		return fmt.Errorf("$PORT must be set!")
+	}
+	if s := os.Getenv("MAX_UPLOAD_SIZE"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("Invalid MAX_UPLOAD_SIZE %q, it must be a positive number of bytes.", s)
+		}
+		conf.maxUploadSize = n
+	}
+	if s := os.Getenv("CACHE_SIZE"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("Invalid CACHE_SIZE %q, it must be a number of bytes.", s)
+		}
+		conf.cacheSize = n
+	}
+	conf.cacheDir = os.Getenv("CACHE_DIR")
+	if s := os.Getenv("CACHE_DIR_SIZE"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("Invalid CACHE_DIR_SIZE %q, it must be a positive number of bytes.", s)
+		}
+		conf.cacheDirSize = n
+	}
+	if s := os.Getenv("JOB_STORE_SIZE"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("Invalid JOB_STORE_SIZE %q, it must be a positive number of bytes.", s)
+		}
+		conf.jobStoreSize = n
+	}
+	if s, ok := os.LookupEnv("ALLOWED_ORIGINS"); ok {
+		conf.allowedOrigins = splitList(s)
+	}
+	conf.apiKeys = splitList(os.Getenv("API_KEYS"))
+	if s := os.Getenv("RATE_LIMIT"); s != "" {
+		r, err := strconv.ParseFloat(s, 64)
+		if err != nil || r < 0 || math.IsInf(r, 0) {
+			return fmt.Errorf("Invalid RATE_LIMIT %q, it must be a number of requests per minute.", s)
+		}
+		conf.rateLimit = r
+	}
+	if s := os.Getenv("TRUSTED_PROXIES"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return fmt.Errorf("Invalid TRUSTED_PROXIES %q, it must be a number of proxies.", s)
+		}
+		conf.trustedProxies = n
+	}
+	ints := []struct {
+		env string
+		n   *int
+	}{
+		{"MAX_CONVERSIONS", &conf.maxConversions},
+		{"JOB_WORKERS", &conf.jobWorkers},
+		{"JOB_QUEUE_SIZE", &conf.jobQueueSize},
+		{"RATE_BURST", &conf.rateBurst},
+		{"AUTH_FAILURE_LIMIT", &conf.authFailures},
+	}
+	for _, i := range ints {
+		s := os.Getenv(i.env)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("Invalid %s %q, it must be a positive number.", i.env, s)
+		}
+		*i.n = n
+	}
+	durations := []struct {
+		env string
+		d   *time.Duration
+	}{
+		{"READ_TIMEOUT", &conf.readTimeout},
+		{"WRITE_TIMEOUT", &conf.writeTimeout},
+		{"CONVERT_TIMEOUT", &conf.convertTimeout},
+		{"SHUTDOWN_TIMEOUT", &conf.shutdownTimeout},
+		{"JOB_TIMEOUT", &conf.jobTimeout},
+		{"JOB_TTL", &conf.jobTTL},
+	}
+	for _, d := range durations {
+		s := os.Getenv(d.env)
+		if s == "" {
+			continue
+		}
+		v, err := time.ParseDuration(s)
+		if err != nil || v <= 0 {
+			return fmt.Errorf("Invalid %s %q, it must be a positive duration like 30s.", d.env, s)
+		}
+		*d.d = v
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, ignoring empty elements.
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
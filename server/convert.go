@@ -0,0 +1,415 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+// An upload is an xlsform POSTed as the excelFile field of a multipart form.
+type upload struct {
+	ctx      context.Context // has the deadline of the conversion
+	timeout  time.Duration   // of ctx, for error messages
+	fileName string
+	xls      *formats.XlsForm
+}
+
+// decodeUpload reads the uploaded xlsform.
+// In case of error it writes the response and returns nil.
+func decodeUpload(w http.ResponseWriter, r *http.Request) *upload {
+	f, head := uploadedFile(w, r)
+	if f == nil {
+		return nil
+	}
+	defer f.Close()
+	logField(w, "file", head.Filename)
+	logField(w, "size", head.Size)
+	metrics.observeInputSize(head.Size)
+
+	u := &upload{ctx: r.Context(), timeout: conf.convertTimeout, fileName: head.Filename}
+	if err := u.decode(f, head.Size); err != nil {
+		u.fail(w, err)
+		return nil
+	}
+	return u
+}
+
+// A stepError is an error of a step of the conversion,
+// caused by the content of the form.
+type stepError struct {
+	detail   string // description of the step, like "Error decoding xlsform"
+	err      error
+	warnings []formats.Diagnostic // found before the error
+}
+
+func (e *stepError) Error() string { return e.detail + ": " + e.err.Error() }
+func (e *stepError) Unwrap() error { return e.err }
+
+// decode decodes the xlsform in f.
+func (u *upload) decode(f formats.File, size int64) error {
+	start := time.Now()
+	defer func() { metrics.observePhase("decode", time.Since(start)) }()
+	var wb formats.WorkBook
+	err := u.run(func() (err error) {
+		wb, err = formats.NewWorkBook(f, filepath.Ext(u.fileName), size)
+		return err
+	})
+	if err != nil {
+		return &stepError{"Error opening workbook", err, nil}
+	}
+	err = u.run(func() (err error) {
+		u.xls, err = formats.DecXlsform(wb)
+		return err
+	})
+	if err != nil {
+		return &stepError{"Error decoding xlsform", err, wb.Warnings()}
+	}
+	return nil
+}
+
+// uploadedFile returns the excelFile field of the form.
+// In case of error it writes the response and returns nil.
+func uploadedFile(w http.ResponseWriter, r *http.Request) (multipart.File, *multipart.FileHeader) {
+	f, head, err := r.FormFile("excelFile")
+	if err != nil && strings.Contains(err.Error(), "request body too large") {
+		writeTooLarge(w)
+		return nil, nil
+	}
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, fmt.Sprintf("Error retrieving POST file: %s", err), nil)
+		return nil, nil
+	}
+	return f, head
+}
+
+// conversionSlots limits the conversion steps running at once.
+var conversionSlots chan struct{}
+
+// run calls f, returning early with an error if the deadline
+// of the conversion expires or the client goes away.
+// The conversion functions can't be interrupted, in that case
+// f keeps running in the background until it ends, holding its slot:
+// abandoned conversions still count in the limit of MAX_CONVERSIONS.
+func (u *upload) run(f func() error) error {
+	slots := conversionSlots
+	select {
+	case slots <- struct{}{}:
+	case <-u.ctx.Done():
+		return u.ctx.Err()
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer func() { <-slots }()
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-u.ctx.Done():
+		return u.ctx.Err()
+	}
+}
+
+// timed returns f, observing its duration in the metrics of phase.
+func timed(phase string, f func() error) func() error {
+	return func() error {
+		start := time.Now()
+		defer func() { metrics.observePhase(phase, time.Since(start)) }()
+		return f()
+	}
+}
+
+// fail writes the response for a failed conversion.
+func (u *upload) fail(w http.ResponseWriter, err error) {
+	var se *stepError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		writeProblem(w, http.StatusServiceUnavailable,
+			fmt.Sprintf("The conversion of %s took longer than %s.", u.fileName, u.timeout), nil)
+	case errors.Is(err, context.Canceled):
+		logField(w, "error", err)
+	case errors.As(err, &se):
+		writeFormProblem(w, u.fileName, se.detail, se.err, se.warnings)
+	default:
+		writeProblem(w, http.StatusInternalServerError, err.Error(), nil)
+	}
+}
+
+// name is the file name of the upload without extension.
+func (u *upload) name() string {
+	return strings.TrimSuffix(u.fileName, filepath.Ext(u.fileName))
+}
+
+// convert converts the upload to ajf.
+func (u *upload) convert() (*formats.AjfForm, error) {
+	var ajf *formats.AjfForm
+	err := u.run(timed("convert", func() (err error) {
+		ajf, err = formats.Convert(u.xls)
+		return err
+	}))
+	if err != nil {
+		return nil, &stepError{"Error converting xlsform", err, u.xls.Warnings}
+	}
+	return ajf, nil
+}
+
+func convertAjf(w http.ResponseWriter, r *http.Request) {
+	u := decodeUpload(w, r)
+	if u == nil {
+		return
+	}
+	ajf, err := u.convert()
+	if err != nil {
+		u.fail(w, err)
+		return
+	}
+	writeAjf(w, ajf)
+}
+
+func writeAjf(w http.ResponseWriter, ajf *formats.AjfForm) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	start := time.Now()
+	err := formats.EncIndentedJson(w, ajf)
+	metrics.observePhase("encode", time.Since(start))
+	if err != nil {
+		logField(w, "error", err)
+	}
+}
+
+// outputFormats maps the values of the format parameter to their media types.
+var outputFormats = map[string]string{
+	"ajf":   "application/json",
+	"xform": "application/xml",
+	"zip":   "application/zip",
+	"html":  "text/html",
+	"fhir":  "application/fhir+json",
+}
+
+// negotiateFormat chooses the output format from the format parameter
+// or, if it is missing, from the Accept header; ajf is the default.
+func negotiateFormat(r *http.Request) (format string, status int) {
+	if format := r.FormValue("format"); format != "" {
+		if outputFormats[format] == "" {
+			return "", http.StatusBadRequest
+		}
+		return format, http.StatusOK
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return "ajf", http.StatusOK
+	}
+	for _, a := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(a))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/json", "*/*", "application/*":
+			return "ajf", http.StatusOK
+		case "application/xml", "text/xml":
+			return "xform", http.StatusOK
+		case "application/zip":
+			return "zip", http.StatusOK
+		case "application/fhir+json":
+			return "fhir", http.StatusOK
+		}
+	}
+	return "", http.StatusNotAcceptable
+}
+
+func convertFormat(w http.ResponseWriter, r *http.Request) {
+	u := decodeUpload(w, r)
+	if u == nil {
+		return
+	}
+	format, status := negotiateFormat(r)
+	if status != http.StatusOK {
+		writeFormatProblem(w, status)
+		return
+	}
+	ajf, err := u.convert()
+	if err != nil {
+		u.fail(w, err)
+		return
+	}
+	resp, err := u.encode(ajf, format)
+	if err != nil {
+		u.fail(w, err)
+		return
+	}
+	writeResponse(w, resp)
+}
+
+func writeFormatProblem(w http.ResponseWriter, status int) {
+	writeProblem(w, status, "The supported formats are ajf (application/json), "+
+		"xform (application/xml), zip (application/zip), html and fhir (application/fhir+json).", nil)
+}
+
+// encode encodes the converted form in one of the outputFormats.
+func (u *upload) encode(ajf *formats.AjfForm, format string) (*response, error) {
+	var buf bytes.Buffer
+	resp := &response{Status: http.StatusOK, Header: make(http.Header)}
+	var err error
+	switch format {
+	case "ajf":
+		resp.Header.Set("Content-Type", "application/json; charset=utf-8")
+		err = u.run(timed("encode", func() error { return formats.EncIndentedJson(&buf, ajf) }))
+	case "xform":
+		resp.Header.Set("Content-Type", "application/xml; charset=utf-8")
+		resp.Header.Set("Content-Disposition", attachment(u.name()+".xml"))
+		err = u.run(timed("encode", func() error { return formats.EncXForm(&buf, u.xls, u.name(), u.name()) }))
+		if err != nil && !errors.Is(err, u.ctx.Err()) {
+			err = &stepError{"Error converting xlsform to XForm", err, u.xls.Warnings}
+		}
+	case "zip":
+		resp.Header.Set("Content-Type", "application/zip")
+		resp.Header.Set("Content-Disposition", attachment(u.name()+".zip"))
+		err = u.run(timed("encode", func() error { return zipOutputs(&buf, u, ajf) }))
+		if err != nil && !errors.Is(err, u.ctx.Err()) {
+			err = fmt.Errorf("Error creating zip: %w", err)
+		}
+	case "fhir":
+		resp.Header.Set("Content-Type", "application/fhir+json; charset=utf-8")
+		resp.Header.Set("Content-Disposition", attachment(u.name()+".fhir.json"))
+		err = u.run(timed("encode", func() error { return formats.EncFhirQuestionnaire(&buf, ajf, u.name(), u.name()) }))
+		if err != nil && !errors.Is(err, u.ctx.Err()) {
+			err = &stepError{"Error converting form to FHIR", err, u.xls.Warnings}
+		}
+	case "html":
+		resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+		// The preview shows uploaded content, it must not load anything.
+		resp.Header.Set("Content-Security-Policy",
+			"default-src 'none'; style-src 'unsafe-inline'; script-src 'unsafe-inline'")
+		err = u.run(timed("encode", func() error { return formats.EncPreview(&buf, ajf, u.name()) }))
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = buf.Bytes()
+	return resp, nil
+}
+
+// zipOutputs creates a zip archive with the form in all formats
+// and the diagnostics.json file, listing the warnings of the form
+// and the errors preventing a conversion.
+func zipOutputs(w io.Writer, u *upload, ajf *formats.AjfForm) error {
+	zw := zip.NewWriter(w)
+	diags := append(formats.Lint(u.xls), u.xls.Warnings...)
+	files := []struct {
+		name string
+		enc  func(w io.Writer) error
+	}{
+		{u.name() + ".json", func(w io.Writer) error { return formats.EncIndentedJson(w, ajf) }},
+		{u.name() + ".xml", func(w io.Writer) error { return formats.EncXForm(w, u.xls, u.name(), u.name()) }},
+		{u.name() + ".fhir.json", func(w io.Writer) error { return formats.EncFhirQuestionnaire(w, ajf, u.name(), u.name()) }},
+	}
+	for _, f := range files {
+		var out bytes.Buffer
+		err := f.enc(&out)
+		if err != nil {
+			diags = append(diags, formats.AsDiagnostic(err))
+			continue
+		}
+		zf, err := zw.Create(f.name)
+		if err != nil {
+			return err
+		}
+		if _, err := zf.Write(out.Bytes()); err != nil {
+			return err
+		}
+	}
+	for i := range diags {
+		diags[i].File = u.fileName
+	}
+	if diags == nil {
+		diags = []formats.Diagnostic{}
+	}
+	zf, err := zw.Create("diagnostics.json")
+	if err != nil {
+		return err
+	}
+	if err := formats.EncIndentedJson(zf, diags); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// preview responds with the html preview of the uploaded form.
+func preview(w http.ResponseWriter, r *http.Request) {
+	u := decodeUpload(w, r)
+	if u == nil {
+		return
+	}
+	ajf, err := u.convert()
+	if err != nil {
+		u.fail(w, err)
+		return
+	}
+	resp, err := u.encode(ajf, "html")
+	if err != nil {
+		u.fail(w, err)
+		return
+	}
+	writeResponse(w, resp)
+}
+
+// validate checks the uploaded form without converting it,
+// responding with the warnings found or with a problem.
+func validate(w http.ResponseWriter, r *http.Request) {
+	u := decodeUpload(w, r)
+	if u == nil {
+		return
+	}
+	if _, err := u.convert(); err != nil {
+		u.fail(w, err)
+		return
+	}
+	diags := append([]formats.Diagnostic(nil), u.xls.Warnings...)
+	diags = append(diags, formats.Lint(u.xls)...)
+	for i := range diags {
+		diags[i].File = u.fileName
+	}
+	if diags == nil {
+		diags = []formats.Diagnostic{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err := formats.EncIndentedJson(w, struct {
+		Valid       bool                 `json:"valid"`
+		Diagnostics []formats.Diagnostic `json:"diagnostics"`
+	}{true, diags})
+	if err != nil {
+		logField(w, "error", err)
+	}
+}
+
+func attachment(fileName string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": fileName})
+}
+
+func writeResponse(w http.ResponseWriter, resp *response) {
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.Status)
+	writeBody(w, resp.Body)
+}
+
+func writeBody(w http.ResponseWriter, body []byte) {
+	if _, err := w.Write(body); err != nil {
+		logField(w, "error", err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunHoldsSlotUntilEnd(t *testing.T) {
+	conversionSlots = make(chan struct{}, 1)
+	upload := func() (*upload, context.CancelFunc) {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		return &upload{ctx: ctx}, cancel
+	}
+
+	release, ended := make(chan struct{}), make(chan struct{})
+	u, cancel := upload()
+	defer cancel()
+	err := u.run(func() error {
+		<-release
+		close(ended)
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Slow conversion: expected a timeout, found %v", err)
+	}
+
+	called := false
+	u, cancel = upload()
+	defer cancel()
+	err = u.run(func() error { called = true; return nil })
+	if !errors.Is(err, context.DeadlineExceeded) || called {
+		t.Fatalf("Conversion started while the timed out one is running: %v", err)
+	}
+
+	close(release)
+	<-ended
+	u, cancel = upload()
+	defer cancel()
+	if err := u.run(func() error { return nil }); err != nil {
+		t.Fatalf("Conversion not started after the slot was released: %v", err)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+// Jobs convert forms in the background: POST /jobs queues a conversion
+// and responds immediately, the client then polls GET /jobs/{id}
+// and downloads GET /jobs/{id}/result when the job is done.
+// Jobs are kept in memory and discarded jobTTL after they end,
+// or earlier if their uploads and results take more than jobStoreSize:
+// then the oldest finished jobs are discarded first.
+
+type jobStatus string
+
+const (
+	jobQueued    jobStatus = "queued"
+	jobRunning   jobStatus = "running"
+	jobSucceeded jobStatus = "succeeded"
+	jobFailed    jobStatus = "failed"
+)
+
+var jobStatuses = []jobStatus{jobQueued, jobRunning, jobSucceeded, jobFailed}
+
+// A job is a queued conversion; its fields are protected by the mutex of the jobStore.
+type job struct {
+	Id          string               `json:"id"`
+	Status      jobStatus            `json:"status"`
+	File        string               `json:"file"`
+	Format      string               `json:"format"`
+	Created     time.Time            `json:"created"`
+	Started     *time.Time           `json:"started,omitempty"`
+	Finished    *time.Time           `json:"finished,omitempty"`
+	Error       string               `json:"error,omitempty"`
+	Diagnostics []formats.Diagnostic `json:"diagnostics"`
+
+	data   []byte    // the uploaded file, until the job starts
+	result *response // the output or the problem
+}
+
+type jobStore struct {
+	mu    sync.Mutex
+	jobs  map[string]*job
+	queue chan *job
+	size  int64 // bytes of the uploads and results of the jobs
+}
+
+var jobs *jobStore
+
+// startJobs creates the store of jobs and starts its workers.
+func startJobs(workers, queueSize int) {
+	jobs = &jobStore{jobs: make(map[string]*job), queue: make(chan *job, queueSize)}
+	for i := 0; i < workers; i++ {
+		go jobs.work()
+	}
+	go jobs.expire()
+}
+
+func (s *jobStore) get(id string) *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jobs[id]
+}
+
+// add queues a job, returning false if the queue is full
+// or its upload doesn't fit in jobStoreSize.
+func (s *jobStore) add(j *job) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	size := int64(len(j.data))
+	if !s.makeRoom(size) {
+		return false
+	}
+	select {
+	case s.queue <- j:
+		s.jobs[j.Id] = j
+		s.size += size
+		return true
+	default:
+		return false
+	}
+}
+
+// makeRoom discards the oldest finished jobs until size more bytes
+// fit in jobStoreSize, returning false (without discarding any job)
+// if they can't fit.
+func (s *jobStore) makeRoom(size int64) bool {
+	if s.size+size <= conf.jobStoreSize {
+		return true
+	}
+	var finished []*job
+	minSize := s.size + size // after discarding all the finished jobs
+	for _, j := range s.jobs {
+		if j.Finished != nil {
+			finished = append(finished, j)
+			minSize -= j.size()
+		}
+	}
+	if minSize > conf.jobStoreSize {
+		return false
+	}
+	sort.Slice(finished, func(a, b int) bool { return finished[a].Finished.Before(*finished[b].Finished) })
+	for _, j := range finished {
+		if s.size+size <= conf.jobStoreSize {
+			break
+		}
+		s.remove(j)
+	}
+	return true
+}
+
+// size is the number of bytes of the upload and result of j.
+func (j *job) size() int64 {
+	size := int64(len(j.data))
+	if j.result != nil {
+		size += int64(len(j.result.Body))
+	}
+	return size
+}
+
+// remove discards a job.
+func (s *jobStore) remove(j *job) {
+	delete(s.jobs, j.Id)
+	s.size -= j.size()
+}
+
+// snapshot returns a copy of the exported fields of j.
+func (s *jobStore) snapshot(j *job) job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := *j
+	c.data, c.result = nil, nil
+	if c.Diagnostics == nil {
+		c.Diagnostics = []formats.Diagnostic{}
+	}
+	return c
+}
+
+func (s *jobStore) work() {
+	for j := range s.queue {
+		s.mu.Lock()
+		started := time.Now().UTC()
+		j.Status, j.Started = jobRunning, &started
+		data := j.data
+		j.data = nil
+		s.size -= int64(len(data))
+		s.mu.Unlock()
+
+		result, diags, err := runJob(j.File, j.Format, data)
+		result = s.finish(j, result, diags, err)
+		metrics.countConversion("jobs", outcome(result.Status, false))
+		logJSON("info", "Job finished.", "job_id", j.Id, "file", j.File, "status", s.snapshot(j).Status,
+			"duration_ms", float64(time.Since(started).Microseconds())/1000)
+	}
+}
+
+// finish stores the result of a job, returning the result kept:
+// if it doesn't fit in jobStoreSize, the job fails with a problem instead.
+func (s *jobStore) finish(j *job, result *response, diags []formats.Diagnostic, err error) *response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Room is made before the job is finished, so it can't discard itself.
+	if !s.makeRoom(int64(len(result.Body))) {
+		err = fmt.Errorf("The result of the conversion of %s is too large to be kept (%d bytes).", j.File, len(result.Body))
+		bw := newBufferWriter()
+		writeProblem(bw, http.StatusInsufficientStorage, err.Error(), nil)
+		result = bw.resp
+	}
+	finished := time.Now().UTC()
+	j.Finished, j.result, j.Diagnostics = &finished, result, diags
+	if err != nil {
+		j.Status, j.Error = jobFailed, err.Error()
+	} else {
+		j.Status = jobSucceeded
+	}
+	s.size += int64(len(result.Body)) // the problem is kept even if it exceeds jobStoreSize
+	return result
+}
+
+// runJob converts a form, returning the response for the result
+// (the problem if the conversion fails) and the diagnostics.
+func runJob(fileName, format string, data []byte) (*response, []formats.Diagnostic, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), conf.jobTimeout)
+	defer cancel()
+	u := &upload{ctx: ctx, timeout: conf.jobTimeout, fileName: fileName}
+	fail := func(err error) (*response, []formats.Diagnostic, error) {
+		var diags []formats.Diagnostic
+		var se *stepError
+		if errors.As(err, &se) {
+			diags = append(append(diags, se.warnings...), formats.AsDiagnostic(se.err))
+		}
+		for i := range diags {
+			diags[i].File = fileName
+		}
+		bw := newBufferWriter()
+		u.fail(bw, err)
+		return bw.resp, diags, err
+	}
+
+	metrics.observeInputSize(int64(len(data)))
+	if err := u.decode(bytes.NewReader(data), int64(len(data))); err != nil {
+		return fail(err)
+	}
+	ajf, err := u.convert()
+	if err != nil {
+		return fail(err)
+	}
+	resp, err := u.encode(ajf, format)
+	if err != nil {
+		return fail(err)
+	}
+	diags := append([]formats.Diagnostic(nil), u.xls.Warnings...)
+	diags = append(diags, formats.Lint(u.xls)...)
+	for i := range diags {
+		diags[i].File = fileName
+	}
+	return resp, diags, nil
+}
+
+// expire periodically discards the jobs that ended more than jobTTL ago.
+func (s *jobStore) expire() {
+	for range time.Tick(time.Minute) {
+		s.mu.Lock()
+		for _, j := range s.jobs {
+			if j.Finished != nil && time.Since(*j.Finished) > conf.jobTTL {
+				s.remove(j)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *jobStore) writeMetrics(w io.Writer) {
+	counts := make(map[jobStatus]int)
+	s.mu.Lock()
+	for _, j := range s.jobs {
+		counts[j.Status]++
+	}
+	s.mu.Unlock()
+	fmt.Fprintln(w, "# HELP formconv_jobs Conversion jobs in memory by status.")
+	fmt.Fprintln(w, "# TYPE formconv_jobs gauge")
+	for _, st := range jobStatuses {
+		fmt.Fprintf(w, "formconv_jobs{status=%q} %d\n", st, counts[st])
+	}
+}
+
+// createJob handles POST /jobs, queueing the conversion of the uploaded form
+// to the format given by the parameter format (ajf by default).
+func createJob(w http.ResponseWriter, r *http.Request) {
+	f, head := uploadedFile(w, r)
+	if f == nil {
+		return
+	}
+	defer f.Close()
+	logField(w, "file", head.Filename)
+	logField(w, "size", head.Size)
+	format := r.FormValue("format")
+	if format == "" {
+		format = "ajf"
+	}
+	if outputFormats[format] == "" {
+		writeFormatProblem(w, http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, fmt.Sprintf("Error reading POST file: %s", err), nil)
+		return
+	}
+
+	j := &job{
+		Id:      randomId(),
+		Status:  jobQueued,
+		File:    head.Filename,
+		Format:  format,
+		Created: time.Now().UTC(),
+		data:    data,
+	}
+	if !jobs.add(j) {
+		w.Header().Set("Retry-After", "60")
+		writeProblem(w, http.StatusServiceUnavailable, "Too many jobs, retry later.", nil)
+		return
+	}
+	logField(w, "job_id", j.Id)
+	w.Header().Set("Location", "/jobs/"+j.Id)
+	writeJob(w, http.StatusAccepted, jobs.snapshot(j))
+}
+
+// jobHandler handles GET /jobs/{id} and GET /jobs/{id}/result.
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET, OPTIONS")
+		writeProblem(w, http.StatusMethodNotAllowed, fmt.Sprintf("Unsupported method %s.", r.Method), nil)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	id := strings.TrimSuffix(path, "/result")
+	j := jobs.get(id)
+	if j == nil || strings.Contains(id, "/") {
+		writeProblem(w, http.StatusNotFound, fmt.Sprintf("Job %s not found.", id), nil)
+		return
+	}
+	snap := jobs.snapshot(j)
+	if id == path {
+		writeJob(w, http.StatusOK, snap)
+		return
+	}
+	if snap.Finished == nil {
+		w.Header().Set("Retry-After", "5")
+		writeProblem(w, http.StatusConflict, fmt.Sprintf("Job %s is %s.", id, snap.Status), nil)
+		return
+	}
+	jobs.mu.Lock()
+	result := j.result
+	jobs.mu.Unlock()
+	writeResponse(w, result)
+}
+
+func writeJob(w http.ResponseWriter, status int, j job) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := formats.EncIndentedJson(w, j); err != nil {
+		logField(w, "error", err)
+	}
+}
+
+// A bufferWriter is a ResponseWriter that stores the response.
+type bufferWriter struct {
+	resp *response
+	body bytes.Buffer
+}
+
+func newBufferWriter() *bufferWriter {
+	return &bufferWriter{resp: &response{Header: make(http.Header)}}
+}
+
+func (b *bufferWriter) Header() http.Header { return b.resp.Header }
+
+func (b *bufferWriter) WriteHeader(status int) {
+	if b.resp.Status == 0 {
+		b.resp.Status = status
+	}
+}
+
+func (b *bufferWriter) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	n, err := b.body.Write(p)
+	b.resp.Body = b.body.Bytes()
+	return n, err
+}
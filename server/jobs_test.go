@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestJobStoreSize(t *testing.T) {
+	defer func(size int64) { conf.jobStoreSize = size }(conf.jobStoreSize)
+	conf.jobStoreSize = 100
+	s := &jobStore{jobs: make(map[string]*job)}
+	running := func(id string) *job {
+		j := &job{Id: id, File: id + ".xlsx", Status: jobRunning}
+		s.jobs[id] = j
+		return j
+	}
+	body := func(n int) *response {
+		return &response{Status: http.StatusOK, Body: bytes.Repeat([]byte{'x'}, n)}
+	}
+
+	old := running("old")
+	s.finish(old, body(60), nil, nil)
+
+	// A result larger than the store fails the job, which is kept.
+	big := running("big")
+	if resp := s.finish(big, body(150), nil, nil); resp.Status != http.StatusInsufficientStorage {
+		t.Fatalf("Too large result stored with status %d.", resp.Status)
+	}
+	if s.get("big") == nil || big.Status != jobFailed || big.Error == "" {
+		t.Fatalf("Job with a too large result not kept as failed: %+v", s.snapshot(big))
+	}
+	if s.get("old") == nil {
+		t.Fatalf("Finished job discarded although the result couldn't fit anyway.")
+	}
+
+	// A result fitting after discarding the oldest jobs discards them, not itself.
+	fits := running("fits")
+	if resp := s.finish(fits, body(60), nil, nil); resp.Status != http.StatusOK {
+		t.Fatalf("Result fitting in the store not kept: status %d.", resp.Status)
+	}
+	if s.get("fits") == nil || fits.Status != jobSucceeded || s.get("old") != nil {
+		t.Fatalf("Wrong jobs kept: %v", s.jobs)
+	}
+	if s.size > conf.jobStoreSize {
+		t.Fatalf("Store size %d over the limit.", s.size)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var logMu sync.Mutex
+
+// logJSON writes a log entry as a line of json on stderr;
+// fields are pairs of keys and values.
+func logJSON(level, msg string, fields ...interface{}) {
+	entry := map[string]interface{}{
+		"time":  time.Now().UTC().Format(time.RFC3339Nano),
+		"level": level,
+		"msg":   msg,
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		key, _ := fields[i].(string)
+		val := fields[i+1]
+		if err, ok := val.(error); ok {
+			val = err.Error()
+		}
+		entry[key] = val
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data = []byte(`{"level":"error","msg":"Error encoding log entry"}`)
+	}
+	logMu.Lock()
+	os.Stderr.Write(append(data, '\n'))
+	logMu.Unlock()
+}
+
+// A recorder wraps the ResponseWriter of a request,
+// collecting what is needed for logs and metrics.
+type recorder struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	writeErr error
+	fields   []interface{} // added to the log of the request
+}
+
+func (r *recorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
+
+func (r *recorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	if err != nil && r.writeErr == nil {
+		r.writeErr = err
+	}
+	return n, err
+}
+
+// logField adds a field to the log of the request written by w,
+// like the file name or an error that couldn't be reported to the client.
+func logField(w http.ResponseWriter, key string, val interface{}) {
+	for {
+		switch ww := w.(type) {
+		case *recorder:
+			ww.fields = append(ww.fields, key, val)
+			return
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = ww.Unwrap()
+		default:
+			return
+		}
+	}
+}
+
+func randomId() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// logRequests logs every request with its id, taken from the header
+// X-Request-Id or generated, and returned in the response.
+// Requests to conversion endpoints are also counted in the metrics.
+func logRequests(h http.Handler, conversionEndpoints map[string]bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get("X-Request-Id")
+		if id == "" || len(id) > 64 {
+			id = randomId()
+		}
+		w.Header().Set("X-Request-Id", id)
+		rec := &recorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		canceled := r.Context().Err() != nil
+		fields := []interface{}{
+			"request_id", id,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"remote_addr", r.RemoteAddr,
+		}
+		fields = append(fields, rec.fields...)
+		level := "info"
+		if canceled {
+			fields = append(fields, "canceled", true)
+			level = "warn"
+		}
+		if rec.writeErr != nil {
+			fields = append(fields, "write_error", rec.writeErr)
+			level = "error"
+		}
+		if rec.status >= 500 {
+			level = "error"
+		}
+		logJSON(level, "Request.", fields...)
+
+		if conversionEndpoints[r.URL.Path] && r.Method == http.MethodPost {
+			metrics.countConversion(endpointName(r.URL.Path), outcome(rec.status, canceled))
+		}
+	})
+}
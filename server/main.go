@@ -1,75 +1,105 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
-	"path/filepath"
-
-	"github.com/gnucoop/formconv/formats"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		log.Fatal("$PORT must be set!")
+	err := loadConfig()
+	if err != nil {
+		logJSON("error", err.Error())
+		os.Exit(1)
 	}
 
-	http.Handle("/", http.FileServer(http.Dir("./server/static")))
-	http.HandleFunc("/result.json", convert)
+	if conf.cacheSize > 0 {
+		cache = newLruCache(conf.cacheSize, conf.cacheDir, conf.cacheDirSize)
+	}
 
-	log.Fatal(http.ListenAndServe(":"+port, nil))
-}
+	conversionSlots = make(chan struct{}, conf.maxConversions)
+	startJobs(conf.jobWorkers, conf.jobQueueSize)
+	if conf.rateLimit > 0 {
+		limiter = newRateLimiter(conf.rateLimit, conf.rateBurst)
+	}
+	if len(conf.apiKeys) > 0 {
+		authFailures = newRateLimiter(float64(conf.authFailures), conf.authFailures)
+	}
 
-func setAllowOrigins(h http.Header) { h.Set("Access-Control-Allow-Origin", "*") }
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.Dir("./server/static")))
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/result.json", protect(postHandler(cached(convertAjf))))
+	mux.HandleFunc("/convert", protect(postHandler(cached(convertFormat))))
+	mux.HandleFunc("/validate", protect(postHandler(cached(validate))))
+	mux.HandleFunc("/preview", protect(postHandler(cached(preview))))
+	mux.HandleFunc("/jobs", protect(postHandler(createJob)))
+	mux.HandleFunc("/jobs/", protect(jobHandler))
+	mux.HandleFunc("/metrics", protectUnlimited(serveMetrics))
+	conversionEndpoints := map[string]bool{"/result.json": true, "/convert": true, "/validate": true, "/preview": true}
 
-func convert(w http.ResponseWriter, r *http.Request) {
-	setAllowOrigins(w.Header())
+	srv := &http.Server{
+		Addr:    ":" + conf.port,
+		Handler: logRequests(mux, conversionEndpoints),
+		// Uploads are read entirely before converting, ReadTimeout covers them.
+		ReadTimeout:       conf.readTimeout,
+		ReadHeaderTimeout: conf.readTimeout,
+		WriteTimeout:      conf.writeTimeout,
+		IdleTimeout:       2 * conf.readTimeout,
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		logJSON("info", "Shutting down...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), conf.shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logJSON("error", "Error shutting down.", "error", err)
+		}
+	}()
 
-	switch r.Method {
-	case http.MethodOptions:
-		// OK
-	case http.MethodGet:
-		fmt.Fprintln(w, "You should POST an excel file here.")
-	case http.MethodPost:
-		convertPost(w, r)
-	default:
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Unsupported method %s", r.Method)
+	logJSON("info", "Listening.", "addr", srv.Addr)
+	err = srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		logJSON("error", err.Error())
+		os.Exit(1)
 	}
+	// ListenAndServe returns as soon as Shutdown is called,
+	// wait for the requests in progress.
+	<-shutdownDone
 }
 
-func convertPost(w http.ResponseWriter, r *http.Request) {
-	f, head, err := r.FormFile("excelFile")
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Error retrieving POST file: %s", err)
-		return
-	}
-	defer f.Close()
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
 
-	wb, err := formats.NewWorkBook(f, filepath.Ext(head.Filename), head.Size)
-	if err != nil {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		fmt.Fprintf(w, "Error opening workbook: %s", err)
-		return
-	}
-	xls, err := formats.DecXlsform(wb)
-	if err != nil {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		fmt.Fprintf(w, "Error decoding xlsform: %s", err)
-		return
-	}
-	ajf, err := formats.Convert(xls)
-	if err != nil {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		fmt.Fprintln(w, err)
-		return
-	}
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	err = formats.EncIndentedJson(w, ajf)
-	if err != nil {
-		log.Printf("Error writing json response: %s", err)
+// postHandler returns a handler for endpoints that expect
+// an excel file to be POSTed.
+func postHandler(post http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			fmt.Fprintln(w, "You should POST an excel file here.")
+		case http.MethodPost:
+			if r.ContentLength > conf.maxUploadSize {
+				writeTooLarge(w)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, conf.maxUploadSize)
+			ctx, cancel := context.WithTimeout(r.Context(), conf.convertTimeout)
+			defer cancel()
+			post(w, r.WithContext(ctx))
+		default:
+			w.Header().Set("Allow", "GET, POST, OPTIONS")
+			writeProblem(w, http.StatusMethodNotAllowed, fmt.Sprintf("Unsupported method %s.", r.Method), nil)
+		}
 	}
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are exposed in the Prometheus text format,
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+type histogram struct {
+	bounds []float64 // upper bounds of the buckets, +Inf excluded
+	counts []uint64  // non-cumulative counts, the last is for +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v) // first bound >= v
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cum uint64
+	for i, b := range h.bounds {
+		cum += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%g\"} %d\n", name, labels, sep, b, cum)
+	}
+	cum += h.counts[len(h.bounds)]
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, cum)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+var phases = []string{"decode", "convert", "encode"}
+
+type serverMetrics struct {
+	mu          sync.Mutex
+	conversions map[[2]string]uint64 // by endpoint and outcome
+	phases      map[string]*histogram
+	inputSize   *histogram
+	cache       map[string]uint64 // by result, hit or miss
+}
+
+var metrics = newServerMetrics()
+
+func newServerMetrics() *serverMetrics {
+	m := &serverMetrics{
+		conversions: make(map[[2]string]uint64),
+		phases:      make(map[string]*histogram),
+		cache:       make(map[string]uint64),
+		inputSize:   newHistogram(1<<10, 4<<10, 16<<10, 64<<10, 256<<10, 1<<20, 4<<20, 16<<20, 64<<20),
+	}
+	for _, p := range phases {
+		m.phases[p] = newHistogram(.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30)
+	}
+	return m
+}
+
+func (m *serverMetrics) countConversion(endpoint, outcome string) {
+	m.mu.Lock()
+	m.conversions[[2]string{endpoint, outcome}]++
+	m.mu.Unlock()
+}
+
+func (m *serverMetrics) countCache(result string) {
+	m.mu.Lock()
+	m.cache[result]++
+	m.mu.Unlock()
+}
+
+func (m *serverMetrics) observePhase(phase string, d time.Duration) {
+	m.mu.Lock()
+	m.phases[phase].observe(d.Seconds())
+	m.mu.Unlock()
+}
+
+func (m *serverMetrics) observeInputSize(size int64) {
+	m.mu.Lock()
+	m.inputSize.observe(float64(size))
+	m.mu.Unlock()
+}
+
+func (m *serverMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP formconv_conversions_total Conversion requests by endpoint and outcome.")
+	fmt.Fprintln(w, "# TYPE formconv_conversions_total counter")
+	keys := make([][2]string, 0, len(m.conversions))
+	for k := range m.conversions {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "formconv_conversions_total{endpoint=%q,outcome=%q} %d\n", k[0], k[1], m.conversions[k])
+	}
+
+	fmt.Fprintln(w, "# HELP formconv_phase_duration_seconds Duration of the phases of conversions.")
+	fmt.Fprintln(w, "# TYPE formconv_phase_duration_seconds histogram")
+	for _, p := range phases {
+		m.phases[p].write(w, "formconv_phase_duration_seconds", fmt.Sprintf("phase=%q", p))
+	}
+
+	fmt.Fprintln(w, "# HELP formconv_input_size_bytes Size of the uploaded workbooks.")
+	fmt.Fprintln(w, "# TYPE formconv_input_size_bytes histogram")
+	m.inputSize.write(w, "formconv_input_size_bytes", "")
+
+	fmt.Fprintln(w, "# HELP formconv_cache_requests_total Lookups in the conversion cache by result.")
+	fmt.Fprintln(w, "# TYPE formconv_cache_requests_total counter")
+	for _, result := range []string{"hit", "miss"} {
+		fmt.Fprintf(w, "formconv_cache_requests_total{result=%q} %d\n", result, m.cache[result])
+	}
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.write(w)
+	jobs.writeMetrics(w)
+}
+
+// outcome classifies the result of a conversion request by its status.
+func outcome(status int, canceled bool) string {
+	switch {
+	case canceled:
+		return "canceled"
+	case status < 300:
+		return "success"
+	case status == http.StatusPreconditionFailed:
+		return "unchanged"
+	case status == http.StatusUnprocessableEntity:
+		return "invalid_form"
+	case status == http.StatusRequestEntityTooLarge:
+		return "too_large"
+	case status == http.StatusServiceUnavailable:
+		return "timeout"
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return "unauthorized"
+	case status == http.StatusTooManyRequests:
+		return "rate_limited"
+	case status < 500:
+		return "bad_request"
+	}
+	return "error"
+}
+
+// endpointName is the endpoint label of a path.
+func endpointName(path string) string { return strings.TrimPrefix(path, "/") }
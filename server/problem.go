@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+// A problem is the body of error responses, in the format
+// of RFC 7807 (application/problem+json) with the extension
+// member "diagnostics", listing the problems found in the form.
+type problem struct {
+	Type        string               `json:"type"`
+	Title       string               `json:"title"`
+	Status      int                  `json:"status"`
+	Detail      string               `json:"detail,omitempty"`
+	Diagnostics []formats.Diagnostic `json:"diagnostics,omitempty"`
+}
+
+func writeProblem(w http.ResponseWriter, status int, detail string, diags []formats.Diagnostic) {
+	p := problem{
+		Type:        "about:blank",
+		Title:       http.StatusText(status),
+		Status:      status,
+		Detail:      detail,
+		Diagnostics: diags,
+	}
+	w.Header().Set("Content-Type", "application/problem+json; charset=utf-8")
+	w.WriteHeader(status)
+	err := formats.EncIndentedJson(w, p)
+	if err != nil {
+		logField(w, "error", err)
+	}
+}
+
+// writeFormProblem responds with status 422 (Unprocessable Entity),
+// listing err and the warnings found in the form.
+func writeFormProblem(w http.ResponseWriter, fileName, detail string, err error, warnings []formats.Diagnostic) {
+	diags := append([]formats.Diagnostic{}, warnings...)
+	diags = append(diags, formats.AsDiagnostic(err))
+	for i := range diags {
+		diags[i].File = fileName
+	}
+	writeProblem(w, http.StatusUnprocessableEntity, detail+": "+err.Error(), diags)
+}
+
+func writeTooLarge(w http.ResponseWriter) {
+	writeProblem(w, http.StatusRequestEntityTooLarge,
+		fmt.Sprintf("The request must not be larger than %d bytes.", conf.maxUploadSize), nil)
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+var simulateCmd = newCommand("simulate", "fill in xlsforms, computing their calculations, relevance and constraints")
+
+type simulateOptions struct {
+	answers string // json file with the answers, interactive if empty
+	save    string // json file where interactive answers are saved
+	json    bool
+}
+
+func init() {
+	in := inputFlags(simulateCmd.flags)
+	opts := new(simulateOptions)
+	simulateCmd.flags.StringVar(&opts.answers, "answers", "", "json file with the answers; without it, the answers are asked on the terminal")
+	simulateCmd.flags.StringVar(&opts.save, "save", "", "json file where the answers given on the terminal are saved")
+	simulateCmd.flags.BoolVar(&opts.json, "json", false, "print the result as json")
+	simulateCmd.args = "form.xlsx"
+	simulateCmd.run = func(files []string) bool {
+		return forEachFile(files, func(fileName string) error {
+			return simulate(fileName, in, opts)
+		})
+	}
+}
+
+func simulate(xlsName string, in *inputOptions, opts *simulateOptions) error {
+	xls, err := decodeFile(xlsName, in)
+	if err != nil {
+		return err
+	}
+	ajf, err := formats.Convert(xls)
+	if err != nil {
+		return fmt.Errorf("%s, %w", xlsName, err)
+	}
+
+	answers := make(map[string]interface{})
+	if opts.answers != "" {
+		data, err := os.ReadFile(opts.answers)
+		if err != nil {
+			return fmt.Errorf("Error reading answers: %s", err)
+		}
+		if err := json.Unmarshal(data, &answers); err != nil {
+			return fmt.Errorf("Error decoding answers %s: %s", opts.answers, err)
+		}
+	} else {
+		if xlsName == "-" {
+			return fmt.Errorf("The answers must be given with -answers when the form is read from stdin.")
+		}
+		s := &session{ajf: ajf, answers: answers, in: bufio.NewScanner(os.Stdin), out: os.Stdout}
+		if err := s.run(); err != nil {
+			return err
+		}
+		if opts.save != "" {
+			f, err := os.Create(opts.save)
+			if err != nil {
+				return fmt.Errorf("Error saving answers: %s", err)
+			}
+			defer f.Close()
+			if err := formats.EncIndentedJson(f, answers); err != nil {
+				return fmt.Errorf("Error saving answers: %s", err)
+			}
+		}
+	}
+
+	sim := formats.Simulate(ajf, answers)
+	if opts.json {
+		if err := formats.EncIndentedJson(os.Stdout, sim); err != nil {
+			return err
+		}
+	} else {
+		printSimulation(os.Stdout, sim)
+	}
+	if n := len(sim.Failures) + len(sim.Errors); n > 0 {
+		return fmt.Errorf("%d failed validations or formula errors.", n)
+	}
+	return nil
+}
+
+func printSimulation(w io.Writer, sim *formats.Simulation) {
+	var names, hidden []string
+	for name := range sim.Values {
+		names = append(names, name)
+	}
+	for name, visible := range sim.Visible {
+		if !visible {
+			hidden = append(hidden, name)
+		}
+	}
+	sort.Strings(names)
+	sort.Strings(hidden)
+	fmt.Fprintln(w, "Values:")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s = %s\n", name, formatValue(sim.Values[name]))
+	}
+	if len(hidden) > 0 {
+		fmt.Fprintf(w, "Hidden: %s\n", strings.Join(hidden, ", "))
+	}
+	for _, f := range sim.Failures {
+		fmt.Fprintf(w, "Invalid %s: %s\n", f.Field, f.Message)
+	}
+	for _, e := range sim.Errors {
+		fmt.Fprintf(w, "Error in %s: %s\n", e.Field, e.Message)
+	}
+}
+
+func formatValue(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+// A session asks the answers of a form on the terminal, slide by slide,
+// showing only the visible fields and the computed values.
+type session struct {
+	ajf     *formats.AjfForm
+	answers map[string]interface{}
+	sim     *formats.Simulation
+	in      *bufio.Scanner
+	out     io.Writer
+}
+
+func (s *session) update() { s.sim = formats.Simulate(s.ajf, s.answers) }
+
+func (s *session) run() error {
+	fmt.Fprintln(s.out, "Empty answers are skipped, end the input (ctrl-D) to stop.")
+	s.update()
+	for i := range s.ajf.Slides {
+		slide := &s.ajf.Slides[i]
+		if !s.sim.Visible[slide.Name] {
+			continue
+		}
+		fmt.Fprintf(s.out, "\n== %s ==\n", slide.Label)
+		if slide.Type != formats.NtRepeatingSlide {
+			if err := s.nodes(slide.Nodes, ""); err != nil {
+				return err
+			}
+			continue
+		}
+		n, err := s.ask(fmt.Sprintf("Number of repetitions (%s)", slide.Name), func(in string) (interface{}, error) {
+			n, err := strconv.Atoi(in)
+			if err != nil || n < 0 || slide.MaxReps != nil && *slide.MaxReps > 0 && n > *slide.MaxReps {
+				return nil, fmt.Errorf("Invalid number of repetitions.")
+			}
+			return float64(n), nil
+		})
+		if err != nil {
+			return err
+		}
+		if n != nil {
+			s.answers[slide.Name] = n
+		}
+		s.update()
+		for r := 0; r < formats.Reps(slide, s.answers[slide.Name]); r++ {
+			fmt.Fprintf(s.out, "-- %d --\n", r+1)
+			if err := s.nodes(slide.Nodes, fmt.Sprintf("__%d", r)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *session) nodes(nodes []formats.Node, suffix string) error {
+	for i := range nodes {
+		n := &nodes[i]
+		name := n.Name + suffix
+		if !s.sim.Visible[name] {
+			continue
+		}
+		if n.Type == formats.NtGroup {
+			fmt.Fprintf(s.out, "%s\n", n.Label)
+			if err := s.nodes(n.Nodes, suffix); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.field(n, name, suffix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *session) field(n *formats.Node, name, suffix string) error {
+	ft := formats.FtString
+	if n.FieldType != nil {
+		ft = *n.FieldType
+	}
+	switch ft {
+	case formats.FtNote:
+		fmt.Fprintf(s.out, "%s\n", n.HTML)
+		return nil
+	case formats.FtFormula:
+		fmt.Fprintf(s.out, "%s = %s\n", n.Label, formatValue(s.sim.Values[name]))
+		return nil
+	case formats.FtTable:
+		fmt.Fprintf(s.out, "%s\n", n.Label)
+		for i, row := range n.Rows {
+			for j, cell := range row {
+				cellName := fmt.Sprintf("%s__%d__%d", n.Name, i, j) + suffix
+				prompt := fmt.Sprintf("%s, %s", n.RowLabels[i], n.ColumnLabels[j])
+				if _, ok := cell.(formats.Formula); ok {
+					fmt.Fprintf(s.out, "%s = %s\n", prompt, formatValue(s.sim.Values[cellName]))
+					continue
+				}
+				parse := parseString
+				if n.ColumnTypes[j] == "number" {
+					parse = parseNumber
+				}
+				if err := s.answer(cellName, prompt, parse); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	prompt := fmt.Sprintf("%s (%s)", n.Label, name)
+	if cur, ok := s.sim.Values[name]; ok {
+		prompt += fmt.Sprintf(" [%s]", formatValue(cur))
+	}
+	parse := parseString
+	switch ft {
+	case formats.FtNumber, formats.FtRange:
+		parse = parseNumber
+	case formats.FtBoolean:
+		parse = parseBool
+	case formats.FtSingleChoice, formats.FtMultipleChoice:
+		choices := s.sim.FilterChoices(s.ajf, n)
+		for i, c := range choices {
+			fmt.Fprintf(s.out, "  %d. %s (%s)\n", i+1, c["label"], c["value"])
+		}
+		parse = choiceParser(choices, ft == formats.FtMultipleChoice)
+	}
+	if err := s.answer(name, prompt, parse); err != nil {
+		return err
+	}
+	for _, f := range s.sim.Failures {
+		if f.Field == name {
+			fmt.Fprintf(s.out, "  ! %s\n", f.Message)
+		}
+	}
+	return nil
+}
+
+// answer asks the answer of a field and updates the simulation.
+func (s *session) answer(name, prompt string, parse func(string) (interface{}, error)) error {
+	v, err := s.ask(prompt, parse)
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		s.answers[name] = v
+		s.update()
+	}
+	return nil
+}
+
+// ask reads an answer until it's valid, returning nil for empty answers.
+func (s *session) ask(prompt string, parse func(string) (interface{}, error)) (interface{}, error) {
+	for {
+		fmt.Fprintf(s.out, "%s: ", prompt)
+		if !s.in.Scan() {
+			if err := s.in.Err(); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("Input ended before the end of the form.")
+		}
+		in := strings.TrimSpace(s.in.Text())
+		if in == "" {
+			return nil, nil
+		}
+		v, err := parse(in)
+		if err == nil {
+			return v, nil
+		}
+		fmt.Fprintf(s.out, "  %s\n", err)
+	}
+}
+
+func parseString(in string) (interface{}, error) { return in, nil }
+
+func parseNumber(in string) (interface{}, error) {
+	n, err := strconv.ParseFloat(in, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Not a number.")
+	}
+	return n, nil
+}
+
+func parseBool(in string) (interface{}, error) {
+	switch strings.ToLower(in) {
+	case "y", "yes", "true", "1":
+		return true, nil
+	case "n", "no", "false", "0":
+		return false, nil
+	}
+	return nil, fmt.Errorf("Answer yes or no.")
+}
+
+// choiceParser parses choices given by value or by number,
+// separated by spaces or commas if multiple.
+func choiceParser(choices []formats.Choice, multiple bool) func(string) (interface{}, error) {
+	return func(in string) (interface{}, error) {
+		words := []string{in}
+		if multiple {
+			words = strings.FieldsFunc(in, func(r rune) bool { return r == ' ' || r == ',' })
+		}
+		var values []interface{}
+		for _, w := range words {
+			value := ""
+			for _, c := range choices {
+				if c["value"] == w {
+					value = w
+				}
+			}
+			if n, err := strconv.Atoi(w); value == "" && err == nil && n >= 1 && n <= len(choices) {
+				value = choices[n-1]["value"]
+			}
+			if value == "" {
+				return nil, fmt.Errorf("Invalid choice %q.", w)
+			}
+			values = append(values, value)
+		}
+		if !multiple {
+			return values[0], nil
+		}
+		return values, nil
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+var sqlCmd = newCommand("sql", "write the sql tables for storing the submissions of xlsforms")
+
+type sqlOptions struct {
+	dialect string
+	table   string
+}
+
+func init() {
+	in := inputFlags(sqlCmd.flags)
+	out := outputPathFlag(sqlCmd.flags)
+	sqlCmd.flags.Lookup("o").Usage = outputFileUsage
+	opts := new(sqlOptions)
+	sqlCmd.flags.StringVar(&opts.dialect, "dialect", "postgres", "sql dialect: postgres or sqlite")
+	sqlCmd.flags.StringVar(&opts.table, "table", "", "name of the table of submissions (the name of the form file by default)")
+	sqlCmd.run = func(files []string) bool {
+		if opts.dialect != "postgres" && opts.dialect != "sqlite" {
+			fmt.Fprintln(os.Stderr, "The dialect must be postgres or sqlite.")
+			return false
+		}
+		if err := out.init(len(files)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return false
+		}
+		return forEachFile(files, func(fileName string) error {
+			return sql(fileName, opts, in, out)
+		})
+	}
+}
+
+var nonIdentChars = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// tableName makes a table name from the name of a form file.
+func tableName(xlsName string) string {
+	if xlsName == "-" {
+		return "submissions"
+	}
+	name := strings.ToLower(strings.TrimSuffix(filepath.Base(xlsName), filepath.Ext(xlsName)))
+	name = strings.Trim(nonIdentChars.ReplaceAllString(name, "_"), "_")
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		name = "form_" + name
+	}
+	return name
+}
+
+func sql(xlsName string, opts *sqlOptions, in *inputOptions, out *outputOptions) error {
+	sqlName, err := out.fileName(xlsName, ".sql")
+	if err != nil {
+		return err
+	}
+	xls, err := decodeFile(xlsName, in)
+	if err != nil {
+		return err
+	}
+	ajf, err := formats.Convert(xls)
+	if err != nil {
+		return fmt.Errorf("%s, %w", xlsName, err)
+	}
+	table := opts.table
+	if table == "" {
+		table = tableName(xlsName)
+	}
+	dialect := formats.Postgres
+	if opts.dialect == "sqlite" {
+		dialect = formats.SQLite
+	}
+	err = out.write(sqlName, func(w io.Writer) error { return formats.EncSql(w, ajf, table, dialect) })
+	if err != nil {
+		return fmt.Errorf("Error writing file %s: %s", sqlName, err)
+	}
+	return nil
+}
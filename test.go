@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+var testCmd = newCommand("test", "run the test scenarios of xlsforms against their logic")
+
+func init() {
+	in := inputFlags(testCmd.flags)
+	var testsFile string
+	testCmd.flags.StringVar(&testsFile, "tests", "", "json or yaml file with the scenarios, instead of form.tests.json or form.tests.yaml next to each form")
+	testCmd.run = func(files []string) bool {
+		return forEachFile(files, func(fileName string) error {
+			return runTests(fileName, testsFile, in)
+		})
+	}
+}
+
+// sidecarExts are the extensions of the files with the scenarios of a form,
+// which replace the extension of the form.
+var sidecarExts = []string{".tests.json", ".tests.yaml", ".tests.yml"}
+
+func runTests(xlsName, testsFile string, in *inputOptions) error {
+	xls, err := decodeFile(xlsName, in)
+	if err != nil {
+		return err
+	}
+	ajf, err := formats.Convert(xls)
+	if err != nil {
+		return fmt.Errorf("%s, %w", xlsName, err)
+	}
+	scenarios, err := formats.ScenariosFromSheet(xls, ajf)
+	if err != nil {
+		return fmt.Errorf("%s, %w", xlsName, err)
+	}
+
+	if testsFile == "" && xlsName != "-" {
+		base := strings.TrimSuffix(xlsName, filepath.Ext(xlsName))
+		for _, ext := range sidecarExts {
+			if _, err := os.Stat(base + ext); err == nil {
+				testsFile = base + ext
+				break
+			}
+		}
+	}
+	if testsFile != "" {
+		data, err := os.ReadFile(testsFile)
+		if err != nil {
+			return fmt.Errorf("Error reading tests: %s", err)
+		}
+		ext := strings.ToLower(filepath.Ext(testsFile))
+		more, err := formats.DecScenarios(data, ext == ".yaml" || ext == ".yml")
+		if err != nil {
+			return fmt.Errorf("Error decoding tests %s: %s", testsFile, err)
+		}
+		scenarios = append(scenarios, more...)
+	}
+	if len(scenarios) == 0 {
+		return fmt.Errorf("No test scenarios: add a tests sheet to the form, or a file like form%s.", sidecarExts[0])
+	}
+
+	fmt.Println(xlsName)
+	failed := 0
+	for _, sc := range scenarios {
+		problems := sc.Check(ajf)
+		if len(problems) == 0 {
+			fmt.Printf("  PASS %s\n", sc.Name)
+			continue
+		}
+		failed++
+		fmt.Printf("  FAIL %s\n", sc.Name)
+		for _, p := range problems {
+			fmt.Printf("       %s\n", p)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d scenarios failed.", failed, len(scenarios))
+	}
+	fmt.Printf("  %d scenarios passed.\n", len(scenarios))
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"go/token"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+var typesCmd = newCommand("types", "write typescript or go types of the submissions of xlsforms")
+
+type typesOptions struct {
+	lang string
+	pkg  string
+}
+
+func init() {
+	in := inputFlags(typesCmd.flags)
+	out := outputPathFlag(typesCmd.flags)
+	typesCmd.flags.Lookup("o").Usage = outputFileUsage
+	opts := new(typesOptions)
+	typesCmd.flags.StringVar(&opts.lang, "lang", "ts", "language of the types: ts (typescript) or go")
+	typesCmd.flags.StringVar(&opts.pkg, "package", "submissions", "package of the go types")
+	typesCmd.run = func(files []string) bool {
+		if opts.lang != "ts" && opts.lang != "go" {
+			fmt.Fprintln(os.Stderr, "The language must be ts or go.")
+			return false
+		}
+		if !token.IsIdentifier(opts.pkg) {
+			fmt.Fprintf(os.Stderr, "Invalid package name %q.\n", opts.pkg)
+			return false
+		}
+		if err := out.init(len(files)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return false
+		}
+		return forEachFile(files, func(fileName string) error {
+			return types(fileName, opts, in, out)
+		})
+	}
+}
+
+func types(xlsName string, opts *typesOptions, in *inputOptions, out *outputOptions) error {
+	outName, err := out.fileName(xlsName, "."+opts.lang)
+	if err != nil {
+		return err
+	}
+	xls, err := decodeFile(xlsName, in)
+	if err != nil {
+		return err
+	}
+	ajf, err := formats.Convert(xls)
+	if err != nil {
+		return fmt.Errorf("%s, %w", xlsName, err)
+	}
+	name := strings.TrimSuffix(filepath.Base(xlsName), filepath.Ext(xlsName))
+	if xlsName == "-" {
+		name = "Form"
+	}
+	err = out.write(outName, func(w io.Writer) error {
+		if opts.lang == "go" {
+			return formats.EncGoTypes(w, ajf, name, opts.pkg)
+		}
+		return formats.EncTypeScript(w, ajf, name)
+	})
+	if err != nil {
+		return fmt.Errorf("Error writing file %s: %s", outName, err)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+var validateCmd = newCommand("validate", "check that xlsforms can be converted, without writing output")
+
+func init() {
+	opts := inputFlags(validateCmd.flags)
+	diagFlags(validateCmd.flags)
+	validateCmd.run = func(files []string) bool {
+		return forEachFile(files, func(fileName string) error {
+			return validate(fileName, opts)
+		})
+	}
+}
+
+func validate(xlsName string, opts *inputOptions) error {
+	xls, err := decodeFile(xlsName, opts)
+	if err != nil {
+		return err
+	}
+	if _, err := formats.Convert(xls); err != nil {
+		return fmt.Errorf("%s, %w", xlsName, err)
+	}
+	if report.format == "text" {
+		fmt.Printf("%s: OK\n", xlsName)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var watchCmd = newCommand("watch", "watch directories and convert the xlsforms in them when they change")
+
+func init() {
+	watchCmd.args = "dir1 dir2..."
+	in := inputFlags(watchCmd.flags)
+	out := outputFlags(watchCmd.flags)
+	interval := watchCmd.flags.Duration("interval", time.Second, "how often the directories are checked for changes")
+	diagFlags(watchCmd.flags)
+	watchCmd.run = func(dirs []string) bool {
+		if out.path == "-" {
+			fmt.Fprintln(os.Stderr, "The output of watch can't be stdout.")
+			return false
+		}
+		if out.path != "" {
+			out.dir = true
+			if err := out.mkdir(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return false
+			}
+		}
+		w := watcher{files: make(map[string]*watchedFile)}
+		for {
+			for _, dir := range dirs {
+				if err := w.scan(dir); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+				}
+			}
+			w.convertStable(func(fileName string) {
+				err := decXlsEncAjf(fileName, in, out)
+				if report.toStdout() {
+					// A document for each conversion, with its diagnostics.
+					if err != nil {
+						report.error(fileName, err)
+					}
+					if err := report.flush(); err != nil {
+						fmt.Fprintf(os.Stderr, "Error writing diagnostics: %s\n", err)
+					}
+					return
+				}
+				now := time.Now().Format("15:04:05")
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s %s\n", now, err)
+				} else {
+					fmt.Printf("%s %s: converted\n", now, fileName)
+				}
+			})
+			time.Sleep(*interval)
+		}
+	}
+}
+
+// A watcher polls the modification times of xlsform files.
+// A file is converted when it has changed and then stayed unchanged
+// for a whole polling interval, so that it isn't read while being saved.
+type watcher struct {
+	files map[string]*watchedFile
+}
+
+type watchedFile struct {
+	modTime time.Time
+	size    int64
+	seen    bool // seen in the current scan
+	changed bool // changed in the current scan
+	pending bool // changed since the last conversion
+}
+
+// scan updates the state of the xlsform files in dir.
+func (w *watcher) scan(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("Error reading directory %s: %s", dir, err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !isFormFile(name) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue // removed in the meantime
+		}
+		path := filepath.Join(dir, name)
+		f := w.files[path]
+		if f == nil {
+			f = new(watchedFile)
+			w.files[path] = f
+		}
+		f.seen = true
+		f.changed = !info.ModTime().Equal(f.modTime) || info.Size() != f.size
+		if f.changed {
+			f.modTime, f.size, f.pending = info.ModTime(), info.Size(), true
+		}
+	}
+	return nil
+}
+
+// convertStable calls convert for the files that have changed
+// but didn't change in the last scan, and forgets the removed files.
+func (w *watcher) convertStable(convert func(fileName string)) {
+	var names []string
+	for name, f := range w.files {
+		if !f.seen {
+			delete(w.files, name)
+			continue
+		}
+		f.seen = false
+		if f.pending && !f.changed {
+			f.pending = false
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		convert(name)
+	}
+}